@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/daemon"
+)
+
+const commandUsage = `Commands:
+  up [section]      start the tunnel for a section in the background daemon
+  down [section]    stop a background tunnel
+  status [-json] [section]
+                    list background tunnels and their connections
+  logs [-n lines] [section]
+                    print the output of a background tunnel
+If no section is given then the -c section is used.  The daemon is started by up
+if it is not already running, and it exits once it has no tunnels left.
+`
+
+// runCommand runs one of the commands that manage background tunnels.  These talk to the daemon over its
+// control socket, except for the daemon command itself which is run by up.
+func runCommand(ctx context.Context, args *args, logger *slog.Logger) int {
+	command := args.commandArgs[0]
+
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	linesPtr := fs.Int("n", 100, "number of log lines to print, or 0 for all of them")
+	jsonPtr := fs.Bool("json", false, "print the status as JSON")
+
+	err := fs.Parse(args.commandArgs[1:])
+	if err != nil {
+		return exitUsageError
+	}
+
+	section := args.configSection
+	if fs.NArg() > 0 {
+		section = fs.Arg(0)
+	}
+
+	stateDir, err := daemon.StateDir()
+	if err != nil {
+		logger.Error("failed to find the daemon state directory", "error", err)
+
+		return exitTunnelError
+	}
+
+	socketPath := daemon.SocketPath(stateDir)
+	req := daemon.Request{Command: command, Section: section}
+
+	switch command {
+	case "daemon":
+		return runDaemon(ctx, socketPath, stateDir, logger)
+	case daemon.CommandUp:
+		req, err = upRequest(args, section)
+		if errors.Is(err, constants.ErrFlagNotAllowedWithUp) {
+			logger.Error("invalid flags for up", "error", err)
+
+			return exitUsageError
+		}
+
+		if err != nil {
+			logger.Error("failed to build request", "error", err)
+
+			return exitConfigError
+		}
+
+		err = daemon.EnsureRunning(stateDir)
+		if err != nil {
+			logger.Error("failed to start daemon", "error", err)
+
+			return exitTunnelError
+		}
+	case daemon.CommandDown, daemon.CommandLogs:
+	case daemon.CommandStatus:
+		// Unlike the other commands, status lists every tunnel unless a section is given.
+		req.Section = fs.Arg(0)
+	default:
+		logger.Error("unknown command", "command", command)
+		fmt.Fprint(os.Stderr, commandUsage)
+
+		return exitUsageError
+	}
+
+	req.Lines = *linesPtr
+
+	resp, err := daemon.Call(socketPath, req)
+
+	if resp != nil {
+		for _, line := range resp.Logs {
+			fmt.Println(line)
+		}
+
+		switch {
+		case command == daemon.CommandLogs:
+		case *jsonPtr:
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			_ = enc.Encode(resp.Tunnels)
+		default:
+			printTunnels(os.Stdout, resp.Tunnels)
+		}
+
+		// The status of a single tunnel also lists its active connections.
+		if command == daemon.CommandStatus && req.Section != "" && !*jsonPtr {
+			for _, t := range resp.Tunnels {
+				if t.Stats != nil {
+					fmt.Println()
+					_ = t.Stats.WriteText(os.Stdout)
+				}
+			}
+		}
+	}
+
+	if errors.Is(err, constants.ErrDaemonNotRunning) && command == daemon.CommandStatus {
+		fmt.Println("no tunnels are running")
+
+		return exitOK
+	}
+
+	if err != nil {
+		logger.Error("command failed", "command", command, "error", err)
+
+		return exitTunnelError
+	}
+
+	return exitOK
+}
+
+// upForwardedFlags are the flags that up passes on to the tunnel when they are set.  The value says whether
+// the flag holds a path, which is made absolute because the daemon runs in a different directory.
+var upForwardedFlags = map[string]bool{
+	"metrics-listen": false,
+	"trace-otlp":     false,
+	"trace-file":     true,
+	"log-format":     false,
+	"log-file":       true,
+	"log-max-size":   false,
+	"log-level":      false,
+}
+
+// upRejectedFlags cannot be passed on to the tunnel.  The daemon gives each tunnel its own ready file and
+// stats socket, and a file descriptor belongs to the process that up runs in.
+var upRejectedFlags = map[string]bool{
+	"ready-file":   true,
+	"ready-fd":     true,
+	"ready-format": true,
+	"stats-socket": true,
+}
+
+// upFlags returns the flags that were set on the command line and should be passed on to the tunnel.
+func upFlags() ([]string, error) {
+	var (
+		flags []string
+		err   error
+	)
+
+	flag.Visit(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+
+		if upRejectedFlags[f.Name] {
+			err = fmt.Errorf("%w: -%s", constants.ErrFlagNotAllowedWithUp, f.Name)
+
+			return
+		}
+
+		isPath, ok := upForwardedFlags[f.Name]
+		if !ok {
+			return
+		}
+
+		value := f.Value.String()
+		if isPath && value != "" {
+			value, err = filepath.Abs(value)
+		}
+
+		flags = append(flags, "-"+f.Name, value)
+	})
+
+	return flags, err
+}
+
+// upRequest resolves the configuration file and the working directory now, because the daemon runs in a
+// different directory.
+func upRequest(args *args, section string) (daemon.Request, error) {
+	flags, err := upFlags()
+	if err != nil {
+		return daemon.Request{}, err
+	}
+
+	configFile, err := filepath.Abs(args.configFile)
+	if err != nil {
+		return daemon.Request{}, err
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return daemon.Request{}, err
+	}
+
+	return daemon.Request{
+		Command:    daemon.CommandUp,
+		Section:    section,
+		ConfigFile: configFile,
+		Dir:        dir,
+		Env:        os.Environ(),
+		Verbose:    args.verbose,
+		Flags:      flags,
+	}, nil
+}
+
+func runDaemon(ctx context.Context, socketPath string, stateDir string, logger *slog.Logger) int {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err := daemon.NewDaemon(socketPath, stateDir, logger).Run(ctx)
+	if err != nil {
+		logger.Error("daemon failed", "error", err)
+
+		return exitTunnelError
+	}
+
+	return exitOK
+}
+
+func printTunnels(w io.Writer, tunnels []daemon.TunnelStatus) {
+	if len(tunnels) == 0 {
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "SECTION\tSTATE\tPID\tADDRESS\tUPTIME\tCONNS\tTO REMOTE\tFROM REMOTE")
+
+	for _, t := range tunnels {
+		address, uptime, conns, toRemote, fromRemote := "-", "-", "-", "-", "-"
+
+		if t.Stats != nil {
+			conns = fmt.Sprintf("%d/%d", t.Stats.ActiveConnections, t.Stats.TotalConnections)
+			toRemote = strconv.FormatUint(t.Stats.BytesToRemote, 10)
+			fromRemote = strconv.FormatUint(t.Stats.BytesFromRemote, 10)
+		}
+
+		switch {
+		case t.Ready != nil && t.Ready.Socket != "":
+			address = t.Ready.Socket
+		case t.Ready != nil:
+			address = net.JoinHostPort(t.Ready.Host, strconv.Itoa(t.Ready.Port))
+		}
+
+		state := t.State
+		if t.State == daemon.StateExited {
+			state = fmt.Sprintf("%s (%d)", t.State, t.ExitCode)
+		} else {
+			uptime = time.Since(t.Started).Round(time.Second).String()
+		}
+
+		_, _ = fmt.Fprintf(
+			tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			t.Section, state, t.Pid, address, uptime, conns, toRemote, fromRemote,
+		)
+	}
+
+	_ = tw.Flush()
+}
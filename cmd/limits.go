@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/config"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+)
+
+// idleCheckInterval is the longest that watchSessionLimits waits between checks for connections.
+const idleCheckInterval = time.Second
+
+// watchSessionLimits stops the tunnel, by cancelling ctx, once there have been no connections for
+// idle_timeout or once it has been running for max_duration.  Cancelling ctx also stops the exec command,
+// in the same way as when the tunnel fails.
+func watchSessionLimits(
+	ctx context.Context,
+	cancel context.CancelCauseFunc,
+	cfg *config.Config,
+	tunnelStats *stats.Stats,
+	logger *slog.Logger,
+) {
+	var idleCheck <-chan time.Time
+
+	if cfg.IdleTimeout > 0 {
+		ticker := time.NewTicker(min(cfg.IdleTimeout, idleCheckInterval))
+		defer ticker.Stop()
+
+		idleCheck = ticker.C
+	}
+
+	var warning, deadline <-chan time.Time
+
+	warnBefore := cfg.MaxDurationWarning
+	if warnBefore <= 0 {
+		warnBefore = config.DefaultMaxDurationWarning
+	}
+
+	if cfg.MaxDuration > 0 {
+		deadline = time.After(cfg.MaxDuration)
+
+		// If the warning would be due before the tunnel is even ready then there is nothing to warn about.
+		if warnBefore < cfg.MaxDuration {
+			warning = time.After(cfg.MaxDuration - warnBefore)
+		}
+	}
+
+	// A connection that opened and closed between checks is spotted by the total going up.
+	idleSince := time.Now()
+	total := tunnelStats.TotalCount()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-warning:
+			logger.Warn("the tunnel will stop soon because of max_duration", "stopIn", warnBefore)
+		case <-deadline:
+			logger.Warn("stopping because the tunnel has reached max_duration", "maxDuration", cfg.MaxDuration)
+			cancel(constants.ErrMaxDuration)
+
+			return
+		case <-idleCheck:
+			if newTotal := tunnelStats.TotalCount(); newTotal != total || tunnelStats.ActiveCount() > 0 {
+				idleSince = time.Now()
+				total = newTotal
+
+				continue
+			}
+
+			if time.Since(idleSince) >= cfg.IdleTimeout {
+				logger.Info("stopping because there have been no connections", "idleTimeout", cfg.IdleTimeout)
+				cancel(constants.ErrIdleTimeout)
+
+				return
+			}
+		}
+	}
+}
+
+// sessionLimitExitCode returns the exit code to use if ctx was cancelled by watchSessionLimits.  The second
+// result is false if it was cancelled for any other reason.
+func sessionLimitExitCode(ctx context.Context) (int, bool) {
+	cause := context.Cause(ctx)
+
+	switch {
+	case errors.Is(cause, constants.ErrIdleTimeout):
+		return exitOK, true
+	case errors.Is(cause, constants.ErrMaxDuration):
+		return exitMaxDuration, true
+	default:
+		return 0, false
+	}
+}
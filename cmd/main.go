@@ -2,31 +2,78 @@ package main
 
 import (
 	"context"
-	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
 	"net"
 	"os"
+	"slices"
+	"strconv"
+	"time"
 
+	"github.com/LaoZhuBaba/iapgo/v2/internal/audit"
 	"github.com/LaoZhuBaba/iapgo/v2/internal/config"
 	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
 	"github.com/LaoZhuBaba/iapgo/v2/internal/exec"
 	"github.com/LaoZhuBaba/iapgo/v2/internal/iap"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/listener"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/logging"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/metrics"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/readiness"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/readyfile"
 	"github.com/LaoZhuBaba/iapgo/v2/internal/ssh"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/tracing"
 	"github.com/LaoZhuBaba/iapgo/v2/internal/util"
+	"go.opentelemetry.io/otel/attribute"
 	cryptoSsh "golang.org/x/crypto/ssh"
 )
 
 const (
 	defaultConfigFileName = "iapgo.yaml"
 	defaultConfigSection  = "default"
+	// How long to wait for buffered spans to be exported when iapgo exits.
+	traceShutdownTimeout = 5 * time.Second
+)
+
+// Exit codes.  These are based on sysexits.h so that they are unlikely to be confused with the exit code of
+// the exec command, which is used when terminate_after_exec is set.
+const (
+	exitOK = 0
+	// The command line flags are invalid.  This matches the exit code used by the flag package.
+	exitUsageError = 2
+	// The IAP or SSH tunnel could not be started, failed while running or the readiness probe failed.
+	exitTunnelError = 69
+	// A before_start hook failed.
+	exitHookError = 70
+	// The tunnel was stopped because it reached max_duration.  This is EX_TEMPFAIL, as the user may want
+	// to start it again.
+	exitMaxDuration = 75
+	// The configuration file could not be read or is invalid.
+	exitConfigError = 78
+	// A second SIGINT or SIGTERM was received while connections were draining.  This matches the exit code
+	// a shell reports for a process killed by SIGINT.
+	exitInterrupted = 130
 )
 
 type args struct {
 	configFile    string
 	configSection string
 	verbose       bool
+	readyFile     string
+	readyFd       int
+	readyFormat   string
+	statsSocket   string
+	metricsListen string
+	traceOtlp     string
+	traceFile     string
+	logFormat     string
+	logFile       string
+	logMaxSize    int
+	logLevels     string
+	// commandArgs holds any arguments after the flags.  If there are any then the first is a command
+	// such as up or status.
+	commandArgs []string
 }
 
 func getArgs() *args {
@@ -42,11 +89,68 @@ func getArgs() *args {
 		"select a non-default configuration file",
 	)
 	verbosePtr := flag.Bool("v", false, "print debugging messages")
+	readyFilePtr := flag.String(
+		"ready-file",
+		"",
+		"write connection details to this file once the tunnel is ready and remove it on exit",
+	)
+	readyFdPtr := flag.Int(
+		"ready-fd",
+		-1,
+		"write connection details to this inherited file descriptor once the tunnel is ready",
+	)
+	readyFormatPtr := flag.String(
+		"ready-format",
+		"",
+		"format of the connection details: json or dotenv (default dotenv for a .env ready file, otherwise json)",
+	)
+
+	statsSocketPtr := flag.String(
+		"stats-socket",
+		"",
+		"serve connection statistics as JSON on this Unix domain socket",
+	)
+
+	metricsListenPtr := flag.String(
+		"metrics-listen",
+		"",
+		"serve Prometheus metrics on http://ADDRESS/metrics, e.g., localhost:9090",
+	)
+
+	traceOtlpPtr := flag.String(
+		"trace-otlp",
+		"",
+		"export OpenTelemetry traces to this OTLP/HTTP endpoint, e.g., http://localhost:4318",
+	)
+
+	traceFilePtr := flag.String(
+		"trace-file",
+		"",
+		"append OpenTelemetry traces to this file as JSON",
+	)
+
+	logFormatPtr := flag.String("log-format", logging.FormatText, "format of log messages: text or json")
+	logFilePtr := flag.String(
+		"log-file",
+		"",
+		"write log messages to this file instead of stderr, rotating it when it reaches -log-max-size",
+	)
+	logMaxSizePtr := flag.Int(
+		"log-max-size",
+		logging.DefaultMaxFileSize/(1024*1024),
+		"size in MiB at which the log file is rotated",
+	)
+	logLevelsPtr := flag.String(
+		"log-level",
+		"",
+		"comma separated log levels, optionally per component (config, iap, ssh or exec), e.g., warn,ssh=debug",
+	)
 
 	flag.Parse()
 
 	if *helpPtr {
 		flag.Usage()
+		fmt.Printf("\n%s", commandUsage)
 		fmt.Printf("\nExample configuration file...\n")
 		fmt.Printf("%s\n", config.ExampleConfig)
 
@@ -56,59 +160,251 @@ func getArgs() *args {
 		configFile:    *configFilePtr,
 		configSection: *configSectionPtr,
 		verbose:       *verbosePtr,
+		readyFile:     *readyFilePtr,
+		readyFd:       *readyFdPtr,
+		readyFormat:   *readyFormatPtr,
+		statsSocket:   *statsSocketPtr,
+		metricsListen: *metricsListenPtr,
+		traceOtlp:     *traceOtlpPtr,
+		traceFile:     *traceFilePtr,
+		logFormat:     *logFormatPtr,
+		logFile:       *logFilePtr,
+		logMaxSize:    *logMaxSizePtr,
+		logLevels:     *logLevelsPtr,
+		commandArgs:   flag.Args(),
 	}
 }
 
 func main() {
+	os.Exit(run())
+}
+
+// run contains everything that would normally be in main so that deferred functions complete before
+// os.Exit is called with the exit code that run returns.  The result is named so that the audit log can
+// record it.
+func run() (code int) {
 	ctx, cancel := context.WithCancelCause(context.Background())
 	defer cancel(nil)
 
 	args := getArgs()
 	if args == nil {
 		// This means that the -h flag was passed.
-		return
+		return exitOK
 	}
 
-	var logLevel slog.LevelVar
-	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-		Level: &logLevel,
-	}))
+	logger, logCloser, err := logging.New(logging.Options{
+		Format:      args.logFormat,
+		File:        args.logFile,
+		MaxFileSize: int64(args.logMaxSize) * 1024 * 1024,
+		Verbose:     args.verbose,
+		Levels:      args.logLevels,
+	})
+	if err != nil {
+		slog.Error("invalid command line flags", "error", err)
+
+		return exitUsageError
+	}
+
+	defer func() { _ = logCloser.Close() }()
+
 	slog.SetDefault(logger)
 
-	if args.verbose {
-		logLevel.Set(slog.LevelDebug)
+	configLogger := logging.ForComponent(logger, logging.ComponentConfig)
+	iapLogger := logging.ForComponent(logger, logging.ComponentIap)
+	sshLogger := logging.ForComponent(logger, logging.ComponentSsh)
+	execLogger := logging.ForComponent(logger, logging.ComponentExec)
+
+	if len(args.commandArgs) > 0 {
+		return runCommand(ctx, args, logger)
 	}
 
-	cfg, err := config.GetConfig(ctx, args.configFile, args.configSection, logger)
+	// Registered before anything that needs cleaning up so that a signal never kills iapgo before the
+	// after_stop hooks and the other deferred functions have run.
+	sd := newShutdown()
+	defer sd.stop()
+
+	// Until the tunnel is ready a signal cancels ctx, which stops whichever start up step is in progress.
+	stopCancelOnSignal := sd.cancelOnSignal(cancel, logger)
 
+	readyFormat, err := readyfile.FormatForPath(args.readyFile, args.readyFormat)
 	if err != nil {
-		logger.Debug("failed to load configuration", "error", err)
+		logger.Error("invalid command line flags", "error", err)
 
-		return
+		return exitUsageError
+	}
+
+	if args.traceOtlp != "" || args.traceFile != "" {
+		shutdownTracing, err := tracing.Setup(ctx, args.traceOtlp, args.traceFile, args.configSection)
+		if err != nil {
+			logger.Error("invalid command line flags", "error", err)
+
+			return exitUsageError
+		}
+
+		// Registered first so that it runs last and includes the spans ended by the other deferred functions.
+		defer func() {
+			shutdownCtx, cancelShutdown := context.WithTimeout(context.WithoutCancel(ctx), traceShutdownTimeout)
+			defer cancelShutdown()
+
+			err := shutdownTracing(shutdownCtx)
+			if err != nil {
+				logger.Warn("failed to export traces", "error", err)
+			}
+		}()
+	}
+
+	// startSpan covers everything from loading the configuration until the tunnel is ready.
+	startCtx, startSpan := tracing.Tracer().Start(ctx, "iapgo.start")
+	defer startSpan.End()
+
+	cfg, err := config.GetConfig(startCtx, args.configFile, args.configSection, configLogger)
+
+	if err != nil {
+		logger.Error("failed to load configuration", "error", err)
+		_ = tracing.RecordError(startSpan, err)
+
+		return startExitCode(ctx, exitConfigError)
+	}
+
+	startSpan.SetAttributes(
+		attribute.String("iapgo.section", args.configSection),
+		attribute.String("iapgo.instance", cfg.Instance),
+	)
+
+	logger.Debug("config", "cfgMap[*configSectionPtr]", cfg.Redacted())
+
+	execOpts := exec.Options{
+		Args:              cfg.Exec,
+		Env:               cfg.Env,
+		EnvFile:           cfg.EnvFile,
+		WorkDir:           cfg.WorkDir,
+		GracePeriod:       cfg.ExecGracePeriod,
+		Restart:           cfg.Restart,
+		RestartMaxRetries: cfg.RestartMaxRetries,
+		RestartBackoff:    cfg.RestartBackoff,
+		RestartMaxBackoff: cfg.RestartMaxBackoff,
+		Section:           args.configSection,
+		Instance:          cfg.Instance,
 	}
 
-	logger.Debug("config", "cfgMap[*configSectionPtr]", *cfg)
+	// Check any {{...}} placeholders in the exec and hook arguments now rather than after the tunnel
+	// has started.
+	for _, cmdArgs := range slices.Concat([][]string{cfg.Exec}, cfg.BeforeStart, cfg.AfterReady, cfg.AfterStop) {
+		checkOpts := execOpts
+		checkOpts.Args = cmdArgs
 
-	// If SSH tunnelling is being used then localIapPort should be zero.  This means the iapLsnr will
-	// use a random ephemeral port.  If SSH tunnelling is not being used then localIapPort should be set
-	// to the value of cfg.LocalPort (which will also be zero if value is not configured).
-	var localIapPort int
+		_, err = exec.ExpandArgs(checkOpts, exec.Endpoint{})
+		if err != nil {
+			logger.Error("failed to load configuration", "error", err)
+
+			return exitConfigError
+		}
+	}
 
 	// Because the listener port we get from the config may be zero we need to check the actual
-	// value that RunCmd() uses to set the $IAPGO_LISTEN_POR environment variable.  Also, the port
+	// value that RunCmd() uses to set the $IAPGO_LISTEN_PORT environment variable.  Also, the port
 	// that RunCmd needs may be the IAP listener port or the SSH listener port, depending on config.
-	var sshLsnrPort, portForRunCmd int
+	var (
+		sshLsnrPort, iapLsnrPort int
+		iapLsnr                  net.Listener
+	)
+
+	endpointForRunCmd := exec.Endpoint{Host: cfg.ListenHost()}
+
+	if cfg.LocalSocket != nil {
+		endpointForRunCmd = exec.Endpoint{Socket: cfg.LocalSocket.Path}
+	}
+
+	// The listener has not been created yet so the before_start hooks see local_port, which may be zero.
+	endpointForRunCmd.Port = cfg.LocalPort
+
+	err = exec.RunHooks(ctx, "before_start", cfg.BeforeStart, execOpts, endpointForRunCmd, execLogger)
+	if err != nil {
+		logger.Error("before_start hook failed so the tunnel will not be started", "error", err)
+
+		return startExitCode(ctx, exitHookError)
+	}
+
+	// Registered here so that after_stop runs after the deferred listener closes below, and even if the
+	// tunnel fails to start.  The context may already have been cancelled so it is not used.
+	defer func() {
+		err := exec.RunHooks(
+			context.WithoutCancel(ctx), "after_stop", cfg.AfterStop, execOpts, endpointForRunCmd, execLogger,
+		)
+		if err != nil {
+			logger.Error("after_stop hook failed", "error", err)
+		}
+	}()
+
+	var auditLog *audit.Log
+
+	if cfg.AuditLog != "" {
+		auditLog, err = startAuditSession(cfg, args.configSection, logger)
+		if err != nil {
+			logger.Error("failed to open audit log", "error", err)
+
+			return exitConfigError
+		}
+
+		sessionStart := time.Now()
+
+		defer func() {
+			auditLog.Write(audit.Record{
+				Event:           audit.EventSessionStop,
+				DurationSeconds: time.Since(sessionStart).Seconds(),
+				ExitCode:        &code,
+			})
+
+			_ = auditLog.Close()
+		}()
+	}
+
+	tunnelStats := stats.New(args.configSection)
+
+	stopStatsDump := dumpStatsOnSignal(tunnelStats, logger)
+	defer stopStatsDump()
+
+	if args.statsSocket != "" {
+		statsLsnr, err := listener.ListenUnix(&config.LocalSocketCfg{Path: args.statsSocket}, logger)
+		if err != nil {
+			logger.Error("failed to listen (statsLsnr)", "error", err)
+
+			return exitTunnelError
+		}
+
+		defer func() { _ = statsLsnr.Close() }()
+
+		go tunnelStats.Serve(statsLsnr, logger)
+	}
+
+	if args.metricsListen != "" {
+		metricsLsnr, err := net.Listen("tcp", args.metricsListen)
+		if err != nil {
+			logger.Error("failed to listen (metricsLsnr)", "error", err)
+
+			return exitTunnelError
+		}
+
+		defer func() { _ = metricsLsnr.Close() }()
+
+		logger.Debug("serving metrics", "addr", metricsLsnr.Addr())
+
+		go metrics.Serve(metricsLsnr, tunnelStats, logger)
+	}
 
 	if cfg.SshTunnel == nil {
-		localIapPort = cfg.LocalPort
+		// Clients connect directly to the IAP listener so it uses local_port or local_socket.
+		iapLsnr, err = listener.Listen(cfg, iapLogger)
+	} else {
+		// If SSH tunnelling is being used then the IAP listener is only used by the SSH client, so it
+		// uses a random ephemeral port.
+		iapLsnr, err = listener.ListenLoopback(cfg, iapLogger)
 	}
 
-	// This is the localhost TCP port that connects to the IAP tunnel.
-	iapLsnr, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", localIapPort))
 	if err != nil {
 		logger.Error("failed to listen (iapLsnr)", "error", err)
 
-		return
+		return exitTunnelError
 	}
 
 	defer func() {
@@ -117,27 +413,30 @@ func main() {
 		_ = iapLsnr.Close()
 	}()
 
-	iapLsnrPort, err := util.GetPortFromTcpAddr(iapLsnr, logger)
-	if err != nil {
-		logger.Error("failed to get port from IAP listener", "error", err)
+	if cfg.SshTunnel != nil || cfg.LocalSocket == nil {
+		iapLsnrPort, err = util.GetPortFromTcpAddr(iapLsnr, logger)
+		if err != nil {
+			logger.Error("failed to get port from IAP listener", "error", err)
 
-		return
-	}
+			return exitTunnelError
+		}
 
-	logger.Debug("iapLsnr is listening on TCP port", "port", iapLsnrPort)
+		logger.Debug("iapLsnr is listening on TCP port", "port", iapLsnrPort)
+	}
 
-	tun, err := iap.NewIapTunnel(cfg, iapLsnr, logger)
+	tun, err := iap.NewIapTunnel(cfg, iapLsnr, tunnelStats, auditLog, iapLogger)
 	if err != nil {
 		logger.Error("failed to create an IAP tunnel manager", "error", err)
 
-		return
+		return exitTunnelError
 	}
 
-	err = tun.Start(ctx)
+	err = tun.Start(startCtx)
 	if err != nil {
 		logger.Error("failed to start IAP tunnel manager", "error", err)
+		_ = tracing.RecordError(startSpan, err)
 
-		return
+		return startExitCode(ctx, exitTunnelError)
 	}
 
 	// Pick up any errors from tunnelMgr, log these and cancel the context.
@@ -157,15 +456,20 @@ func main() {
 		return
 	}()
 
+	// These are closed first when iapgo stops so that no new connections are accepted while the open ones
+	// drain.
+	drainListeners := []net.Listener{iapLsnr}
+
 	// pass ssh.Dial so we can test with a fake dialer
 	if cfg.SshTunnel != nil {
-		sshTunnel := ssh.NewSshTunnel(cfg, cryptoSsh.Dial, iapLsnrPort, sshLsnrPort, logger)
+		sshTunnel := ssh.NewSshTunnel(cfg, cryptoSsh.Dial, iapLsnrPort, sshLsnrPort, tunnelStats, auditLog, sshLogger)
 
-		err = sshTunnel.Start(ctx)
+		err = sshTunnel.Start(startCtx)
 		if err != nil {
 			logger.Error("failed to start ssh tunnel", "error", err)
+			_ = tracing.RecordError(startSpan, err)
 
-			return
+			return startExitCode(ctx, exitTunnelError)
 		}
 
 		sshLsnrPort = sshTunnel.GetLsnrPort()
@@ -177,30 +481,170 @@ func main() {
 
 			_ = sshTunnel.Listener.Close()
 		}()
+
+		drainListeners = append([]net.Listener{sshTunnel.Listener}, drainListeners...)
+	}
+
+	// Registered after the listener closes above so that it runs before them, while the tunnel is still up.
+	defer sd.drain(ctx, cfg, drainListeners, tunnelStats, logger)
+
+	if cfg.SshTunnel == nil {
+		endpointForRunCmd.Port = iapLsnrPort
+	} else {
+		endpointForRunCmd.Port = sshLsnrPort
+	}
+
+	if cfg.Readiness != nil {
+		network, address := "tcp", net.JoinHostPort(endpointForRunCmd.Host, strconv.Itoa(endpointForRunCmd.Port))
+		if endpointForRunCmd.Socket != "" {
+			network, address = "unix", endpointForRunCmd.Socket
+		}
+
+		probeStart := time.Now()
+
+		probeCtx, probeSpan := tracing.Tracer().Start(startCtx, "readiness.wait")
+		probeSpan.SetAttributes(attribute.String("iapgo.readiness.type", cfg.Readiness.Type))
+
+		err = readiness.Wait(probeCtx, cfg.Readiness, network, address, tunnelStats, logger)
+		_ = tracing.RecordError(probeSpan, err)
+
+		probeSpan.End()
+
+		if err != nil {
+			logger.Error("remote service did not become ready", "error", err)
+			_ = tracing.RecordError(startSpan, err)
+
+			return startExitCode(ctx, exitTunnelError)
+		}
+
+		tunnelStats.SetReadinessLatency(time.Since(probeStart))
+	}
+
+	startSpan.End()
+
+	// From now on signals are handled by wait, drain or RunCmd.  One may have arrived just before this.
+	stopCancelOnSignal()
+
+	if stoppedBySignal(ctx) {
+		return exitOK
+	}
+
+	readyInfo := readyfile.Info{
+		Section:  args.configSection,
+		Instance: cfg.Instance,
+		Host:     endpointForRunCmd.Host,
+		Port:     endpointForRunCmd.Port,
+		Socket:   endpointForRunCmd.Socket,
+		Pid:      os.Getpid(),
+	}
+
+	if endpointForRunCmd.Socket == "" {
+		readyInfo.Ports = map[string]int{args.configSection: endpointForRunCmd.Port}
+	}
+
+	if args.readyFile != "" {
+		err = readyfile.WriteFile(args.readyFile, readyFormat, readyInfo)
+		if err != nil {
+			logger.Error("failed to write ready file", "error", err)
+
+			return exitTunnelError
+		}
+
+		defer func() {
+			logger.Debug("removing ready file", "path", args.readyFile)
+
+			_ = os.Remove(args.readyFile)
+		}()
+	}
+
+	if args.readyFd >= 0 {
+		err = readyfile.WriteFd(args.readyFd, readyFormat, readyInfo)
+		if err != nil {
+			logger.Error("failed to write ready file descriptor", "error", err)
+
+			return exitTunnelError
+		}
+	}
+
+	err = exec.RunHooks(ctx, "after_ready", cfg.AfterReady, execOpts, endpointForRunCmd, execLogger)
+	if err != nil {
+		logger.Error("after_ready hook failed", "error", err)
+	}
+
+	if cfg.IdleTimeout > 0 || cfg.MaxDuration > 0 {
+		go watchSessionLimits(ctx, cancel, cfg, tunnelStats, logger)
 	}
 
 	if cfg.Exec == nil {
 		logger.Debug("no Exec command so wait forever.  Enter Control-C to exit.")
-		<-ctx.Done()
-		if errors.Is(ctx.Err(), context.Canceled) {
-			logger.Error("context canceled with error", "error", context.Cause(ctx))
+
+		return sd.wait(ctx, logger)
+	}
+
+	// The deferred listener closes only run after RunCmd returns, so the tunnel stays up until the command
+	// has exited.
+	exitCode, stopRequested := exec.RunCmd(ctx, execOpts, endpointForRunCmd, execLogger)
+
+	if sd.received() {
+		stopRequested = true
+	}
+
+	if ctx.Err() != nil {
+		if limitCode, ok := sessionLimitExitCode(ctx); ok {
+			return limitCode
 		}
-		return
+
+		logger.Error("command was stopped because the tunnel failed", "error", context.Cause(ctx))
+
+		return exitTunnelError
 	}
 
-	if cfg.SshTunnel == nil {
-		portForRunCmd = iapLsnrPort
-	} else {
-		portForRunCmd = sshLsnrPort
+	if cfg.TerminateAfterExec {
+		return exitCode
 	}
 
-	exec.RunCmd(ctx, cfg.Exec, portForRunCmd, logger)
+	// The signal that stopped the command was meant for iapgo as well, so stop now rather than waiting for
+	// another one.
+	if stopRequested {
+		logger.Info("received signal while the command was running so stopping")
 
-	if !cfg.TerminateAfterExec {
-		logger.Debug("terminate_after_exec is not set so wait forever.  Enter Control-C to exit.")
-		<-ctx.Done()
-		if errors.Is(ctx.Err(), context.Canceled) {
-			logger.Error("context canceled with error", "error", context.Cause(ctx))
-		}
+		return exitOK
+	}
+
+	logger.Debug("terminate_after_exec is not set so wait forever.  Enter Control-C to exit.")
+
+	return sd.wait(ctx, logger)
+}
+
+// startAuditSession opens the audit log and records who is starting the tunnel and where it goes.  The GCP
+// principal is looked up even if the POSIX account is configured, but failing to find it is not fatal.
+func startAuditSession(cfg *config.Config, section string, logger *slog.Logger) (*audit.Log, error) {
+	auditLog, err := audit.Open(cfg.AuditLog, section, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	principal, err := util.GetGcpLogin()
+	if err != nil {
+		logger.Warn("failed to get gcp login for the audit log", "error", err)
+	}
+
+	rec := audit.Record{
+		Event:      audit.EventSessionStart,
+		Principal:  principal,
+		Project:    cfg.ProjectID,
+		Zone:       cfg.Zone,
+		Instance:   cfg.Instance,
+		RemotePort: cfg.RemotePort,
 	}
+
+	if cfg.SshTunnel != nil {
+		rec.PosixAccount = cfg.SshTunnel.AccountName
+		rec.TunnelTo = cfg.SshTunnel.TunnelTo
+		rec.RemoteSocket = cfg.SshTunnel.RemoteSocket
+	}
+
+	auditLog.Write(rec)
+
+	return auditLog, nil
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/config"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+)
+
+// stopSignals are the signals that ask iapgo to stop.
+var stopSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// closeSettleTime is how long drain waits after force-closing connections.
+const closeSettleTime = 100 * time.Millisecond
+
+// shutdown turns SIGINT and SIGTERM into a graceful stop.  The signals are caught from when it is created
+// until stop is called, so they never kill iapgo before deferred clean up such as draining connections and
+// the after_stop hooks has run.  While the tunnel is starting a signal cancels the start up (see
+// cancelOnSignal), and while the exec command is running RunCmd passes the signals on to the command.
+type shutdown struct {
+	sigCh chan os.Signal
+}
+
+func newShutdown() *shutdown {
+	s := &shutdown{sigCh: make(chan os.Signal, 1)}
+	signal.Notify(s.sigCh, stopSignals...)
+
+	return s
+}
+
+// stop stops catching SIGINT and SIGTERM.
+func (s *shutdown) stop() {
+	signal.Stop(s.sigCh)
+}
+
+// cancelOnSignal calls cancel with constants.ErrStopSignal if SIGINT or SIGTERM is received before the
+// returned function is called.  It is used while the tunnel is starting, so that a signal stops whichever
+// start up step is in progress.
+func (s *shutdown) cancelOnSignal(cancel context.CancelCauseFunc, logger *slog.Logger) func() {
+	done := make(chan struct{})
+	exited := make(chan struct{})
+
+	go func() {
+		defer close(exited)
+
+		select {
+		case <-s.sigCh:
+			logger.Info("received signal while starting so stopping")
+			cancel(constants.ErrStopSignal)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-exited
+	}
+}
+
+// received reports whether SIGINT or SIGTERM has been received since it was last checked.  RunCmd handles
+// the signals that arrive while the exec command runs, so their copy here is discarded so that drain does
+// not take it as a second signal.
+func (s *shutdown) received() bool {
+	select {
+	case <-s.sigCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// stoppedBySignal reports whether ctx was cancelled by cancelOnSignal.
+func stoppedBySignal(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), constants.ErrStopSignal)
+}
+
+// startExitCode returns code for a start up step that failed, unless it failed because a signal cancelled
+// ctx, which means that iapgo is stopping as it was asked to.
+func startExitCode(ctx context.Context, code int) int {
+	if stoppedBySignal(ctx) {
+		return exitOK
+	}
+
+	return code
+}
+
+// wait blocks until either the tunnel fails, it reaches idle_timeout or max_duration, or iapgo receives
+// SIGINT or SIGTERM.
+func (s *shutdown) wait(ctx context.Context, logger *slog.Logger) int {
+	select {
+	case <-s.sigCh:
+		logger.Info("received signal so stopping")
+
+		return exitOK
+	case <-ctx.Done():
+	}
+
+	if code, ok := sessionLimitExitCode(ctx); ok {
+		return code
+	}
+
+	if errors.Is(ctx.Err(), context.Canceled) {
+		logger.Error("context canceled with error", "error", context.Cause(ctx))
+	}
+
+	return exitTunnelError
+}
+
+// drain stops new connections by closing the listeners, then gives the open connections up to
+// drain_timeout to finish before closing them.  Receiving SIGINT or SIGTERM while draining makes iapgo
+// exit immediately.
+func (s *shutdown) drain(
+	ctx context.Context,
+	cfg *config.Config,
+	listeners []net.Listener,
+	tunnelStats *stats.Stats,
+	logger *slog.Logger,
+) {
+	for _, lsnr := range listeners {
+		_ = lsnr.Close()
+	}
+
+	active := tunnelStats.ActiveCount()
+	if active == 0 {
+		return
+	}
+
+	timeout := cfg.DrainTimeout
+	if timeout <= 0 {
+		timeout = config.DefaultDrainTimeout
+	}
+
+	logger.Info(
+		"waiting for connections to finish, press Control-C again to exit immediately",
+		"active", active,
+		"timeout", timeout,
+	)
+
+	// If the tunnel has failed then the connections cannot finish so there is no point waiting, and
+	// max_duration is a hard stop.
+	drainCtx, cancelDrain := context.WithTimeout(ctx, timeout)
+	defer cancelDrain()
+
+	idle := make(chan error, 1)
+
+	go func() { idle <- tunnelStats.WaitIdle(drainCtx) }()
+
+	select {
+	case err := <-idle:
+		if err == nil {
+			logger.Debug("all connections finished")
+
+			return
+		}
+
+		logger.Warn("connections did not finish in time so closing them", "active", tunnelStats.CloseActive())
+
+		// Give the code copying data a moment to notice that the connections have closed so that, for
+		// example, their audit records are written.
+		time.Sleep(closeSettleTime)
+	case sig := <-s.sigCh:
+		logger.Warn("received another signal so exiting immediately", "signal", sig)
+		os.Exit(exitInterrupted)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+)
+
+// dumpStatsOnSignal writes the tunnel's statistics to stderr each time iapgo receives SIGUSR1, until the
+// returned function is called.
+func dumpStatsOnSignal(tunnelStats *stats.Stats, logger *slog.Logger) func() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGUSR1)
+
+	go func() {
+		for range sigCh {
+			err := tunnelStats.Snapshot().WriteText(os.Stderr)
+			if err != nil {
+				logger.Error("failed to write stats", "error", err)
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigCh)
+		close(sigCh)
+	}
+}
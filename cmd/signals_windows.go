@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+import (
+	"log/slog"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+)
+
+// dumpStatsOnSignal does nothing because Windows has no SIGUSR1.  Use -stats-socket instead.
+func dumpStatsOnSignal(_ *stats.Stats, _ *slog.Logger) func() {
+	return func() {}
+}
@@ -0,0 +1,213 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+)
+
+// Audit log events.
+const (
+	EventSessionStart    = "session_start"
+	EventSessionStop     = "session_stop"
+	EventSshSessionStart = "ssh_session_start"
+	EventConnectionOpen  = "connection_open"
+	EventConnectionClose = "connection_close"
+)
+
+// Record is one line of the audit log.  Every record has the time, event, section and process ID.  The
+// other fields are only set for the events that they apply to.
+type Record struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Section string    `json:"section"`
+	Pid     int       `json:"pid"`
+
+	// Set for session_start.  PosixAccount, TunnelTo and RemoteSocket are also set for ssh_session_start,
+	// which is written each time the SSH session is established.  This is the only record with the POSIX
+	// account of a lazy tunnel, because its account is not looked up until the first connection.
+	Principal    string `json:"principal,omitempty"`
+	PosixAccount string `json:"posix_account,omitempty"`
+	Project      string `json:"project,omitempty"`
+	Zone         string `json:"zone,omitempty"`
+	Instance     string `json:"instance,omitempty"`
+	TunnelTo     string `json:"tunnel_to,omitempty"`
+	RemotePort   int    `json:"remote_port,omitempty"`
+	RemoteSocket string `json:"remote_socket,omitempty"`
+
+	// Set for connection_open and connection_close.
+	ConnID uint64 `json:"conn_id,omitempty"`
+	Peer   string `json:"peer,omitempty"`
+
+	// Set for connection_close and session_stop.
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+
+	// Set for connection_close.
+	BytesToRemote   uint64 `json:"bytes_to_remote,omitempty"`
+	BytesFromRemote uint64 `json:"bytes_from_remote,omitempty"`
+
+	// Set for session_stop.
+	ExitCode *int `json:"exit_code,omitempty"`
+}
+
+// Log appends records to an audit log as JSON lines.  A nil *Log discards everything, so callers do not
+// need to check whether auditing is enabled.
+type Log struct {
+	mu      sync.Mutex
+	w       io.WriteCloser
+	section string
+	logger  *slog.Logger
+	nextID  atomic.Uint64
+}
+
+// Open opens the audit log at path for appending, creating it if necessary.
+func Open(path string, section string, logger *slog.Logger) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", constants.ErrFailedToOpenAuditLog, err)
+	}
+
+	return &Log{w: f, section: section, logger: logger}, nil
+}
+
+// Write appends rec to the log, filling in the time, section and process ID.  A failure to write is logged
+// rather than returned because it should not stop the tunnel.
+func (l *Log) Write(rec Record) {
+	if l == nil {
+		return
+	}
+
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+
+	rec.Section = l.section
+	rec.Pid = os.Getpid()
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		l.logger.Error("failed to encode audit record", "event", rec.Event, "error", err)
+
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A single write per record means that records from several iapgo processes sharing a file are not
+	// interleaved.
+	_, err = l.w.Write(append(data, '\n'))
+	if err != nil {
+		l.logger.Error("failed to write audit record", "event", rec.Event, "error", err)
+	}
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.w.Close()
+}
+
+// Listener wraps lsnr so that a connection_open record is written for each accepted connection and a
+// connection_close record when it is closed.  Connections made by the readiness probe are not recorded.  If
+// l is nil then lsnr is returned unchanged.
+func (l *Log) Listener(lsnr net.Listener) net.Listener {
+	if l == nil {
+		return lsnr
+	}
+
+	return &listener{Listener: lsnr, log: l}
+}
+
+type listener struct {
+	net.Listener
+	log *Log
+}
+
+func (a *listener) Accept() (net.Conn, error) {
+	conn, err := a.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if stats.IsProbe(conn) {
+		return conn, nil
+	}
+
+	c := &Conn{
+		Conn:    conn,
+		log:     a.log,
+		id:      a.log.nextID.Add(1),
+		started: time.Now(),
+	}
+
+	a.log.Write(Record{Event: EventConnectionOpen, ConnID: c.id, Peer: conn.RemoteAddr().String()})
+
+	return c, nil
+}
+
+// Conn is a local connection that is recorded in the audit log.
+type Conn struct {
+	net.Conn
+	log       *Log
+	id        uint64
+	started   time.Time
+	closeOnce sync.Once
+}
+
+// NetConn returns the connection being recorded.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// BytesToRemote returns the byte count of the underlying connection, if it has one, so that wrappers
+// outside this one can still read it.
+func (c *Conn) BytesToRemote() uint64 {
+	if counter, ok := c.Conn.(stats.ByteCounter); ok {
+		return counter.BytesToRemote()
+	}
+
+	return 0
+}
+
+// BytesFromRemote returns the byte count of the underlying connection, if it has one.
+func (c *Conn) BytesFromRemote() uint64 {
+	if counter, ok := c.Conn.(stats.ByteCounter); ok {
+		return counter.BytesFromRemote()
+	}
+
+	return 0
+}
+
+// Close closes the connection and writes its connection_close record.
+func (c *Conn) Close() error {
+	err := c.Conn.Close()
+
+	c.closeOnce.Do(func() {
+		c.log.Write(Record{
+			Event:           EventConnectionClose,
+			ConnID:          c.id,
+			Peer:            c.RemoteAddr().String(),
+			DurationSeconds: time.Since(c.started).Seconds(),
+			BytesToRemote:   c.BytesToRemote(),
+			BytesFromRemote: c.BytesFromRemote(),
+		})
+	})
+
+	return err
+}
@@ -0,0 +1,132 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+)
+
+func TestLog(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	auditLog, err := Open(path, "test", logger)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	auditLog.Write(Record{Event: EventSessionStart, Principal: "fred@example.com", Instance: "my-jumpbox"})
+
+	inner, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	lsnr := auditLog.Listener(stats.New("test").Listener(inner))
+	defer func() { _ = lsnr.Close() }()
+
+	go func() {
+		client, err := net.Dial("tcp", lsnr.Addr().String())
+		if err != nil {
+			return
+		}
+
+		_, _ = client.Write([]byte("hello"))
+		_ = client.Close()
+	}()
+
+	conn, err := lsnr.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+
+	_, _ = io.ReadAll(conn)
+	_ = conn.Close()
+	_ = conn.Close()
+
+	exitCode := 0
+	auditLog.Write(Record{Event: EventSessionStop, ExitCode: &exitCode})
+
+	_ = auditLog.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open audit log: %v", err)
+	}
+
+	defer func() { _ = f.Close() }()
+
+	var got []Record
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec Record
+
+		err = json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			t.Fatalf("audit record is not JSON: %v: %s", err, scanner.Text())
+		}
+
+		got = append(got, rec)
+	}
+
+	wantEvents := []string{EventSessionStart, EventConnectionOpen, EventConnectionClose, EventSessionStop}
+	if len(got) != len(wantEvents) {
+		t.Fatalf("got %d records, want %d: %+v", len(got), len(wantEvents), got)
+	}
+
+	for i, rec := range got {
+		if rec.Event != wantEvents[i] {
+			t.Errorf("record %d event = %q, want %q", i, rec.Event, wantEvents[i])
+		}
+
+		if rec.Section != "test" || rec.Pid != os.Getpid() || rec.Time.IsZero() {
+			t.Errorf("record %d = %+v, want section, pid and time to be set", i, rec)
+		}
+	}
+
+	if got[0].Principal != "fred@example.com" {
+		t.Errorf("session_start principal = %q, want fred@example.com", got[0].Principal)
+	}
+
+	if got[1].ConnID != 1 || got[2].ConnID != 1 {
+		t.Errorf("connection records conn_id = %d and %d, want 1", got[1].ConnID, got[2].ConnID)
+	}
+
+	if got[2].BytesToRemote != 5 {
+		t.Errorf("connection_close bytes_to_remote = %d, want 5", got[2].BytesToRemote)
+	}
+
+	if got[3].ExitCode == nil || *got[3].ExitCode != 0 {
+		t.Errorf("session_stop exit_code = %v, want 0", got[3].ExitCode)
+	}
+}
+
+func TestLog_Nil(t *testing.T) {
+	var auditLog *Log
+
+	inner, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	defer func() { _ = inner.Close() }()
+
+	if got := auditLog.Listener(inner); got != inner {
+		t.Errorf("Listener() on a nil Log wrapped the listener")
+	}
+
+	auditLog.Write(Record{Event: EventSessionStart})
+
+	if err := auditLog.Close(); err != nil {
+		t.Errorf("Close() on a nil Log error = %v", err)
+	}
+}
@@ -4,10 +4,16 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/tracing"
 	"github.com/LaoZhuBaba/iapgo/v2/internal/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/yaml.v3"
 )
 
@@ -21,12 +27,219 @@ type Config struct {
 	Exec               []string      `yaml:"exec,omitempty"`
 	TerminateAfterExec bool          `yaml:"terminate_after_exec"`
 	SshTunnel          *SshTunnelCfg `yaml:"ssh_tunnel,omitempty"`
+	// ExecGracePeriod is how long the exec command has to exit after the tunnel stops before it is killed.
+	ExecGracePeriod time.Duration `yaml:"exec_grace_period,omitempty"`
+	// DrainTimeout is how long open connections have to finish when iapgo is stopping before they are
+	// closed.
+	DrainTimeout time.Duration `yaml:"drain_timeout,omitempty"`
+	// If ConnectionIdleTimeout is set then a connection with no data in either direction for that long is
+	// closed.  If ConnectionMaxLifetime is set then every connection is closed after that long.  These are
+	// only supported with ssh_tunnel.
+	ConnectionIdleTimeout time.Duration `yaml:"connection_idle_timeout,omitempty"`
+	ConnectionMaxLifetime time.Duration `yaml:"connection_max_lifetime,omitempty"`
+	// CopyBufferSize is the size in bytes of the buffers used to copy data through an SSH tunnel.  If it is
+	// not set then 64KiB is used.
+	CopyBufferSize int `yaml:"copy_buffer_size,omitempty"`
+	// If IapPool is set then idle IAP connections are opened in advance so that new local connections do
+	// not have to wait for the IAP handshake.
+	IapPool *IapPoolCfg `yaml:"iap_pool,omitempty"`
+	// If Lazy is set then the local listener is opened straight away but the SSH session, including the OS
+	// Login lookup, is only started when the first connection arrives.  If LazyIdleTimeout is also set then
+	// the session is closed again once there have been no connections for that long.
+	Lazy            bool          `yaml:"lazy,omitempty"`
+	LazyIdleTimeout time.Duration `yaml:"lazy_idle_timeout,omitempty"`
+	// If IdleTimeout is set then iapgo stops once there have been no connections for that long.  If
+	// MaxDuration is set then iapgo stops that long after the tunnel is ready, whatever it is doing, and
+	// logs a warning MaxDurationWarning (default 5m) beforehand.
+	IdleTimeout        time.Duration `yaml:"idle_timeout,omitempty"`
+	MaxDuration        time.Duration `yaml:"max_duration,omitempty"`
+	MaxDurationWarning time.Duration `yaml:"max_duration_warning,omitempty"`
+	// Restart is one of RestartNever (the default), RestartOnFailure or RestartAlways.  The delay before
+	// each restart starts at RestartBackoff and doubles up to RestartMaxBackoff.
+	Restart           string        `yaml:"restart,omitempty"`
+	RestartMaxRetries int           `yaml:"restart_max_retries,omitempty"`
+	RestartBackoff    time.Duration `yaml:"restart_backoff,omitempty"`
+	RestartMaxBackoff time.Duration `yaml:"restart_max_backoff,omitempty"`
+	// Each hook is a list of commands that are run in order with the same environment as exec.  If a
+	// before_start command fails then the tunnel is not started.
+	BeforeStart [][]string `yaml:"before_start,omitempty"`
+	AfterReady  [][]string `yaml:"after_ready,omitempty"`
+	AfterStop   [][]string `yaml:"after_stop,omitempty"`
+	// Env, EnvFile and WorkDir apply to the exec command and hooks.  Env values may refer to
+	// $IAPGO_LISTEN_HOST, $IAPGO_LISTEN_PORT and other environment variables.
+	Env     map[string]string `yaml:"env,omitempty"`
+	EnvFile string            `yaml:"env_file,omitempty"`
+	WorkDir string            `yaml:"workdir,omitempty"`
+	// LocalAddress is the address that local_port is bound to.  If it is not set then localhost is used.
+	// Addresses that are not loopback addresses are only allowed if AllowRemoteClients is true.
+	LocalAddress       string `yaml:"local_address,omitempty"`
+	AllowRemoteClients bool   `yaml:"allow_remote_clients,omitempty"`
+	// If LocalSocket is set then clients connect to a Unix domain socket instead of local_port.
+	LocalSocket *LocalSocketCfg `yaml:"local_socket,omitempty"`
+	// If AllowedUids or AllowedUsers are set then connections to the local listener from any other
+	// user are rejected.  This is only supported on Linux.
+	AllowedUids  []int    `yaml:"allowed_uids,omitempty"`
+	AllowedUsers []string `yaml:"allowed_users,omitempty"`
+	// If Readiness is set then the remote service is probed through the local listener before the
+	// after_ready hooks and the exec command are run.
+	Readiness *ReadinessCfg `yaml:"readiness,omitempty"`
+	// If AuditLog is set then the session and each connection through the tunnel are recorded in this
+	// file as JSON lines.
+	AuditLog string `yaml:"audit_log,omitempty"`
 }
 
+type LocalSocketCfg struct {
+	Path string `yaml:"path"`
+	// Mode is an octal string such as "0660".  If it is not set then DefaultLocalSocketMode is used.
+	Mode  string `yaml:"mode,omitempty"`
+	Owner string `yaml:"owner,omitempty"`
+	Group string `yaml:"group,omitempty"`
+}
+
+const (
+	DefaultLocalSocketMode os.FileMode = 0o600
+	DefaultLocalAddress                = "localhost"
+)
+
+// These are the values allowed for restart.
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// redactedValue replaces values that may be secret when a configuration is logged.
+const redactedValue = "REDACTED"
+
+// Redacted returns a copy of the configuration that is safe to log.  Env values often hold passwords or
+// tokens, so they are replaced while the names are kept.
+func (c *Config) Redacted() Config {
+	redacted := *c
+
+	if c.Env != nil {
+		redacted.Env = make(map[string]string, len(c.Env))
+
+		for name := range c.Env {
+			redacted.Env[name] = redactedValue
+		}
+	}
+
+	return redacted
+}
+
+// BindAddress returns the address that the local TCP listener should be bound to.
+func (c *Config) BindAddress() string {
+	if c.LocalAddress == "" {
+		return DefaultLocalAddress
+	}
+
+	return c.LocalAddress
+}
+
+// ListenHost returns the address that local clients, such as the exec command, should connect to.  This is
+// the bind address except that a wildcard address is replaced by the matching loopback address.
+func (c *Config) ListenHost() string {
+	ip := net.ParseIP(c.LocalAddress)
+
+	switch {
+	case ip == nil:
+		return c.BindAddress()
+	case ip.Equal(net.IPv4zero):
+		return "127.0.0.1"
+	case ip.Equal(net.IPv6unspecified):
+		return "::1"
+	default:
+		return c.LocalAddress
+	}
+}
+
+// FileMode returns the permissions to be applied to the socket file.
+func (s *LocalSocketCfg) FileMode() (os.FileMode, error) {
+	if s.Mode == "" {
+		return DefaultLocalSocketMode, nil
+	}
+
+	mode, err := strconv.ParseUint(s.Mode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("%w: %s", constants.ErrInvalidLocalSocketMode, s.Mode)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// ReadinessCfg describes a probe that checks that the remote service answers through the tunnel.
+type ReadinessCfg struct {
+	// Type is one of the Probe... constants.
+	Type string `yaml:"type"`
+	// Path and ExpectStatus only apply to http and https probes.  ExpectStatus defaults to 200.
+	Path         string `yaml:"path,omitempty"`
+	ExpectStatus int    `yaml:"expect_status,omitempty"`
+	// ServerName is used to verify the certificate for tls and https probes.  Because the probe connects
+	// to the local listener there is normally no useful default, so InsecureSkipVerify may be set instead.
+	ServerName         string `yaml:"server_name,omitempty"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify,omitempty"`
+	// Timeout applies to each attempt.  The probe is attempted 1+Retries times, Interval apart.  Retries is
+	// a pointer so that an explicit 0, meaning a single attempt, can be told apart from not being set.
+	Timeout  time.Duration `yaml:"timeout,omitempty"`
+	Retries  *int          `yaml:"retries,omitempty"`
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+// These are the values allowed for readiness.type.
+const (
+	ProbeTcp      = "tcp"
+	ProbeHttp     = "http"
+	ProbeHttps    = "https"
+	ProbeTls      = "tls"
+	ProbePostgres = "postgres"
+	ProbeMysql    = "mysql"
+	ProbeRedis    = "redis"
+)
+
+const DefaultDrainTimeout = 10 * time.Second
+
+type IapPoolCfg struct {
+	// Size is the number of idle IAP connections to keep ready.
+	Size int `yaml:"size"`
+	// MaxIdle is how long an idle connection is kept before it is replaced, which should be less than the
+	// time after which IAP or the remote service closes an idle connection.
+	MaxIdle time.Duration `yaml:"max_idle,omitempty"`
+}
+
+const DefaultIapPoolMaxIdle = 30 * time.Second
+
+const DefaultMaxDurationWarning = 5 * time.Minute
+
+const (
+	DefaultReadinessTimeout  = 5 * time.Second
+	DefaultReadinessRetries  = 10
+	DefaultReadinessInterval = time.Second
+)
+
 type SshTunnelCfg struct {
-	TunnelTo       string `yaml:"tunnel_to"`
+	TunnelTo string `yaml:"tunnel_to"`
+	// RemoteSocket is a Unix domain socket path on the last SSH server.  It is used instead of
+	// tunnel_to and remote_port.
+	RemoteSocket   string      `yaml:"remote_socket,omitempty"`
+	AccountName    string      `yaml:"account_name,omitempty"`
+	PrivateKeyFile string      `yaml:"private_key_file,omitempty"`
+	Hops           []SshHopCfg `yaml:"hops,omitempty"`
+}
+
+// SshHopCfg describes an additional SSH server that is dialled through the previous hop (or through
+// the jump box for the first entry) before forwarding to tunnel_to.  This works like ssh -J.
+type SshHopCfg struct {
+	Host string `yaml:"host"`
+	// If Port is not set then 22 is used.
+	Port int `yaml:"port,omitempty"`
+	// If AccountName or PrivateKeyFile are not set then the values used for the jump box are used.
 	AccountName    string `yaml:"account_name,omitempty"`
 	PrivateKeyFile string `yaml:"private_key_file,omitempty"`
+	// Unlike the jump box, a hop is not reached through IAP so its host key is checked.  HostKey is a
+	// public key in authorized_keys format.  If it is not set then the key is looked up in KnownHosts, or
+	// in ~/.ssh/known_hosts if that is not set either.
+	HostKey    string `yaml:"host_key,omitempty"`
+	KnownHosts string `yaml:"known_hosts,omitempty"`
 }
 
 // This is printed out as part of the "usage" output.
@@ -36,15 +249,20 @@ default:
   project_id: my-gcp-project
   zone: us-central1-a
   instance: my-jumpbox
-  # If local_port is not set then an ephemeral port will be allocated and made available as $IAP_LISTEN_PORT
+  # If local_port is not set then an ephemeral port will be allocated and made available as $IAPGO_LISTEN_PORT
   # local_port: 1234
   remote_port: 80
   remote_nic: nic0
   terminate_after_exec: true
+  # If the tunnel fails then the exec command is sent SIGTERM, and killed if it is still running after
+  # exec_grace_period (default 10s)
+  # exec_grace_period: 30s
+  # When iapgo stops, open connections have drain_timeout (default 10s) to finish before they are closed
+  # drain_timeout: 1m
   exec:
     - bash
     - "-c"
-    - curl http://localhost:$IAP_LISTEN_PORT
+    - curl http://localhost:$IAPGO_LISTEN_PORT
 example:
   project_id: my-gcp-project
   zone: us-central1-a
@@ -57,11 +275,189 @@ example:
     # account_name: my_ssh_login
     # By default ~/.ssh/google_compute_engine will be used.
     # private_key_file: /home/fred/.ssh/google_compute_engine
+  # Close connections with no traffic for 15m, and any connection after 8h (ssh_tunnel only)
+  # connection_idle_timeout: 15m
+  # connection_max_lifetime: 8h
+  # Larger copy buffers can help bulk transfers (ssh_tunnel only, default 65536)
+  # copy_buffer_size: 262144
   exec:
     - bash
     - "-c"
     # curl will reach ssh_tunnel.tunnel_to host on remote_port
-    - curl http://localhost:$IAP_LISTEN_PORT
+    - curl http://localhost:$IAPGO_LISTEN_PORT
+multi-hop:
+  project_id: my-gcp-project
+  zone: us-central1-a
+  instance: my-jumpbox
+  remote_port: 5432
+  remote_nic: nic0
+  ssh_tunnel:
+    tunnel_to: 10.1.2.3 # This host is only reachable from the last hop
+    # Each hop is reached through the previous one, starting from my-jumpbox
+    hops:
+      - host: 10.0.0.5
+        # port: 22
+        # account_name and private_key_file default to the values used for my-jumpbox
+        # account_name: my_ssh_login
+        # private_key_file: /home/fred/.ssh/second_bastion
+        # The hop's host key is checked against ~/.ssh/known_hosts unless known_hosts or host_key is set
+        # known_hosts: /home/fred/.ssh/known_hosts_bastions
+        # host_key: ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAA...
+docker:
+  project_id: my-gcp-project
+  zone: us-central1-a
+  instance: my-jumpbox
+  remote_nic: nic0
+  ssh_tunnel:
+    # Forward to a Unix domain socket on my-jumpbox instead of tunnel_to and remote_port
+    remote_socket: /var/run/docker.sock
+  exec:
+    - bash
+    - "-c"
+    - DOCKER_HOST=tcp://localhost:$IAPGO_LISTEN_PORT docker ps
+socket:
+  project_id: my-gcp-project
+  zone: us-central1-a
+  instance: my-jumpbox
+  remote_port: 5432
+  remote_nic: nic0
+  # Listen on a Unix domain socket instead of local_port.  The path is made available as $IAPGO_LISTEN_SOCKET
+  local_socket:
+    path: /home/fred/.iapgo/.s.PGSQL.5432
+    mode: "0660" # Defaults to 0600
+    # owner: fred
+    # group: dbadmins
+  exec:
+    - bash
+    - "-c"
+    - psql -h "$(dirname $IAPGO_LISTEN_SOCKET)"
+db:
+  project_id: my-gcp-project
+  zone: us-central1-a
+  instance: my-jumpbox
+  remote_port: 5432
+  remote_nic: nic0
+  # workdir, env_file and env set the directory and extra environment variables for the exec command.
+  # $IAPGO_LISTEN_HOST, $IAPGO_LISTEN_PORT, $IAPGO_SECTION and $IAPGO_INSTANCE are always set.
+  workdir: /home/fred/migrations
+  # env_file: /home/fred/.iapgo/db.env
+  env:
+    PGHOST: $IAPGO_LISTEN_HOST
+    PGPORT: $IAPGO_LISTEN_PORT
+    PGUSER: migrator
+  terminate_after_exec: true
+  exec:
+    - ./migrate.sh
+psql:
+  project_id: my-gcp-project
+  zone: us-central1-a
+  instance: my-jumpbox
+  remote_port: 5432
+  remote_nic: nic0
+  # {{.Host}}, {{.Port}}, {{.Socket}}, {{.Section}}, {{.Instance}} and {{.Forwards.psql.Port}} are replaced
+  # in each exec argument, so no shell is needed
+  exec: [psql, -h, "{{.Host}}", -p, "{{.Port}}"]
+sync-agent:
+  project_id: my-gcp-project
+  zone: us-central1-a
+  instance: my-jumpbox
+  remote_port: 8080
+  remote_nic: nic0
+  # restart can be never (the default), on-failure or always.  The delay between restarts starts at
+  # restart_backoff and doubles up to restart_max_backoff.  restart_max_retries of 0 means no limit.
+  restart: on-failure
+  restart_max_retries: 10
+  restart_backoff: 1s
+  restart_max_backoff: 1m
+  exec: [sync-agent, --server, "http://{{.Host}}:{{.Port}}"]
+ready:
+  project_id: my-gcp-project
+  zone: us-central1-a
+  instance: my-db-server
+  remote_port: 5432
+  remote_nic: nic0
+  # Wait until PostgreSQL answers through the tunnel before running exec.  The type may be tcp, http,
+  # https, tls, postgres, mysql or redis.
+  readiness:
+    type: postgres
+    timeout: 5s     # Per attempt.  Defaults to 5s
+    retries: 10     # Defaults to 10
+    interval: 1s    # Defaults to 1s
+  exec: [psql, -h, "{{.Host}}", -p, "{{.Port}}"]
+  terminate_after_exec: true
+hooks:
+  project_id: my-gcp-project
+  zone: us-central1-a
+  instance: my-jumpbox
+  remote_port: 22
+  remote_nic: nic0
+  # Hooks are lists of commands which run with the same environment as exec and log their output.
+  # If a before_start command fails then iapgo exits without starting the tunnel.
+  before_start:
+    - [gcloud, compute, instances, start, my-jumpbox, --zone, us-central1-a]
+  after_ready:
+    - [bash, -c, "echo tunnel is listening on port $IAPGO_LISTEN_PORT"]
+  after_stop:
+    - [rm, -f, /tmp/my-temp-credentials]
+loopback-alias:
+  project_id: my-gcp-project
+  zone: us-central1-a
+  instance: my-jumpbox
+  remote_port: 5432
+  local_port: 5432
+  remote_nic: nic0
+  # Bind to another loopback address so that several tunnels can use the same local_port.  The
+  # address is made available as $IAPGO_LISTEN_HOST.  Use "::1" for IPv6.
+  local_address: 127.0.0.2
+  # Addresses such as 0.0.0.0 allow connections from other hosts and must be explicitly enabled
+  # allow_remote_clients: true
+restricted:
+  project_id: my-gcp-project
+  zone: us-central1-a
+  instance: my-jumpbox
+  remote_port: 5432
+  remote_nic: nic0
+  # Reject connections from other local users (Linux only)
+  allowed_users:
+    - fred
+  # allowed_uids:
+  #   - 1001
+  # Record who opened the tunnel and each connection through it as JSON lines
+  audit_log: /var/log/iapgo/audit.jsonl
+pooled:
+  project_id: my-gcp-project
+  zone: us-central1-a
+  instance: my-jumpbox
+  remote_port: 5432
+  remote_nic: nic0
+  # Keep two IAP connections open and ready so that new connections start faster.  Each is replaced
+  # after max_idle (default 30s) if it has not been used.
+  iap_pool:
+    size: 2
+    max_idle: 30s
+on-demand:
+  project_id: my-gcp-project
+  zone: us-central1-a
+  instance: my-jumpbox
+  remote_port: 5432
+  remote_nic: nic0
+  # Start the SSH session when the first connection arrives rather than when iapgo starts, and close it
+  # again after 15 minutes with no connections
+  lazy: true
+  lazy_idle_timeout: 15m
+  ssh_tunnel:
+    tunnel_to: 10.0.0.5
+production:
+  project_id: my-gcp-project
+  zone: us-central1-a
+  instance: my-prod-jumpbox
+  remote_port: 5432
+  remote_nic: nic0
+  # Stop after 30 minutes with no connections, and stop after 8 hours in any case with a warning 10
+  # minutes beforehand
+  idle_timeout: 30m
+  max_duration: 8h
+  max_duration_warning: 10m
 `
 
 func GetConfig(
@@ -69,7 +465,14 @@ func GetConfig(
 	yamlFileName string,
 	cfgSection string,
 	logger *slog.Logger,
-) (*Config, error) {
+) (_ *Config, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "config.load", trace.WithAttributes(
+		attribute.String("iapgo.config_file", yamlFileName),
+		attribute.String("iapgo.section", cfgSection),
+	))
+	defer span.End()
+	defer func() { _ = tracing.RecordError(span, err) }()
+
 	var cfgMap map[string]Config
 
 	yamlFile, err := os.Open(yamlFileName)
@@ -92,37 +495,164 @@ func GetConfig(
 	}
 
 	if cfg.SshTunnel != nil {
-		if cfg.SshTunnel.TunnelTo == "" {
+		if cfg.SshTunnel.TunnelTo == "" && cfg.SshTunnel.RemoteSocket == "" {
 			return nil, constants.ErrSshTunnelToNoValue
 		}
+
+		if cfg.SshTunnel.TunnelTo != "" && cfg.SshTunnel.RemoteSocket != "" {
+			return nil, constants.ErrSshTunnelToAndSocket
+		}
+
+		for i, hop := range cfg.SshTunnel.Hops {
+			if hop.Host == "" {
+				return nil, fmt.Errorf("%w: hop %d", constants.ErrSshHopHostNoValue, i)
+			}
+
+			if hop.HostKey != "" && hop.KnownHosts != "" {
+				return nil, fmt.Errorf("%w: hop %d", constants.ErrSshHopHostKeyAndKnown, i)
+			}
+		}
 	}
 
-	if cfg.SshTunnel != nil && cfg.SshTunnel.AccountName == "" {
-		logger.Debug("no posix account name found in config so attempting to resolve from OS Login")
+	if cfg.SshTunnel == nil && (cfg.ConnectionIdleTimeout != 0 || cfg.ConnectionMaxLifetime != 0) {
+		return nil, constants.ErrConnTimeoutsNeedSsh
+	}
 
-		login, err := util.GetGcpLogin()
-		if err != nil {
-			logger.Error("failed to get gcp login", "error", err)
-			logger.Error(
-				"this may be because the 'gcloud' command is not in your path or you are not logged into GCP",
-			)
+	// An SSH tunnel only uses a single IAP connection, so a pool would waste the rest.
+	if cfg.IapPool != nil && cfg.SshTunnel != nil {
+		return nil, constants.ErrIapPoolWithSsh
+	}
+
+	if cfg.IapPool != nil && cfg.IapPool.Size < 1 {
+		return nil, fmt.Errorf("%w: %d", constants.ErrInvalidIapPoolSize, cfg.IapPool.Size)
+	}
+
+	if cfg.LazyIdleTimeout != 0 && !cfg.Lazy {
+		return nil, constants.ErrLazyIdleNeedsLazy
+	}
 
+	// Both of these connect to the remote side as soon as the tunnel starts.
+	if cfg.Lazy && cfg.Readiness != nil {
+		return nil, constants.ErrLazyWithReadiness
+	}
+
+	if cfg.Lazy && cfg.IapPool != nil {
+		return nil, constants.ErrLazyWithIapPool
+	}
+
+	if cfg.IdleTimeout < 0 || cfg.MaxDuration < 0 || cfg.MaxDurationWarning < 0 {
+		return nil, constants.ErrNegativeSessionLimit
+	}
+
+	if cfg.CopyBufferSize < 0 {
+		return nil, fmt.Errorf("%w: %d", constants.ErrInvalidCopyBufferSize, cfg.CopyBufferSize)
+	}
+
+	for _, hooks := range [][][]string{cfg.BeforeStart, cfg.AfterReady, cfg.AfterStop} {
+		for _, hook := range hooks {
+			if len(hook) == 0 {
+				return nil, fmt.Errorf("%w: hook", constants.ErrEmptyCommand)
+			}
+		}
+	}
+
+	switch cfg.Restart {
+	case "", RestartNever, RestartOnFailure, RestartAlways:
+	default:
+		return nil, fmt.Errorf("%w: %s", constants.ErrInvalidRestartPolicy, cfg.Restart)
+	}
+
+	if cfg.Readiness != nil {
+		switch cfg.Readiness.Type {
+		case ProbeTcp, ProbeHttp, ProbeHttps, ProbeTls, ProbePostgres, ProbeMysql, ProbeRedis:
+		default:
+			return nil, fmt.Errorf("%w: %s", constants.ErrInvalidReadinessType, cfg.Readiness.Type)
+		}
+
+		if cfg.Readiness.Retries != nil && *cfg.Readiness.Retries < 0 {
+			return nil, fmt.Errorf("%w: %d", constants.ErrInvalidReadinessRetries, *cfg.Readiness.Retries)
+		}
+	}
+
+	if cfg.LocalAddress != "" {
+		if cfg.LocalSocket != nil {
+			return nil, constants.ErrLocalAddressAndSocket
+		}
+
+		err = checkLocalAddress(cfg.LocalAddress, cfg.AllowRemoteClients)
+		if err != nil {
 			return nil, err
 		}
+	}
+
+	if cfg.LocalSocket != nil {
+		if cfg.LocalSocket.Path == "" {
+			return nil, constants.ErrLocalSocketPathNoValue
+		}
 
-		cfg.SshTunnel.AccountName, err = util.GetPosixLogin(ctx, login)
+		_, err = cfg.LocalSocket.FileMode()
 		if err != nil {
-			logger.Error("failed to get posix login", "error", err)
+			return nil, err
+		}
+	}
 
+	// A lazy tunnel resolves the account name when it starts the SSH session.
+	if cfg.SshTunnel != nil && cfg.SshTunnel.AccountName == "" && !cfg.Lazy {
+		err = ResolveAccountName(ctx, cfg.SshTunnel, logger)
+		if err != nil {
 			return nil, err
 		}
+	}
 
-		logger.Debug(
-			"successfully resolved from OS Login",
-			"AccountName",
-			cfg.SshTunnel.AccountName,
+	return &cfg, nil
+}
+
+// ResolveAccountName sets the POSIX account name for the SSH tunnel from OS Login.
+func ResolveAccountName(ctx context.Context, sshCfg *SshTunnelCfg, logger *slog.Logger) error {
+	logger.Debug("no posix account name found in config so attempting to resolve from OS Login")
+
+	login, err := util.GetGcpLogin()
+	if err != nil {
+		logger.Error("failed to get gcp login", "error", err)
+		logger.Error(
+			"this may be because the 'gcloud' command is not in your path or you are not logged into GCP",
 		)
+
+		return err
 	}
 
-	return &cfg, nil
+	loginCtx, loginSpan := tracing.Tracer().Start(ctx, "oslogin.lookup")
+	sshCfg.AccountName, err = util.GetPosixLogin(loginCtx, login)
+	_ = tracing.RecordError(loginSpan, err)
+
+	loginSpan.End()
+
+	if err != nil {
+		logger.Error("failed to get posix login", "error", err)
+
+		return err
+	}
+
+	logger.Debug("successfully resolved from OS Login", "AccountName", sshCfg.AccountName)
+
+	return nil
+}
+
+// checkLocalAddress makes sure that local_address is either localhost or an IP address, and that a non-loopback
+// address (which includes 0.0.0.0 and ::) is only used if allow_remote_clients has been set.
+func checkLocalAddress(address string, allowRemoteClients bool) error {
+	if address == DefaultLocalAddress {
+		return nil
+	}
+
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return fmt.Errorf("%w: %s", constants.ErrInvalidLocalAddress, address)
+	}
+
+	if !ip.IsLoopback() && !allowRemoteClients {
+		return fmt.Errorf("%w: %s", constants.ErrRemoteClientsNotAllowed, address)
+	}
+
+	return nil
 }
@@ -7,6 +7,7 @@ import (
 	"log/slog"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
 	"github.com/stretchr/testify/assert"
@@ -19,6 +20,9 @@ func TestGetConfig(t *testing.T) {
 		cfgSection   string
 		logger       *slog.Logger
 	}
+
+	readinessRetries := 3
+
 	tests := []struct {
 		name    string
 		args    args
@@ -96,6 +100,337 @@ func TestGetConfig(t *testing.T) {
 			wantErr: constants.ErrSshTunnelToNoValue,
 			want:    nil,
 		},
+		{
+			name: "GetConfig_ssh_tunnel_to_and_remote_socket",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: constants.ErrSshTunnelToAndSocket,
+			want:    nil,
+		},
+		{
+			name: "GetConfig_ssh_remote_socket",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: nil,
+			want: &Config{
+				ProjectID: "project_id",
+				Zone:      "zone",
+				Instance:  "instance",
+				LocalPort: 100,
+				RemoteNic: "nic0",
+				SshTunnel: &SshTunnelCfg{
+					RemoteSocket: "/var/run/docker.sock",
+					AccountName:  "fred",
+				},
+			},
+		},
+		{
+			name: "GetConfig_local_socket",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: nil,
+			want: &Config{
+				ProjectID:  "project_id",
+				Zone:       "zone",
+				Instance:   "instance",
+				RemotePort: 200,
+				RemoteNic:  "nic0",
+				LocalSocket: &LocalSocketCfg{
+					Path:  "/tmp/iapgo.sock",
+					Mode:  "0660",
+					Owner: "fred",
+					Group: "dbadmins",
+				},
+			},
+		},
+		{
+			name: "GetConfig_local_socket_invalid_mode",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: constants.ErrInvalidLocalSocketMode,
+			want:    nil,
+		},
+		{
+			name: "GetConfig_connection_timeouts_without_ssh",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: constants.ErrConnTimeoutsNeedSsh,
+			want:    nil,
+		},
+		{
+			name: "GetConfig_invalid_copy_buffer_size",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: constants.ErrInvalidCopyBufferSize,
+			want:    nil,
+		},
+		{
+			name: "GetConfig_invalid_iap_pool_size",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: constants.ErrInvalidIapPoolSize,
+			want:    nil,
+		},
+		{
+			// The account name is not resolved from OS Login until the SSH session starts.
+			name: "GetConfig_lazy",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: nil,
+			want: &Config{
+				ProjectID:       "project_id",
+				Zone:            "zone",
+				Instance:        "instance",
+				RemotePort:      200,
+				RemoteNic:       "nic0",
+				Lazy:            true,
+				LazyIdleTimeout: 15 * time.Minute,
+				SshTunnel:       &SshTunnelCfg{TunnelTo: "10.0.0.5"},
+			},
+		},
+		{
+			name: "GetConfig_lazy_idle_timeout_without_lazy",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: constants.ErrLazyIdleNeedsLazy,
+			want:    nil,
+		},
+		{
+			name: "GetConfig_session_limits",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: nil,
+			want: &Config{
+				ProjectID:          "project_id",
+				Zone:               "zone",
+				Instance:           "instance",
+				RemotePort:         200,
+				RemoteNic:          "nic0",
+				IdleTimeout:        30 * time.Minute,
+				MaxDuration:        8 * time.Hour,
+				MaxDurationWarning: 10 * time.Minute,
+			},
+		},
+		{
+			name: "GetConfig_negative_session_limit",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: constants.ErrNegativeSessionLimit,
+			want:    nil,
+		},
+		{
+			name: "GetConfig_iap_pool_with_ssh",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: constants.ErrIapPoolWithSsh,
+			want:    nil,
+		},
+		{
+			name: "GetConfig_local_socket_no_path",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: constants.ErrLocalSocketPathNoValue,
+			want:    nil,
+		},
+		{
+			name: "GetConfig_local_address_remote_not_allowed",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: constants.ErrRemoteClientsNotAllowed,
+			want:    nil,
+		},
+		{
+			name: "GetConfig_local_address_invalid",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: constants.ErrInvalidLocalAddress,
+			want:    nil,
+		},
+		{
+			name: "GetConfig_local_address_remote_allowed",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: nil,
+			want: &Config{
+				ProjectID:          "project_id",
+				Zone:               "zone",
+				Instance:           "instance",
+				RemotePort:         200,
+				LocalPort:          100,
+				RemoteNic:          "nic0",
+				LocalAddress:       "::",
+				AllowRemoteClients: true,
+			},
+		},
+		{
+			name: "GetConfig_exec_options",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: nil,
+			want: &Config{
+				ProjectID:         "project_id",
+				Zone:              "zone",
+				Instance:          "instance",
+				RemotePort:        200,
+				LocalPort:         100,
+				RemoteNic:         "nic0",
+				Exec:              []string{"psql", "-h", "{{.Host}}", "-p", "{{.Port}}"},
+				ExecGracePeriod:   30 * time.Second,
+				Restart:           RestartOnFailure,
+				RestartMaxRetries: 5,
+				RestartBackoff:    2 * time.Second,
+				RestartMaxBackoff: time.Minute,
+				WorkDir:           "/tmp",
+				EnvFile:           "/tmp/db.env",
+				Env:               map[string]string{"PGUSER": "fred"},
+			},
+		},
+		{
+			name: "GetConfig_hooks",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: nil,
+			want: &Config{
+				ProjectID:   "project_id",
+				Zone:        "zone",
+				Instance:    "instance",
+				RemotePort:  200,
+				LocalPort:   100,
+				RemoteNic:   "nic0",
+				BeforeStart: [][]string{{"gcloud", "compute", "instances", "start", "instance"}},
+				AfterReady:  [][]string{{"echo", "{{.Port}}"}},
+				AfterStop:   [][]string{{"rm", "-f", "/tmp/creds"}, {"echo", "done"}},
+			},
+		},
+		{
+			name: "GetConfig_empty_hook_command",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: constants.ErrEmptyCommand,
+			want:    nil,
+		},
+		{
+			name: "GetConfig_readiness",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: nil,
+			want: &Config{
+				ProjectID:  "project_id",
+				Zone:       "zone",
+				Instance:   "instance",
+				RemotePort: 200,
+				LocalPort:  100,
+				RemoteNic:  "nic0",
+				Readiness: &ReadinessCfg{
+					Type:         ProbeHttp,
+					Path:         "/healthz",
+					ExpectStatus: 204,
+					Timeout:      2 * time.Second,
+					Retries:      &readinessRetries,
+					Interval:     500 * time.Millisecond,
+				},
+			},
+		},
+		{
+			name: "GetConfig_invalid_readiness_type",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: constants.ErrInvalidReadinessType,
+			want:    nil,
+		},
+		{
+			name: "GetConfig_invalid_restart_policy",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: constants.ErrInvalidRestartPolicy,
+			want:    nil,
+		},
+		{
+			name: "GetConfig_ssh_hop_host_no_value",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: constants.ErrSshHopHostNoValue,
+			want:    nil,
+		},
+		{
+			name: "GetConfig_ssh_hop_host_key_and_known_hosts",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: constants.ErrSshHopHostKeyAndKnown,
+			want:    nil,
+		},
+		{
+			name: "GetConfig_ssh_hops",
+			args: args{
+				ctx:    context.Background(),
+				logger: slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})),
+			},
+			wantErr: nil,
+			want: &Config{
+				ProjectID:  "project_id",
+				Zone:       "zone",
+				Instance:   "instance",
+				RemotePort: 200,
+				LocalPort:  100,
+				RemoteNic:  "nic0",
+				SshTunnel: &SshTunnelCfg{
+					TunnelTo:    "10.0.0.2",
+					AccountName: "fred",
+					Hops: []SshHopCfg{
+						{Host: "10.0.0.3"},
+						{Host: "10.0.0.4", Port: 2222, AccountName: "barney", PrivateKeyFile: "/tmp/barney"},
+					},
+				},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -110,3 +445,52 @@ func TestGetConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestConfig_ListenHost(t *testing.T) {
+	tests := []struct {
+		localAddress    string
+		wantBindAddress string
+		wantListenHost  string
+	}{
+		{localAddress: "", wantBindAddress: "localhost", wantListenHost: "localhost"},
+		{localAddress: "localhost", wantBindAddress: "localhost", wantListenHost: "localhost"},
+		{localAddress: "127.0.0.2", wantBindAddress: "127.0.0.2", wantListenHost: "127.0.0.2"},
+		{localAddress: "::1", wantBindAddress: "::1", wantListenHost: "::1"},
+		{localAddress: "0.0.0.0", wantBindAddress: "0.0.0.0", wantListenHost: "127.0.0.1"},
+		{localAddress: "::", wantBindAddress: "::", wantListenHost: "::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.localAddress, func(t *testing.T) {
+			c := &Config{LocalAddress: tt.localAddress}
+			if got := c.BindAddress(); got != tt.wantBindAddress {
+				t.Errorf("BindAddress() = %v, want %v", got, tt.wantBindAddress)
+			}
+			if got := c.ListenHost(); got != tt.wantListenHost {
+				t.Errorf("ListenHost() = %v, want %v", got, tt.wantListenHost)
+			}
+		})
+	}
+}
+
+func TestConfig_Redacted(t *testing.T) {
+	c := &Config{
+		Instance: "instance",
+		Env:      map[string]string{"PGPASSWORD": "secret", "PGUSER": "fred"},
+	}
+
+	got := c.Redacted()
+
+	want := map[string]string{"PGPASSWORD": "REDACTED", "PGUSER": "REDACTED"}
+	if !assert.EqualValues(t, want, got.Env) || got.Instance != "instance" {
+		t.Errorf("Redacted() = %+v", got)
+	}
+
+	// The original configuration is still used to run the command, so it must not be changed.
+	if c.Env["PGPASSWORD"] != "secret" {
+		t.Errorf("Redacted() changed Env to %v", c.Env)
+	}
+
+	if got := (&Config{}).Redacted(); got.Env != nil {
+		t.Errorf("Redacted() of a config without env = %v, want nil", got.Env)
+	}
+}
@@ -3,20 +3,79 @@ package constants
 import "errors"
 
 var (
-	ErrSshDialFailed          = errors.New("error dialing ssh tunnel")
-	ErrFailedToReadYaml       = errors.New("failed to read yaml file")
-	ErrFailedToUnmarshalYaml  = errors.New("failed to unmarshal yaml file")
-	ErrConfigSectionNotFound  = errors.New("config section not found")
-	ErrNotATcpListener        = errors.New("not a TCP listener")
-	ErrPrimaryPosixAcNotFound = errors.New("primary Posix account not found")
-	ErrFailedToGetGcpLogin    = errors.New("failed to get GCP login")
-	ErrTunnelReadyTimeout     = errors.New("timed out waiting for the tunnel to be ready")
-	ErrTunnelReturnedError    = errors.New("tunnel returned an error")
-	ErrSshTunnelToNoValue     = errors.New("ssh_tunnel_to must have a value")
-	ErrChannelIsNil           = errors.New("channel is nil")
-	ErrFailedToListen         = errors.New("failed to listen")
-	ErrFailedToGetPort        = errors.New("failed to get port")
-	ErrPrivateKeyFileNotFound = errors.New("private key file not found")
-	ErrInvalidPrivateKeyFile  = errors.New("invalid private key file")
-	ErrNilParameter           = errors.New("unexpected nil parameter")
+	ErrSshDialFailed           = errors.New("error dialing ssh tunnel")
+	ErrFailedToReadYaml        = errors.New("failed to read yaml file")
+	ErrFailedToUnmarshalYaml   = errors.New("failed to unmarshal yaml file")
+	ErrConfigSectionNotFound   = errors.New("config section not found")
+	ErrNotATcpListener         = errors.New("not a TCP listener")
+	ErrPrimaryPosixAcNotFound  = errors.New("primary Posix account not found")
+	ErrFailedToGetGcpLogin     = errors.New("failed to get GCP login")
+	ErrTunnelReadyTimeout      = errors.New("timed out waiting for the tunnel to be ready")
+	ErrTunnelReturnedError     = errors.New("tunnel returned an error")
+	ErrSshTunnelToNoValue      = errors.New("ssh_tunnel_to or remote_socket must have a value")
+	ErrSshTunnelToAndSocket    = errors.New("ssh_tunnel tunnel_to and remote_socket cannot both be set")
+	ErrSshHopHostNoValue       = errors.New("ssh_tunnel hop host must have a value")
+	ErrSshHopDialFailed        = errors.New("error dialing ssh hop")
+	ErrSshHopHostKeyAndKnown   = errors.New("ssh_tunnel hop host_key and known_hosts cannot both be set")
+	ErrInvalidSshHostKey       = errors.New("invalid ssh_tunnel hop host_key")
+	ErrFailedToReadKnownHosts  = errors.New("failed to read known_hosts file")
+	ErrChannelIsNil            = errors.New("channel is nil")
+	ErrFailedToListen          = errors.New("failed to listen")
+	ErrFailedToGetPort         = errors.New("failed to get port")
+	ErrPrivateKeyFileNotFound  = errors.New("private key file not found")
+	ErrInvalidPrivateKeyFile   = errors.New("invalid private key file")
+	ErrNilParameter            = errors.New("unexpected nil parameter")
+	ErrLocalSocketPathNoValue  = errors.New("local_socket path must have a value")
+	ErrInvalidLocalSocketMode  = errors.New("local_socket mode must be an octal file mode")
+	ErrFailedToSetSocketPerms  = errors.New("failed to set local socket permissions")
+	ErrPeerCredUnsupported     = errors.New("allowed_uids and allowed_users are not supported on this platform")
+	ErrPeerUidNotFound         = errors.New("failed to find the UID of the connecting process")
+	ErrUnknownAllowedUser      = errors.New("unknown user in allowed_users")
+	ErrInvalidLocalAddress     = errors.New("local_address must be localhost or an IP address")
+	ErrRemoteClientsNotAllowed = errors.New("local_address is not a loopback address and allow_remote_clients is not set")
+	ErrLocalAddressAndSocket   = errors.New("local_address and local_socket cannot both be set")
+	ErrFailedToReadEnvFile     = errors.New("failed to read env_file")
+	ErrInvalidEnvFile          = errors.New("env_file lines must be KEY=VALUE")
+	ErrInvalidExecTemplate     = errors.New("invalid template in exec argument")
+	ErrInvalidRestartPolicy    = errors.New("restart must be never, on-failure or always")
+	ErrHookFailed              = errors.New("hook failed")
+	ErrEmptyCommand            = errors.New("command must not be empty")
+	ErrInvalidReadinessType    = errors.New("readiness type must be tcp, http, https, tls, postgres, mysql or redis")
+	ErrInvalidReadinessRetries = errors.New("readiness retries must not be negative")
+	ErrReadinessProbeFailed    = errors.New("readiness probe failed")
+	ErrUnexpectedProbeResponse = errors.New("unexpected response to readiness probe")
+	ErrProbeNotConnected       = errors.New("readiness probe was not connected to the remote service")
+	ErrInvalidReadyFormat      = errors.New("ready format must be json or dotenv")
+	ErrFailedToWriteReadyFile  = errors.New("failed to write connection details")
+	ErrDaemonNotRunning        = errors.New("iapgo daemon is not running")
+	ErrFailedToStartDaemon     = errors.New("failed to start iapgo daemon")
+	ErrControlSocket           = errors.New("control socket error")
+	ErrDaemonRequestFailed     = errors.New("iapgo daemon request failed")
+	ErrUnknownCommand          = errors.New("unknown command")
+	ErrSectionRequired         = errors.New("a configuration section is required")
+	ErrInvalidSectionName      = errors.New("section name must not contain a path separator or be . or ..")
+	ErrFlagNotAllowedWithUp    = errors.New("flag cannot be used with up")
+	ErrTunnelAlreadyRunning    = errors.New("tunnel is already running")
+	ErrTunnelNotFound          = errors.New("no tunnel for section")
+	ErrTunnelFailedToStart     = errors.New("tunnel failed to start")
+	ErrFailedToFetchStats      = errors.New("failed to fetch tunnel stats")
+	ErrFailedToSetUpTracing    = errors.New("failed to set up tracing")
+	ErrInvalidLogFormat        = errors.New("invalid log format")
+	ErrInvalidLogLevel         = errors.New("invalid log level")
+	ErrFailedToOpenLogFile     = errors.New("failed to open log file")
+	ErrFailedToOpenAuditLog    = errors.New("failed to open audit log")
+	ErrConnectionIdleTimeout   = errors.New("connection was idle for too long")
+	ErrConnectionMaxLifetime   = errors.New("connection reached its maximum lifetime")
+	ErrConnTimeoutsNeedSsh     = errors.New("connection_idle_timeout and connection_max_lifetime require ssh_tunnel")
+	ErrInvalidCopyBufferSize   = errors.New("copy_buffer_size must not be negative")
+	ErrInvalidIapPoolSize      = errors.New("iap_pool.size must be at least 1")
+	ErrIapConnectFailed        = errors.New("failed to connect through IAP")
+	ErrIapPoolWithSsh          = errors.New("iap_pool cannot be used with ssh_tunnel")
+	ErrLazyIdleNeedsLazy       = errors.New("lazy_idle_timeout requires lazy")
+	ErrLazyWithReadiness       = errors.New("lazy and readiness cannot both be set")
+	ErrLazyWithIapPool         = errors.New("lazy and iap_pool cannot both be set")
+	ErrNegativeSessionLimit    = errors.New("idle_timeout, max_duration and max_duration_warning must not be negative")
+	ErrIdleTimeout             = errors.New("no connections for idle_timeout")
+	ErrMaxDuration             = errors.New("reached max_duration")
+	ErrStopSignal              = errors.New("received SIGINT or SIGTERM")
 )
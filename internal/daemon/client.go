@@ -0,0 +1,100 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+)
+
+const (
+	socketName    = "iapgo.sock"
+	daemonLogName = "daemon.log"
+	// startTimeout is how long a client waits for a daemon that it has started to begin listening.
+	startTimeout = 5 * time.Second
+)
+
+// StateDir returns the per-user directory that holds the control socket, the daemon's log and the
+// connection details of each tunnel.  This is $XDG_RUNTIME_DIR/iapgo if it is set, otherwise a directory
+// in the user's cache directory.  The directory is created if necessary and is only accessible by the user.
+func StateDir() (string, error) {
+	base := os.Getenv("XDG_RUNTIME_DIR")
+	if base == "" {
+		var err error
+
+		base, err = os.UserCacheDir()
+		if err != nil {
+			return "", fmt.Errorf("%w: %w", constants.ErrControlSocket, err)
+		}
+	}
+
+	dir := filepath.Join(base, "iapgo")
+
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", constants.ErrControlSocket, err)
+	}
+
+	return dir, nil
+}
+
+// SocketPath returns the path of the control socket in stateDir.
+func SocketPath(stateDir string) string {
+	return filepath.Join(stateDir, socketName)
+}
+
+// EnsureRunning starts a daemon if one is not already listening on the control socket in stateDir.  The
+// daemon is started by running this executable with the daemon command, detached from the terminal so
+// that it survives the terminal being closed.  Its own log is written to daemon.log in stateDir.
+func EnsureRunning(stateDir string) error {
+	socketPath := SocketPath(stateDir)
+
+	_, err := Call(socketPath, Request{Command: CommandStatus})
+	if err == nil || !errors.Is(err, constants.ErrDaemonNotRunning) {
+		return err
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("%w: %w", constants.ErrFailedToStartDaemon, err)
+	}
+
+	logFile, err := os.OpenFile(
+		filepath.Join(stateDir, daemonLogName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600,
+	)
+	if err != nil {
+		return fmt.Errorf("%w: %w", constants.ErrFailedToStartDaemon, err)
+	}
+
+	defer func() { _ = logFile.Close() }()
+
+	cmd := exec.Command(self, "daemon")
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	cmd.SysProcAttr = detachedProcAttr()
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("%w: %w", constants.ErrFailedToStartDaemon, err)
+	}
+
+	// The daemon is not waited for, so release it rather than leaving it as a zombie of a short-lived
+	// client.
+	_ = cmd.Process.Release()
+
+	deadline := time.Now().Add(startTimeout)
+	for time.Now().Before(deadline) {
+		_, err = Call(socketPath, Request{Command: CommandStatus})
+		if err == nil {
+			return nil
+		}
+
+		time.Sleep(readyPollInterval)
+	}
+
+	return fmt.Errorf("%w: %w", constants.ErrFailedToStartDaemon, err)
+}
@@ -0,0 +1,439 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/config"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/listener"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/readyfile"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+)
+
+// upTimeout is how long up waits for a tunnel to become ready before returning.  The tunnel is left running
+// if it is still starting.  It allows for slow before_start hooks such as starting the instance.  It is a
+// variable so that tests can shorten it.
+var upTimeout = 2 * time.Minute
+
+const (
+	// stopTimeout is how long down waits for a tunnel to exit after asking it to stop before killing it.
+	// The tunnel may itself be waiting for its exec command's grace period.
+	stopTimeout = 30 * time.Second
+	// startupIdleTimeout is how long a daemon with no tunnels waits for its first request before exiting.
+	startupIdleTimeout = 30 * time.Second
+	readyPollInterval  = 100 * time.Millisecond
+)
+
+// Daemon runs tunnels in the background on behalf of clients that connect to its control socket.  Each
+// tunnel is a separate iapgo process so that a failure in one tunnel cannot affect the others.
+type Daemon struct {
+	socketPath string
+	stateDir   string
+	logger     *slog.Logger
+	// newCmd builds the command that runs a tunnel.  It is a field so that tests can replace it.
+	newCmd func(req Request, readyFile string, statsSocket string) (*exec.Cmd, error)
+
+	mu       sync.Mutex
+	tunnels  map[string]*tunnel
+	idle     chan struct{}
+	idleOnce sync.Once
+}
+
+type tunnel struct {
+	req         Request
+	cmd         *exec.Cmd
+	logs        *logBuffer
+	readyFile   string
+	statsSocket string
+	started     time.Time
+	// done is closed once the process has exited and exitCode has been set.
+	done     chan struct{}
+	exitCode int
+}
+
+// NewDaemon creates a daemon that listens on socketPath and keeps the connection details of its tunnels
+// in stateDir.
+func NewDaemon(socketPath string, stateDir string, logger *slog.Logger) *Daemon {
+	return &Daemon{
+		socketPath: socketPath,
+		stateDir:   stateDir,
+		logger:     logger,
+		newCmd:     selfCmd,
+		tunnels:    make(map[string]*tunnel),
+		idle:       make(chan struct{}),
+	}
+}
+
+// selfCmd runs the tunnel by starting this executable in the foreground mode, with the client's working
+// directory and environment.
+func selfCmd(req Request, readyFile string, statsSocket string) (*exec.Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		"-f", req.ConfigFile, "-c", req.Section, "-ready-file", readyFile, "-stats-socket", statsSocket,
+	}
+	if req.Verbose {
+		args = append(args, "-v")
+	}
+
+	args = append(args, req.Flags...)
+
+	cmd := exec.Command(self, args...)
+	cmd.Dir = req.Dir
+	cmd.Env = req.Env
+
+	return cmd, nil
+}
+
+// Run serves the control socket until ctx is cancelled or there are no tunnels left, and then stops any
+// tunnels that are still running.
+func (d *Daemon) Run(ctx context.Context) error {
+	lsnr, err := listener.ListenUnix(&config.LocalSocketCfg{Path: d.socketPath}, d.logger)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = lsnr.Close() }()
+
+	d.logger.Info("daemon is listening", "socket", d.socketPath, "pid", os.Getpid())
+
+	idleTimer := time.AfterFunc(startupIdleTimeout, d.checkIdle)
+	defer idleTimer.Stop()
+
+	go func() {
+		for {
+			conn, err := lsnr.Accept()
+			if err != nil {
+				return
+			}
+
+			go d.serveConn(ctx, conn)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		d.logger.Info("daemon is stopping", "cause", context.Cause(ctx))
+	case <-d.idle:
+		d.logger.Info("no tunnels left so daemon is stopping")
+	}
+
+	d.stopAll()
+
+	return nil
+}
+
+func (d *Daemon) serveConn(ctx context.Context, conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	// This only limits reading the request, which the client sends straight away.
+	_ = conn.SetReadDeadline(time.Now().Add(callTimeout))
+
+	var req Request
+
+	resp := &Response{}
+
+	err := json.NewDecoder(conn).Decode(&req)
+	if err == nil {
+		resp, err = d.handle(ctx, req)
+	}
+
+	if err != nil {
+		d.logger.Error("request failed", "command", req.Command, "section", req.Section, "error", err)
+		resp.Error = err.Error()
+	}
+
+	err = json.NewEncoder(conn).Encode(resp)
+	if err != nil {
+		d.logger.Error("failed to send response", "error", err)
+	}
+
+	// Other commands never remove a tunnel.  In particular the status request used to check that a new
+	// daemon is listening must not stop it before the up request arrives.
+	if req.Command == CommandDown {
+		d.checkIdle()
+	}
+}
+
+func (d *Daemon) handle(ctx context.Context, req Request) (*Response, error) {
+	if req.Section == "" && req.Command != CommandStatus {
+		return &Response{}, fmt.Errorf("%w: %s", constants.ErrSectionRequired, req.Command)
+	}
+
+	// The section name is used to name files in the state directory, so it must not be able to point
+	// anywhere else.
+	if req.Section != "" && !validSection(req.Section) {
+		return &Response{}, fmt.Errorf("%w: %q", constants.ErrInvalidSectionName, req.Section)
+	}
+
+	switch req.Command {
+	case CommandUp:
+		return d.up(ctx, req)
+	case CommandDown:
+		return d.down(req.Section)
+	case CommandStatus:
+		return d.status(req.Section)
+	case CommandLogs:
+		t, err := d.lookup(req.Section)
+		if err != nil {
+			return &Response{}, err
+		}
+
+		return &Response{Logs: t.logs.Lines(req.Lines)}, nil
+	default:
+		return &Response{}, fmt.Errorf("%w: %s", constants.ErrUnknownCommand, req.Command)
+	}
+}
+
+// validSection reports whether section can be used as a file name in the state directory.
+func validSection(section string) bool {
+	return filepath.Base(section) == section && section != "." && section != ".."
+}
+
+// up starts the tunnel and waits for it to become ready, so that a script can use it as soon as up returns.
+func (d *Daemon) up(ctx context.Context, req Request) (*Response, error) {
+	d.mu.Lock()
+
+	if t, ok := d.tunnels[req.Section]; ok {
+		select {
+		case <-t.done:
+			// A tunnel that has exited is replaced, but its logs are lost.
+		default:
+			d.mu.Unlock()
+
+			return &Response{}, fmt.Errorf("%w: %s", constants.ErrTunnelAlreadyRunning, req.Section)
+		}
+	}
+
+	readyFile := filepath.Join(d.stateDir, req.Section+".json")
+	statsSocket := filepath.Join(d.stateDir, req.Section+".stats.sock")
+	_ = os.Remove(readyFile)
+
+	cmd, err := d.newCmd(req, readyFile, statsSocket)
+	if err != nil {
+		d.mu.Unlock()
+
+		return &Response{}, err
+	}
+
+	t := &tunnel{
+		req:         req,
+		cmd:         cmd,
+		logs:        newLogBuffer(DefaultLogLines),
+		readyFile:   readyFile,
+		statsSocket: statsSocket,
+		started:     time.Now(),
+		done:        make(chan struct{}),
+	}
+
+	cmd.Stdout = t.logs
+	cmd.Stderr = t.logs
+
+	err = cmd.Start()
+	if err != nil {
+		d.mu.Unlock()
+
+		return &Response{}, err
+	}
+
+	d.tunnels[req.Section] = t
+	d.mu.Unlock()
+
+	d.logger.Info("started tunnel", "section", req.Section, "pid", cmd.Process.Pid)
+
+	go func() {
+		_ = cmd.Wait()
+		t.exitCode = cmd.ProcessState.ExitCode()
+		close(t.done)
+
+		d.logger.Info("tunnel exited", "section", req.Section, "exitCode", t.exitCode)
+	}()
+
+	timeout := time.NewTimer(upTimeout)
+	defer timeout.Stop()
+
+	ticker := time.NewTicker(readyPollInterval)
+	defer ticker.Stop()
+
+	for {
+		status := t.status()
+
+		switch status.State {
+		case StateReady:
+			return &Response{Tunnels: []TunnelStatus{status}}, nil
+		case StateExited:
+			return &Response{Tunnels: []TunnelStatus{status}, Logs: t.logs.Lines(20)}, fmt.Errorf(
+				"%w: %s exited with code %d", constants.ErrTunnelFailedToStart, req.Section, status.ExitCode,
+			)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-timeout.C:
+			return &Response{Tunnels: []TunnelStatus{status}}, nil
+		case <-ctx.Done():
+			return &Response{}, context.Cause(ctx)
+		}
+	}
+}
+
+func (d *Daemon) down(section string) (*Response, error) {
+	t, err := d.lookup(section)
+	if err != nil {
+		return &Response{}, err
+	}
+
+	t.stop(d.logger)
+
+	d.mu.Lock()
+	if d.tunnels[section] == t {
+		delete(d.tunnels, section)
+	}
+	d.mu.Unlock()
+
+	return &Response{Tunnels: []TunnelStatus{t.status()}}, nil
+}
+
+func (d *Daemon) status(section string) (*Response, error) {
+	if section != "" {
+		t, err := d.lookup(section)
+		if err != nil {
+			return &Response{}, err
+		}
+
+		return &Response{Tunnels: []TunnelStatus{t.status()}}, nil
+	}
+
+	d.mu.Lock()
+	tunnels := make([]*tunnel, 0, len(d.tunnels))
+	for _, t := range d.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	d.mu.Unlock()
+
+	resp := &Response{Tunnels: make([]TunnelStatus, 0, len(tunnels))}
+	for _, t := range tunnels {
+		resp.Tunnels = append(resp.Tunnels, t.status())
+	}
+
+	sort.Slice(resp.Tunnels, func(i, j int) bool { return resp.Tunnels[i].Section < resp.Tunnels[j].Section })
+
+	return resp, nil
+}
+
+func (d *Daemon) lookup(section string) (*tunnel, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	t, ok := d.tunnels[section]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", constants.ErrTunnelNotFound, section)
+	}
+
+	return t, nil
+}
+
+func (d *Daemon) stopAll() {
+	d.mu.Lock()
+	tunnels := make([]*tunnel, 0, len(d.tunnels))
+	for _, t := range d.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	d.mu.Unlock()
+
+	var wg sync.WaitGroup
+
+	for _, t := range tunnels {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			t.stop(d.logger)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// checkIdle tells Run to return if there are no tunnels left, including tunnels that have exited but whose
+// logs could still be read.
+func (d *Daemon) checkIdle() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.tunnels) == 0 {
+		d.idleOnce.Do(func() { close(d.idle) })
+	}
+}
+
+// stop asks the tunnel to exit, which gives it the chance to run its after_stop hooks, and kills it if it
+// has not exited after stopTimeout.
+func (t *tunnel) stop(logger *slog.Logger) {
+	select {
+	case <-t.done:
+		return
+	default:
+	}
+
+	err := stopProcess(t.cmd.Process)
+	if err != nil && !errors.Is(err, os.ErrProcessDone) {
+		logger.Error("failed to stop tunnel", "section", t.req.Section, "error", err)
+	}
+
+	select {
+	case <-t.done:
+	case <-time.After(stopTimeout):
+		logger.Error("tunnel did not stop so killing it", "section", t.req.Section)
+
+		_ = t.cmd.Process.Kill()
+		<-t.done
+	}
+}
+
+func (t *tunnel) status() TunnelStatus {
+	status := TunnelStatus{
+		Section:    t.req.Section,
+		ConfigFile: t.req.ConfigFile,
+		Pid:        t.cmd.Process.Pid,
+		State:      StateStarting,
+		Started:    t.started,
+	}
+
+	select {
+	case <-t.done:
+		status.State = StateExited
+		status.ExitCode = t.exitCode
+
+		return status
+	default:
+	}
+
+	info, err := readyfile.ReadFile(t.readyFile)
+	if err == nil {
+		status.State = StateReady
+		status.Ready = &info
+	}
+
+	// The stats socket may not exist yet if the tunnel is still starting.
+	snap, err := stats.Fetch(t.statsSocket)
+	if err == nil {
+		status.Stats = snap
+	}
+
+	return status
+}
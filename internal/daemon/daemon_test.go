@@ -0,0 +1,291 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/config"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/listener"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/readyfile"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+)
+
+// TestHelperProcess is not a real test.  It is run as a tunnel by the other tests.  Depending on its last
+// argument it either exits straight away or writes its ready file, after a delay if it is "slow", and then
+// waits to be stopped.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("IAPGO_TEST_HELPER_PROCESS") != "1" {
+		return
+	}
+
+	fmt.Println("helper starting")
+
+	if os.Args[len(os.Args)-1] == "fail" {
+		fmt.Fprintln(os.Stderr, "helper failed")
+		os.Exit(3)
+	}
+
+	if os.Args[len(os.Args)-1] == "slow" {
+		time.Sleep(time.Second)
+	}
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	statsLsnr, err := listener.ListenUnix(&config.LocalSocketCfg{Path: os.Getenv("STATS_SOCKET")}, logger)
+	if err != nil {
+		os.Exit(255)
+	}
+
+	go stats.New("test").Serve(statsLsnr, logger)
+
+	info := readyfile.Info{Section: "test", Host: "localhost", Port: 1234, Pid: os.Getpid()}
+	if err := readyfile.WriteFile(os.Getenv("READY_FILE"), readyfile.FormatJson, info); err != nil {
+		os.Exit(255)
+	}
+
+	time.Sleep(time.Minute)
+	os.Exit(0)
+}
+
+func helperCmd(req Request, readyFile string, statsSocket string) (*exec.Cmd, error) {
+	cmd := exec.Command(os.Args[0], "-test.run=TestHelperProcess", "--", req.Section)
+	cmd.Env = append(
+		os.Environ(), "IAPGO_TEST_HELPER_PROCESS=1", "READY_FILE="+readyFile, "STATS_SOCKET="+statsSocket,
+	)
+
+	return cmd, nil
+}
+
+func startTestDaemon(t *testing.T) (string, <-chan error) {
+	t.Helper()
+
+	// Unix socket paths are limited to around 100 bytes, which t.TempDir() can exceed on macOS.
+	stateDir, err := os.MkdirTemp("", "iapgo")
+	if err != nil {
+		t.Fatalf("failed to create state directory: %v", err)
+	}
+
+	t.Cleanup(func() { _ = os.RemoveAll(stateDir) })
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	d := NewDaemon(SocketPath(stateDir), stateDir, logger)
+	d.newCmd = helperCmd
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	done := make(chan error, 1)
+
+	go func() { done <- d.Run(ctx) }()
+
+	socketPath := SocketPath(stateDir)
+	for i := 0; i < 50; i++ {
+		if _, err := os.Stat(socketPath); err == nil {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return socketPath, done
+}
+
+func TestDaemon(t *testing.T) {
+	socketPath, done := startTestDaemon(t)
+
+	tests := []struct {
+		name      string
+		req       Request
+		wantErr   error
+		wantState string
+		wantLogs  []string
+	}{
+		{
+			name:      "up",
+			req:       Request{Command: CommandUp, Section: "ok"},
+			wantState: StateReady,
+		},
+		{
+			name:    "up_already_running",
+			req:     Request{Command: CommandUp, Section: "ok"},
+			wantErr: constants.ErrDaemonRequestFailed,
+		},
+		{
+			name:      "up_fails",
+			req:       Request{Command: CommandUp, Section: "fail"},
+			wantErr:   constants.ErrDaemonRequestFailed,
+			wantState: StateExited,
+		},
+		{
+			name:      "status",
+			req:       Request{Command: CommandStatus, Section: "ok"},
+			wantState: StateReady,
+		},
+		{
+			name:     "logs",
+			req:      Request{Command: CommandLogs, Section: "fail"},
+			wantLogs: []string{"helper starting", "helper failed"},
+		},
+		{
+			name:     "logs_last_line",
+			req:      Request{Command: CommandLogs, Section: "fail", Lines: 1},
+			wantLogs: []string{"helper failed"},
+		},
+		{
+			name:    "logs_unknown_section",
+			req:     Request{Command: CommandLogs, Section: "unknown"},
+			wantErr: constants.ErrDaemonRequestFailed,
+		},
+		{
+			name:    "up_section_with_path",
+			req:     Request{Command: CommandUp, Section: "../escape"},
+			wantErr: constants.ErrDaemonRequestFailed,
+		},
+		{
+			name:    "up_section_dot_dot",
+			req:     Request{Command: CommandUp, Section: ".."},
+			wantErr: constants.ErrDaemonRequestFailed,
+		},
+		{
+			name:    "unknown_command",
+			req:     Request{Command: "restart", Section: "ok"},
+			wantErr: constants.ErrDaemonRequestFailed,
+		},
+		{
+			name:      "down",
+			req:       Request{Command: CommandDown, Section: "ok"},
+			wantState: StateExited,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := Call(socketPath, tt.req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Call() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantState != "" {
+				if len(resp.Tunnels) != 1 || resp.Tunnels[0].State != tt.wantState {
+					t.Fatalf("Call() tunnels = %+v, want state %s", resp.Tunnels, tt.wantState)
+				}
+			}
+
+			if tt.wantState == StateReady && resp.Tunnels[0].Ready.Port != 1234 {
+				t.Errorf("Call() ready = %+v, want port 1234", resp.Tunnels[0].Ready)
+			}
+
+			if tt.wantState == StateReady && (resp.Tunnels[0].Stats == nil || resp.Tunnels[0].Stats.Section != "test") {
+				t.Errorf("Call() stats = %+v, want stats for section test", resp.Tunnels[0].Stats)
+			}
+
+			if tt.wantLogs != nil && fmt.Sprint(resp.Logs) != fmt.Sprint(tt.wantLogs) {
+				t.Errorf("Call() logs = %q, want %q", resp.Logs, tt.wantLogs)
+			}
+		})
+	}
+
+	// Removing the last tunnel stops the daemon.
+	_, err := Call(socketPath, Request{Command: CommandDown, Section: "fail"})
+	if err != nil {
+		t.Fatalf("Call() error = %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon did not stop after its last tunnel was removed")
+	}
+
+	_, err = Call(socketPath, Request{Command: CommandStatus})
+	if !errors.Is(err, constants.ErrDaemonNotRunning) {
+		t.Errorf("Call() error = %v, wantErr %v", err, constants.ErrDaemonNotRunning)
+	}
+}
+
+func TestLogBuffer(t *testing.T) {
+	b := newLogBuffer(2)
+
+	_, _ = b.Write([]byte("one\ntwo\r\nthr"))
+	_, _ = b.Write([]byte("ee\nfour"))
+
+	tests := []struct {
+		name string
+		n    int
+		want []string
+	}{
+		{name: "all", n: 0, want: []string{"two", "three", "four"}},
+		{name: "last", n: 1, want: []string{"four"}},
+		{name: "more_than_retained", n: 10, want: []string{"two", "three", "four"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := b.Lines(tt.n)
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("Lines() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDaemon_SlowUp checks that the client waits for as long as the daemon does when a tunnel is slow to
+// become ready, rather than giving up after callTimeout.
+func TestDaemon_SlowUp(t *testing.T) {
+	savedCallTimeout, savedUpTimeout, savedMargin := callTimeout, upTimeout, upCallMargin
+
+	t.Cleanup(func() { callTimeout, upTimeout, upCallMargin = savedCallTimeout, savedUpTimeout, savedMargin })
+
+	callTimeout, upTimeout, upCallMargin = 200*time.Millisecond, 5*time.Second, time.Second
+
+	socketPath, _ := startTestDaemon(t)
+
+	resp, err := Call(socketPath, Request{Command: CommandUp, Section: "slow"})
+	if err != nil {
+		t.Fatalf("Call() error = %v", err)
+	}
+
+	if len(resp.Tunnels) != 1 || resp.Tunnels[0].State != StateReady {
+		t.Errorf("Call() tunnels = %+v, want state %s", resp.Tunnels, StateReady)
+	}
+
+	_, err = Call(socketPath, Request{Command: CommandDown, Section: "slow"})
+	if err != nil {
+		t.Errorf("Call() error = %v", err)
+	}
+}
+
+func TestSelfCmd(t *testing.T) {
+	req := Request{
+		Command:    CommandUp,
+		Section:    "db",
+		ConfigFile: "/home/fred/iapgo.yaml",
+		Verbose:    true,
+		Flags:      []string{"-metrics-listen", "localhost:9090", "-log-file", "/tmp/iapgo.log"},
+	}
+
+	cmd, err := selfCmd(req, "/state/db.json", "/state/db.stats.sock")
+	if err != nil {
+		t.Fatalf("selfCmd() error = %v", err)
+	}
+
+	want := []string{
+		"-f", "/home/fred/iapgo.yaml", "-c", "db", "-ready-file", "/state/db.json",
+		"-stats-socket", "/state/db.stats.sock", "-v",
+		"-metrics-listen", "localhost:9090", "-log-file", "/tmp/iapgo.log",
+	}
+	if got := cmd.Args[1:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("selfCmd() args = %q, want %q", got, want)
+	}
+}
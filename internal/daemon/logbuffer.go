@@ -0,0 +1,63 @@
+package daemon
+
+import (
+	"bytes"
+	"sync"
+)
+
+// DefaultLogLines is the number of log lines kept for each tunnel.
+const DefaultLogLines = 1000
+
+// logBuffer keeps the most recent lines written to it.  The stdout and stderr of a tunnel are both
+// written to the same logBuffer, possibly from different goroutines.
+type logBuffer struct {
+	mu      sync.Mutex
+	lines   []string
+	partial []byte
+	max     int
+}
+
+func newLogBuffer(maxLines int) *logBuffer {
+	return &logBuffer{max: maxLines}
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.partial = append(b.partial, p...)
+
+	for {
+		i := bytes.IndexByte(b.partial, '\n')
+		if i < 0 {
+			break
+		}
+
+		b.lines = append(b.lines, string(bytes.TrimRight(b.partial[:i], "\r")))
+		b.partial = b.partial[i+1:]
+	}
+
+	if len(b.lines) > b.max {
+		b.lines = append([]string(nil), b.lines[len(b.lines)-b.max:]...)
+	}
+
+	return len(p), nil
+}
+
+// Lines returns up to n of the most recent lines, including any incomplete last line.  If n is zero then
+// every retained line is returned.
+func (b *logBuffer) Lines(n int) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	lines := b.lines
+	if len(b.partial) > 0 {
+		lines = append(lines[:len(lines):len(lines)], string(b.partial))
+	}
+
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return append([]string(nil), lines...)
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package daemon
+
+import (
+	"os"
+	"syscall"
+)
+
+// detachedProcAttr puts the daemon in a new session so that it does not receive signals from the terminal
+// and is not stopped when the terminal is closed.
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// stopProcess sends SIGTERM so that the tunnel can close its listeners and run its after_stop hooks.
+func stopProcess(process *os.Process) error {
+	return process.Signal(syscall.SIGTERM)
+}
@@ -0,0 +1,22 @@
+//go:build windows
+
+package daemon
+
+import (
+	"os"
+	"syscall"
+)
+
+// detachedProcess is the DETACHED_PROCESS process creation flag.
+const detachedProcess = 0x00000008
+
+// detachedProcAttr starts the daemon without a console so that it is not stopped when the console is
+// closed.
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: detachedProcess}
+}
+
+// stopProcess kills the tunnel because Windows has no equivalent of SIGTERM.
+func stopProcess(process *os.Process) error {
+	return process.Kill()
+}
@@ -0,0 +1,116 @@
+package daemon
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/readyfile"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+)
+
+// These are the commands that a client can send on the control socket.
+const (
+	CommandUp     = "up"
+	CommandDown   = "down"
+	CommandStatus = "status"
+	CommandLogs   = "logs"
+)
+
+// callTimeout limits how long a client waits for the daemon.  Stopping a tunnel can take as long as the
+// exec grace period, so this is generous.  An up request waits for upTimeout plus upCallMargin instead, so
+// that the client does not give up while the daemon is still waiting for the tunnel to become ready.  These
+// are variables so that tests can shorten them.
+var (
+	callTimeout  = time.Minute
+	upCallMargin = 30 * time.Second
+)
+
+// Request is sent by a client on the control socket.  Each connection carries a single request and
+// response, both encoded as JSON.
+type Request struct {
+	Command string `json:"command"`
+	Section string `json:"section,omitempty"`
+	// ConfigFile, Dir, Env and Verbose are used by up.  The tunnel is run with the client's working
+	// directory and environment so that it behaves as it would in the foreground.
+	ConfigFile string   `json:"config_file,omitempty"`
+	Dir        string   `json:"dir,omitempty"`
+	Env        []string `json:"env,omitempty"`
+	Verbose    bool     `json:"verbose,omitempty"`
+	// Flags holds the other flags that up was run with, such as -metrics-listen, which are passed on to
+	// the tunnel.
+	Flags []string `json:"flags,omitempty"`
+	// Lines is the number of log lines returned by logs.  Zero means all of the retained lines.
+	Lines int `json:"lines,omitempty"`
+}
+
+// Response is sent by the daemon.  If Error is set then the request failed.
+type Response struct {
+	Error   string         `json:"error,omitempty"`
+	Tunnels []TunnelStatus `json:"tunnels,omitempty"`
+	Logs    []string       `json:"logs,omitempty"`
+}
+
+// TunnelStatus describes a tunnel managed by the daemon.
+type TunnelStatus struct {
+	Section    string    `json:"section"`
+	ConfigFile string    `json:"config_file"`
+	Pid        int       `json:"pid"`
+	State      string    `json:"state"`
+	Started    time.Time `json:"started"`
+	// ExitCode is only meaningful when State is StateExited.
+	ExitCode int `json:"exit_code"`
+	// Ready holds the connection details once the tunnel is ready.
+	Ready *readyfile.Info `json:"ready,omitempty"`
+	// Stats holds the tunnel's connection statistics while it is running.
+	Stats *stats.Snapshot `json:"stats,omitempty"`
+}
+
+// These are the values used for TunnelStatus.State.
+const (
+	StateStarting = "starting"
+	StateReady    = "ready"
+	StateExited   = "exited"
+)
+
+// timeoutFor returns how long a client waits for the response to command.
+func timeoutFor(command string) time.Duration {
+	if command == CommandUp {
+		return upTimeout + upCallMargin
+	}
+
+	return callTimeout
+}
+
+// Call sends req to the daemon listening on socketPath and returns its response.  An error reported by
+// the daemon is returned as ErrDaemonRequestFailed.
+func Call(socketPath string, req Request) (*Response, error) {
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", constants.ErrDaemonNotRunning, err)
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetDeadline(time.Now().Add(timeoutFor(req.Command)))
+
+	err = json.NewEncoder(conn).Encode(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", constants.ErrControlSocket, err)
+	}
+
+	var resp Response
+
+	err = json.NewDecoder(conn).Decode(&resp)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", constants.ErrControlSocket, err)
+	}
+
+	if resp.Error != "" {
+		return &resp, fmt.Errorf("%w: %s", constants.ErrDaemonRequestFailed, resp.Error)
+	}
+
+	return &resp, nil
+}
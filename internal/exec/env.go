@@ -0,0 +1,159 @@
+package exec
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+)
+
+// Options holds the settings from the config section that control how the exec command is run.
+type Options struct {
+	Args []string
+	// Env values may refer to other variables, including the IAPGO_* variables, as $NAME or ${NAME}.
+	Env     map[string]string
+	EnvFile string
+	WorkDir string
+	// GracePeriod is how long the command has to exit after being asked to terminate before it is killed.
+	GracePeriod time.Duration
+	// Restart is one of the config.Restart* policies.  If RestartMaxRetries is zero then there is no limit.
+	Restart           string
+	RestartMaxRetries int
+	RestartBackoff    time.Duration
+	RestartMaxBackoff time.Duration
+	Section           string
+	Instance          string
+}
+
+// BuildEnv returns the environment for the command.  This starts with the iapgo environment and then adds,
+// in order, the IAPGO_* variables, the variables from env_file and the variables from env, so that a later
+// source overrides an earlier one.  Values from env_file and env are expanded using the variables that
+// have already been set, which means that an env value cannot refer to another env value.
+func BuildEnv(opts Options, endpoint Endpoint) ([]string, error) {
+	env := make(map[string]string)
+
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		env[k] = v
+	}
+
+	env["IAPGO_SECTION"] = opts.Section
+	env["IAPGO_INSTANCE"] = opts.Instance
+	env["IAPGO_LISTEN_HOST"] = endpoint.Host
+	env["IAPGO_LISTEN_PORT"] = strconv.Itoa(endpoint.Port)
+
+	// If the tunnel listens on a Unix domain socket then the port is zero and the path is needed instead.
+	if endpoint.Socket != "" {
+		env["IAPGO_LISTEN_SOCKET"] = endpoint.Socket
+	}
+
+	expand := func(s string) string {
+		return os.Expand(s, func(k string) string { return env[k] })
+	}
+
+	if opts.EnvFile != "" {
+		f, err := os.Open(opts.EnvFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", constants.ErrFailedToReadEnvFile, err)
+		}
+
+		vars, err := parseEnvFile(f)
+
+		_ = f.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", constants.ErrFailedToReadEnvFile, opts.EnvFile, err)
+		}
+
+		for _, v := range vars {
+			if v.literal {
+				env[v.key] = v.value
+			} else {
+				env[v.key] = expand(v.value)
+			}
+		}
+	}
+
+	// Expand all the values before setting any of them so that the result does not depend on map order.
+	expanded := make(map[string]string, len(opts.Env))
+	for k, v := range opts.Env {
+		expanded[k] = expand(v)
+	}
+
+	for k, v := range expanded {
+		env[k] = v
+	}
+
+	result := make([]string, 0, len(env))
+	for k, v := range env {
+		result = append(result, k+"="+v)
+	}
+
+	sort.Strings(result)
+
+	return result, nil
+}
+
+type envFileVar struct {
+	key   string
+	value string
+	// literal is set for single quoted values, which are not expanded.
+	literal bool
+}
+
+// parseEnvFile reads KEY=VALUE lines in the usual dotenv format.  Blank lines and lines starting with # are
+// ignored, an "export " prefix is allowed, and values may be single or double quoted.
+func parseEnvFile(r io.Reader) ([]envFileVar, error) {
+	var vars []envFileVar
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		line = strings.TrimPrefix(line, "export ")
+
+		k, v, ok := strings.Cut(line, "=")
+		k = strings.TrimSpace(k)
+
+		if !ok || k == "" || strings.ContainsAny(k, " \t") {
+			return nil, fmt.Errorf("%w: line %d", constants.ErrInvalidEnvFile, lineNum)
+		}
+
+		v = strings.TrimSpace(v)
+		literal := false
+
+		switch {
+		case len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"':
+			unquoted, err := strconv.Unquote(v)
+			if err != nil {
+				return nil, fmt.Errorf("%w: line %d: %w", constants.ErrInvalidEnvFile, lineNum, err)
+			}
+
+			v = unquoted
+		case len(v) >= 2 && v[0] == '\'' && v[len(v)-1] == '\'':
+			v = v[1 : len(v)-1]
+			literal = true
+		}
+
+		vars = append(vars, envFileVar{key: k, value: v, literal: literal})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return vars, nil
+}
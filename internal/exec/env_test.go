@@ -0,0 +1,118 @@
+package exec
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+)
+
+func TestBuildEnv(t *testing.T) {
+	t.Setenv("IAPGO_TEST_PARENT", "parent")
+
+	dir := t.TempDir()
+
+	envFile := filepath.Join(dir, "test.env")
+
+	err := os.WriteFile(envFile, []byte(`# comment
+export PGUSER=fred
+PGDATABASE="db_${PGUSER}"
+LITERAL='$IAPGO_LISTEN_PORT'
+FROM_FILE=file
+`), 0o600)
+	if err != nil {
+		t.Fatalf("failed to write env file: %v", err)
+	}
+
+	badEnvFile := filepath.Join(dir, "bad.env")
+
+	err = os.WriteFile(badEnvFile, []byte("NOT A VARIABLE\n"), 0o600)
+	if err != nil {
+		t.Fatalf("failed to write env file: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		opts     Options
+		endpoint Endpoint
+		want     []string
+		wantErr  error
+	}{
+		{
+			name: "iapgo_variables",
+			opts: Options{
+				Section:  "db",
+				Instance: "my-jumpbox",
+			},
+			endpoint: Endpoint{Host: "127.0.0.2", Port: 5432},
+			want: []string{
+				"IAPGO_SECTION=db",
+				"IAPGO_INSTANCE=my-jumpbox",
+				"IAPGO_LISTEN_HOST=127.0.0.2",
+				"IAPGO_LISTEN_PORT=5432",
+				"IAPGO_TEST_PARENT=parent",
+			},
+		},
+		{
+			name:     "socket",
+			endpoint: Endpoint{Socket: "/tmp/iapgo.sock"},
+			want:     []string{"IAPGO_LISTEN_SOCKET=/tmp/iapgo.sock", "IAPGO_LISTEN_PORT=0"},
+		},
+		{
+			name: "env_and_env_file",
+			opts: Options{
+				EnvFile: envFile,
+				Env: map[string]string{
+					"PGHOST":    "$IAPGO_LISTEN_HOST",
+					"PGPORT":    "${IAPGO_LISTEN_PORT}",
+					"FROM_FILE": "overridden",
+					"PARENT":    "$IAPGO_TEST_PARENT",
+				},
+			},
+			endpoint: Endpoint{Host: "localhost", Port: 1234},
+			want: []string{
+				"PGHOST=localhost",
+				"PGPORT=1234",
+				"PGUSER=fred",
+				"PGDATABASE=db_fred",
+				"LITERAL=$IAPGO_LISTEN_PORT",
+				"FROM_FILE=overridden",
+				"PARENT=parent",
+			},
+		},
+		{
+			name:    "missing_env_file",
+			opts:    Options{EnvFile: filepath.Join(dir, "does-not-exist")},
+			wantErr: constants.ErrFailedToReadEnvFile,
+		},
+		{
+			name:    "invalid_env_file",
+			opts:    Options{EnvFile: badEnvFile},
+			wantErr: constants.ErrInvalidEnvFile,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := BuildEnv(tt.opts, tt.endpoint)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("BuildEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			for _, want := range tt.want {
+				if !slices.Contains(got, want) {
+					t.Errorf("BuildEnv() is missing %q", want)
+				}
+			}
+
+			if tt.endpoint.Socket == "" && slices.ContainsFunc(got, func(s string) bool {
+				return strings.HasPrefix(s, "IAPGO_LISTEN_SOCKET=")
+			}) {
+				t.Error("BuildEnv() set IAPGO_LISTEN_SOCKET without a socket")
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"sync"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+)
+
+// RunHooks runs each hook command in order with the same environment and {{...}} placeholders as the exec
+// command.  The output of each hook is written to the log rather than to the terminal.  If a hook fails
+// then the remaining hooks are not run and the error is returned.
+func RunHooks(
+	ctx context.Context,
+	name string,
+	hooks [][]string,
+	opts Options,
+	endpoint Endpoint,
+	logger *slog.Logger,
+) error {
+	env, err := BuildEnv(opts, endpoint)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", constants.ErrHookFailed, name, err)
+	}
+
+	gracePeriod := opts.GracePeriod
+	if gracePeriod <= 0 {
+		gracePeriod = DefaultGracePeriod
+	}
+
+	for i, hook := range hooks {
+		hookOpts := opts
+		hookOpts.Args = hook
+
+		args, err := ExpandArgs(hookOpts, endpoint)
+		if err != nil {
+			return fmt.Errorf("%w: %s[%d]: %w", constants.ErrHookFailed, name, i, err)
+		}
+
+		hookLogger := logger.With("hook", name, "index", i)
+		output := &logWriter{logger: hookLogger}
+
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Env = env
+		cmd.Dir = opts.WorkDir
+		cmd.Stdout = output
+		cmd.Stderr = output
+		cmd.WaitDelay = gracePeriod
+
+		hookLogger.Info("running hook", "command", args)
+
+		err = cmd.Run()
+		output.flush()
+
+		if err != nil {
+			return fmt.Errorf("%w: %s[%d]: %w", constants.ErrHookFailed, name, i, err)
+		}
+	}
+
+	return nil
+}
+
+// logWriter logs each complete line that is written to it.  It is shared by stdout and stderr, which
+// exec.Cmd may write to from different goroutines, so it needs a mutex.
+type logWriter struct {
+	mu     sync.Mutex
+	logger *slog.Logger
+	buf    []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		w.logger.Info("hook output", "line", string(bytes.TrimRight(w.buf[:i], "\r")))
+		w.buf = w.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// flush logs any output that did not end with a newline.
+func (w *logWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.buf) > 0 {
+		w.logger.Info("hook output", "line", string(w.buf))
+		w.buf = nil
+	}
+}
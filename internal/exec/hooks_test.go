@@ -0,0 +1,97 @@
+package exec
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+)
+
+func TestRunHooks(t *testing.T) {
+	t.Setenv("IAPGO_TEST_HELPER_PROCESS", "1")
+
+	helper := func(mode string) []string {
+		return []string{os.Args[0], "-test.run=TestHelperProcess", "--", mode}
+	}
+
+	tests := []struct {
+		name      string
+		hooks     [][]string
+		exitCode  string
+		wantErr   error
+		wantCount int
+	}{
+		{
+			name:      "no_hooks",
+			hooks:     nil,
+			wantErr:   nil,
+			wantCount: 0,
+		},
+		{
+			name:      "all_succeed",
+			hooks:     [][]string{helper("count-and-exit"), helper("count-and-exit")},
+			exitCode:  "0",
+			wantErr:   nil,
+			wantCount: 2,
+		},
+		{
+			name:      "failure_stops_later_hooks",
+			hooks:     [][]string{helper("count-and-exit"), helper("count-and-exit")},
+			exitCode:  "1",
+			wantErr:   constants.ErrHookFailed,
+			wantCount: 1,
+		},
+		{
+			name:      "invalid_template",
+			hooks:     [][]string{{os.Args[0], "{{.Nope}}"}},
+			wantErr:   constants.ErrHookFailed,
+			wantCount: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			countFile := filepath.Join(t.TempDir(), "count")
+			t.Setenv("COUNT_FILE", countFile)
+			t.Setenv("EXIT_CODE", tt.exitCode)
+
+			logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+			err := RunHooks(context.Background(), tt.name, tt.hooks, Options{}, Endpoint{Host: "localhost"}, logger)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("RunHooks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			count, _ := os.ReadFile(countFile)
+			if len(count) != tt.wantCount {
+				t.Errorf("RunHooks() ran %d hooks, want %d", len(count), tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestRunHooks_OutputIsLogged(t *testing.T) {
+	t.Setenv("IAPGO_TEST_HELPER_PROCESS", "1")
+
+	var buf bytes.Buffer
+
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	hooks := [][]string{{os.Args[0], "-test.run=TestHelperProcess", "--", "print-output"}}
+
+	err := RunHooks(context.Background(), "after_ready", hooks, Options{}, Endpoint{Host: "localhost"}, logger)
+	if err != nil {
+		t.Fatalf("RunHooks() error = %v", err)
+	}
+
+	for _, want := range []string{`line="hello from stdout"`, `line="hello from stderr"`, "hook=after_ready"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("log output does not contain %q:\n%s", want, buf.String())
+		}
+	}
+}
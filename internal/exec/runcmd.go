@@ -2,29 +2,279 @@ package exec
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"log/slog"
 	"os"
 	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/config"
+)
+
+// These follow the shell conventions for a command that could not be run.
+const (
+	ExitCodeCannotRun = 126
+	ExitCodeNotFound  = 127
+	// A child killed by a signal is reported as ExitCodeSignalBase plus the signal number.
+	ExitCodeSignalBase = 128
+)
+
+// Endpoint describes where the tunnel is listening for local connections.
+type Endpoint struct {
+	Host string
+	Port int
+	// Socket is set instead of Host and Port when the tunnel listens on a Unix domain socket.
+	Socket string
+}
+
+const (
+	// DefaultGracePeriod is how long the command has to exit after being asked to terminate before it is killed.
+	DefaultGracePeriod = 10 * time.Second
+	// DefaultRestartBackoff is the delay before the first restart.  The delay doubles after each restart up to
+	// DefaultRestartMaxBackoff unless other values are configured.
+	DefaultRestartBackoff    = time.Second
+	DefaultRestartMaxBackoff = time.Minute
 )
 
-func RunCmd(ctx context.Context, args []string, port int, logger *slog.Logger) {
-	// Run the provided command.  To avoid having to enter the local port number into the configuration file twice
-	// make it available as an env var.  This will only work if exec runs a shell.  E.g., "bash -c ..."
-	err := os.Setenv("IAPGO_LISTEN_PORT", fmt.Sprintf("%d", port))
+// RunCmd runs the exec command and returns its exit code.  If the command cannot be started then
+// ExitCodeNotFound or ExitCodeCannotRun is returned instead.  The second result reports whether iapgo
+// received SIGINT or SIGTERM while the command was running or waiting to be restarted, which the caller
+// should treat as a request to stop.  The command's environment is built by
+// BuildEnv so the environment of iapgo itself is never changed.
+//
+// If ctx is cancelled (e.g., because the tunnel failed) then the command is asked to terminate and is killed
+// if it has not exited after the grace period.  While the command runs, SIGINT, SIGTERM and SIGWINCH are
+// passed on to it instead of stopping iapgo, so the tunnel stays up until the command has exited.
+//
+// The command is run again after it exits if the restart policy allows it, unless ctx has been cancelled,
+// the command was stopped by SIGINT or SIGTERM, or the maximum number of restarts has been reached.
+func RunCmd(ctx context.Context, opts Options, endpoint Endpoint, logger *slog.Logger) (int, bool) {
+	backoff := opts.RestartBackoff
+	if backoff <= 0 {
+		backoff = DefaultRestartBackoff
+	}
+
+	maxBackoff := opts.RestartMaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultRestartMaxBackoff
+	}
+
+	for restarts := 0; ; restarts++ {
+		exitCode, started, stopRequested := runOnce(ctx, opts, endpoint, logger)
+
+		switch {
+		case !started || stopRequested || ctx.Err() != nil:
+			return exitCode, stopRequested
+		case !shouldRestart(opts.Restart, exitCode):
+			return exitCode, false
+		case opts.RestartMaxRetries > 0 && restarts >= opts.RestartMaxRetries:
+			logger.Error("command will not be restarted again", "exitCode", exitCode, "restarts", restarts)
+
+			return exitCode, false
+		}
+
+		logger.Info("restarting command", "exitCode", exitCode, "restart", restarts+1, "backoff", backoff)
+
+		restart, stopRequested := waitToRestart(ctx, backoff)
+		if !restart {
+			if stopRequested {
+				logger.Info("received signal so the command will not be restarted")
+			}
+
+			return exitCode, stopRequested
+		}
+
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// waitToRestart waits for backoff before the command is restarted.  It returns false if ctx is cancelled or
+// iapgo receives SIGINT or SIGTERM first, and the second result reports whether it was because of a signal.
+func waitToRestart(ctx context.Context, backoff time.Duration) (bool, bool) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, forwardedSignals...)
+
+	defer signal.Stop(sigCh)
+
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return true, false
+		case <-ctx.Done():
+			return false, false
+		case sig := <-sigCh:
+			if stopSignals[sig] {
+				return false, true
+			}
+		}
+	}
+}
+
+func shouldRestart(policy string, exitCode int) bool {
+	switch policy {
+	case config.RestartAlways:
+		return true
+	case config.RestartOnFailure:
+		return exitCode != 0
+	default:
+		return false
+	}
+}
+
+// runOnce runs the command a single time.  started is false if the command could not be run at all, and
+// stopRequested is true if iapgo received SIGINT or SIGTERM while the command was running.
+func runOnce(ctx context.Context, opts Options, endpoint Endpoint, logger *slog.Logger) (int, bool, bool) {
+	env, err := BuildEnv(opts, endpoint)
 	if err != nil {
-		logger.Error("failed to set IAPGO_LISTEN_PORT environment variable")
+		logger.Error("failed to build environment for command", "error", err)
 
-		return
+		return ExitCodeCannotRun, false, false
 	}
-	cmd := exec.Command(args[0], args[1:]...)
+
+	gracePeriod := opts.GracePeriod
+	if gracePeriod <= 0 {
+		gracePeriod = DefaultGracePeriod
+	}
+
+	args, err := ExpandArgs(opts, endpoint)
+	if err != nil {
+		logger.Error("failed to expand exec arguments", "error", err)
+
+		return ExitCodeCannotRun, false, false
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = env
+	cmd.Dir = opts.WorkDir
 	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
 	cmd.Stdin = os.Stdin
-	err = cmd.Run()
+	// After Cancel is called, Wait kills the command if it has not exited within WaitDelay.
+	cmd.WaitDelay = gracePeriod
+
+	sharedTerminal := prepareCmd(cmd, stdinIsTerminal(), logger)
 
+	err = cmd.Start()
 	if err != nil {
-		logger.Error("failed to run command", "error", err)
+		exitCode := exitCodeFromErr(err)
+		logger.Error("failed to start command", "error", err, "exitCode", exitCode)
 
-		return
+		return exitCode, false, false
 	}
+
+	stopForwarding := forwardSignals(cmd.Process, sharedTerminal, logger)
+	err = cmd.Wait()
+	stopRequested := stopForwarding()
+
+	exitCode := exitCodeFromState(cmd.ProcessState, err)
+	if err != nil {
+		logger.Error("failed to run command", "error", err, "exitCode", exitCode)
+
+		return exitCode, true, stopRequested
+	}
+
+	logger.Debug("command exited", "exitCode", exitCode)
+
+	return exitCode, true, stopRequested
+}
+
+// forwardSignals passes signals received by iapgo on to the command until the returned function is called.
+// If the command shares our terminal then signals generated by the terminal (e.g., SIGINT from Control-C)
+// have already been delivered to it, so these are only caught and not sent a second time.  The returned
+// function reports whether any of the other signals was a request to stop.
+func forwardSignals(process *os.Process, sharedTerminal bool, logger *slog.Logger) func() bool {
+	sigCh := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	exited := make(chan struct{})
+
+	var stopRequested bool
+
+	signal.Notify(sigCh, forwardedSignals...)
+
+	go func() {
+		defer close(exited)
+
+		for {
+			select {
+			case sig := <-sigCh:
+				// A terminal signal such as Control-C was meant for the command, for example to cancel a
+				// query, so it does not stop iapgo once the command exits.
+				if sharedTerminal && terminalSignals[sig] {
+					logger.Debug("signal was delivered to command by the terminal", "signal", sig)
+
+					continue
+				}
+
+				if stopSignals[sig] {
+					stopRequested = true
+				}
+
+				logger.Debug("forwarding signal to command", "signal", sig)
+
+				err := process.Signal(sig)
+				if err != nil {
+					logger.Error("failed to forward signal to command", "signal", sig, "error", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() bool {
+		signal.Stop(sigCh)
+		close(done)
+		<-exited
+
+		return stopRequested
+	}
+}
+
+func stdinIsTerminal() bool {
+	fi, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// exitCodeFromState uses the process state if the command ran.  This is needed because Wait returns the
+// context error, rather than an *exec.ExitError, if the command was stopped because ctx was cancelled.
+func exitCodeFromState(state *os.ProcessState, err error) int {
+	if state == nil {
+		return exitCodeFromErr(err)
+	}
+
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return ExitCodeSignalBase + int(status.Signal())
+	}
+
+	return state.ExitCode()
+}
+
+func exitCodeFromErr(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+			return ExitCodeNotFound
+		}
+
+		return ExitCodeCannotRun
+	}
+
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return ExitCodeSignalBase + int(status.Signal())
+	}
+
+	return exitErr.ExitCode()
 }
@@ -0,0 +1,249 @@
+package exec
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/config"
+)
+
+// TestHelperProcess is not a real test.  It is run as the exec command by the other tests and exits with
+// the code passed as its last argument.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("IAPGO_TEST_HELPER_PROCESS") != "1" {
+		return
+	}
+
+	switch arg := os.Args[len(os.Args)-1]; arg {
+	case "check-env":
+		// The wanted values are passed in the environment, so this also checks that they reach the command.
+		wd, _ := os.Getwd()
+		if os.Getenv("PGPORT") != "1234" || os.Getenv("PGHOST") != "localhost" || wd != os.Getenv("WANT_DIR") {
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	case "count-and-exit":
+		// Record each run so that restarts can be counted, then exit with the code from the environment.
+		f, err := os.OpenFile(os.Getenv("COUNT_FILE"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			os.Exit(255)
+		}
+
+		_, _ = f.WriteString("x")
+		_ = f.Close()
+
+		code, _ := strconv.Atoi(os.Getenv("EXIT_CODE"))
+		os.Exit(code)
+	case "print-output":
+		fmt.Println("hello from stdout")
+		fmt.Fprint(os.Stderr, "hello from stderr")
+		os.Exit(0)
+	case "sleep":
+		time.Sleep(time.Minute)
+	case "ignore-sigterm":
+		signal.Ignore(syscall.SIGTERM)
+		time.Sleep(time.Minute)
+	default:
+		code, err := strconv.Atoi(arg)
+		if err != nil {
+			os.Exit(255)
+		}
+
+		os.Exit(code)
+	}
+}
+
+func TestRunCmd(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	t.Setenv("IAPGO_TEST_HELPER_PROCESS", "1")
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{
+			name: "success",
+			args: []string{os.Args[0], "-test.run=TestHelperProcess", "--", "0"},
+			want: 0,
+		},
+		{
+			name: "failure",
+			args: []string{os.Args[0], "-test.run=TestHelperProcess", "--", "3"},
+			want: 3,
+		},
+		{
+			name: "not_found",
+			args: []string{"iapgo-command-that-does-not-exist"},
+			want: ExitCodeNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := RunCmd(context.Background(), Options{Args: tt.args}, Endpoint{Host: "localhost", Port: 1234}, logger)
+			if got != tt.want {
+				t.Errorf("RunCmd() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunCmd_ContextCancelled(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	t.Setenv("IAPGO_TEST_HELPER_PROCESS", "1")
+
+	tests := []struct {
+		name        string
+		helperArg   string
+		gracePeriod time.Duration
+		maxDuration time.Duration
+	}{
+		{
+			name:        "terminated",
+			helperArg:   "sleep",
+			gracePeriod: 30 * time.Second,
+			maxDuration: 10 * time.Second,
+		},
+		{
+			name:        "killed_after_grace_period",
+			helperArg:   "ignore-sigterm",
+			gracePeriod: 500 * time.Millisecond,
+			maxDuration: 10 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			args := []string{os.Args[0], "-test.run=TestHelperProcess", "--", tt.helperArg}
+
+			got, _ := RunCmd(ctx, Options{Args: args, GracePeriod: tt.gracePeriod}, Endpoint{}, logger)
+			if got == 0 {
+				t.Errorf("RunCmd() = %v, want a non-zero exit code", got)
+			}
+
+			if elapsed := time.Since(start); elapsed > tt.maxDuration {
+				t.Errorf("RunCmd() took %v, want less than %v", elapsed, tt.maxDuration)
+			}
+		})
+	}
+}
+
+func TestRunCmd_EnvAndWorkDir(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to resolve temp dir: %v", err)
+	}
+
+	opts := Options{
+		Args: []string{os.Args[0], "-test.run=TestHelperProcess", "--", "check-env"},
+		Env: map[string]string{
+			"IAPGO_TEST_HELPER_PROCESS": "1",
+			"PGHOST":                    "$IAPGO_LISTEN_HOST",
+			"PGPORT":                    "${IAPGO_LISTEN_PORT}",
+			"WANT_DIR":                  dir,
+		},
+		WorkDir: dir,
+	}
+
+	got, _ := RunCmd(context.Background(), opts, Endpoint{Host: "localhost", Port: 1234}, logger)
+	if got != 0 {
+		t.Errorf("RunCmd() = %v, want 0", got)
+	}
+
+	if _, ok := os.LookupEnv("PGPORT"); ok {
+		t.Error("RunCmd() changed the environment of the calling process")
+	}
+}
+
+func TestRunCmd_Restart(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	tests := []struct {
+		name       string
+		restart    string
+		exitCode   string
+		maxRetries int
+		wantRuns   int
+	}{
+		{name: "default_is_never", restart: "", exitCode: "1", maxRetries: 2, wantRuns: 1},
+		{name: "never", restart: config.RestartNever, exitCode: "1", maxRetries: 2, wantRuns: 1},
+		{name: "on_failure_success", restart: config.RestartOnFailure, exitCode: "0", maxRetries: 2, wantRuns: 1},
+		{name: "on_failure_failure", restart: config.RestartOnFailure, exitCode: "1", maxRetries: 2, wantRuns: 3},
+		{name: "always", restart: config.RestartAlways, exitCode: "0", maxRetries: 3, wantRuns: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			countFile := filepath.Join(t.TempDir(), "count")
+
+			opts := Options{
+				Args: []string{os.Args[0], "-test.run=TestHelperProcess", "--", "count-and-exit"},
+				Env: map[string]string{
+					"IAPGO_TEST_HELPER_PROCESS": "1",
+					"COUNT_FILE":                countFile,
+					"EXIT_CODE":                 tt.exitCode,
+				},
+				Restart:           tt.restart,
+				RestartMaxRetries: tt.maxRetries,
+				RestartBackoff:    time.Millisecond,
+			}
+
+			got, _ := RunCmd(context.Background(), opts, Endpoint{}, logger)
+			if want, _ := strconv.Atoi(tt.exitCode); got != want {
+				t.Errorf("RunCmd() = %v, want %v", got, want)
+			}
+
+			runs, err := os.ReadFile(countFile)
+			if err != nil {
+				t.Fatalf("failed to read count file: %v", err)
+			}
+
+			if len(runs) != tt.wantRuns {
+				t.Errorf("command ran %d times, want %d", len(runs), tt.wantRuns)
+			}
+		})
+	}
+}
+
+func TestRunCmd_RestartStopsWhenContextCancelled(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	opts := Options{
+		Args: []string{os.Args[0], "-test.run=TestHelperProcess", "--", "count-and-exit"},
+		Env: map[string]string{
+			"IAPGO_TEST_HELPER_PROCESS": "1",
+			"COUNT_FILE":                filepath.Join(t.TempDir(), "count"),
+			"EXIT_CODE":                 "1",
+		},
+		Restart:        config.RestartAlways,
+		RestartBackoff: time.Hour,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	if got, stopRequested := RunCmd(ctx, opts, Endpoint{}, logger); got != 1 || stopRequested {
+		t.Errorf("RunCmd() = %v, %v, want 1, false", got, stopRequested)
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("RunCmd() took %v after the context was cancelled", elapsed)
+	}
+}
@@ -0,0 +1,135 @@
+//go:build !windows
+
+package exec
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/config"
+)
+
+func TestRunCmd_ForwardsSignals(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	t.Setenv("IAPGO_TEST_HELPER_PROCESS", "1")
+
+	// Catch SIGTERM here too so that the test binary is not killed if the signal arrives before RunCmd
+	// has started forwarding.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM)
+
+	defer signal.Stop(sigCh)
+
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+
+		_ = syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+
+	args := []string{os.Args[0], "-test.run=TestHelperProcess", "--", "sleep"}
+
+	got, stopRequested := RunCmd(context.Background(), Options{Args: args, GracePeriod: time.Minute}, Endpoint{}, logger)
+	if want := ExitCodeSignalBase + int(syscall.SIGTERM); got != want || !stopRequested {
+		t.Errorf("RunCmd() = %v, %v, want %v, true", got, stopRequested, want)
+	}
+}
+
+func TestRunCmd_SignalStopsRestart(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM)
+
+	defer signal.Stop(sigCh)
+
+	opts := Options{
+		Args: []string{os.Args[0], "-test.run=TestHelperProcess", "--", "count-and-exit"},
+		Env: map[string]string{
+			"IAPGO_TEST_HELPER_PROCESS": "1",
+			"COUNT_FILE":                filepath.Join(t.TempDir(), "count"),
+			"EXIT_CODE":                 "1",
+		},
+		Restart:        config.RestartAlways,
+		RestartBackoff: time.Hour,
+	}
+
+	// The command exits straight away, so the signal normally arrives while RunCmd waits to restart it.
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+
+		_ = syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	}()
+
+	start := time.Now()
+
+	if got, stopRequested := RunCmd(context.Background(), opts, Endpoint{}, logger); got != 1 || !stopRequested {
+		t.Errorf("RunCmd() = %v, %v, want 1, true", got, stopRequested)
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("RunCmd() took %v after the signal", elapsed)
+	}
+}
+
+func TestForwardSignals_SharedTerminal(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+
+	defer signal.Stop(sigCh)
+
+	tests := []struct {
+		name              string
+		sig               syscall.Signal
+		wantStopRequested bool
+	}{
+		{
+			// Control-C is delivered to the command by the terminal, e.g., to cancel a psql query, so it
+			// must not stop iapgo once the command exits.
+			name:              "sigint",
+			sig:               syscall.SIGINT,
+			wantStopRequested: false,
+		},
+		{
+			name:              "sigterm",
+			sig:               syscall.SIGTERM,
+			wantStopRequested: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := exec.Command(os.Args[0], "-test.run=TestHelperProcess", "--", "sleep")
+			cmd.Env = append(os.Environ(), "IAPGO_TEST_HELPER_PROCESS=1")
+
+			if err := cmd.Start(); err != nil {
+				t.Fatalf("failed to start helper: %v", err)
+			}
+
+			defer func() {
+				_ = cmd.Process.Kill()
+				_ = cmd.Wait()
+			}()
+
+			stopForwarding := forwardSignals(cmd.Process, true, logger)
+
+			_ = syscall.Kill(os.Getpid(), tt.sig)
+
+			// Give the signal time to arrive before forwarding stops.
+			time.Sleep(200 * time.Millisecond)
+
+			if got := stopForwarding(); got != tt.wantStopRequested {
+				t.Errorf("stop requested = %v, want %v", got, tt.wantStopRequested)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+//go:build !windows
+
+package exec
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+var forwardedSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGWINCH}
+
+// terminalSignals are sent by the terminal to every process in its foreground process group.
+var terminalSignals = map[os.Signal]bool{
+	syscall.SIGINT:   true,
+	syscall.SIGWINCH: true,
+}
+
+// stopSignals are the forwarded signals that ask the command to exit, so it should not be restarted.
+var stopSignals = map[os.Signal]bool{
+	syscall.SIGINT:  true,
+	syscall.SIGTERM: true,
+}
+
+// prepareCmd sets up how the command is terminated and which process group it runs in, and reports whether
+// it shares our terminal.  An interactive command (e.g., psql) must stay in our process group so that it
+// can read from the terminal.  Otherwise it is given its own process group so that it only receives the
+// signals that we forward.
+func prepareCmd(cmd *exec.Cmd, interactive bool, logger *slog.Logger) bool {
+	cmd.Cancel = func() error {
+		logger.Info("tunnel stopped so sending SIGTERM to command", "gracePeriod", cmd.WaitDelay)
+
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+
+	if !interactive {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+
+	return interactive
+}
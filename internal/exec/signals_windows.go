@@ -0,0 +1,33 @@
+//go:build windows
+
+package exec
+
+import (
+	"log/slog"
+	"os"
+	"os/exec"
+)
+
+var forwardedSignals = []os.Signal{os.Interrupt}
+
+// Windows sends Control-C to every process attached to the console.
+var terminalSignals = map[os.Signal]bool{
+	os.Interrupt: true,
+}
+
+// stopSignals are the forwarded signals that ask the command to exit, so it should not be restarted.
+var stopSignals = map[os.Signal]bool{
+	os.Interrupt: true,
+}
+
+// prepareCmd sets up how the command is terminated.  Windows has no equivalent of SIGTERM so the command
+// is killed immediately.  The command always shares our console so this returns true.
+func prepareCmd(cmd *exec.Cmd, interactive bool, logger *slog.Logger) bool {
+	cmd.Cancel = func() error {
+		logger.Info("tunnel stopped so killing command")
+
+		return cmd.Process.Kill()
+	}
+
+	return true
+}
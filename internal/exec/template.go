@@ -0,0 +1,60 @@
+package exec
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+)
+
+// templateData is the value that {{...}} placeholders in exec arguments are evaluated against.  The fields of
+// Endpoint are promoted so that {{.Host}}, {{.Port}} and {{.Socket}} refer to the section's listener.
+type templateData struct {
+	Endpoint
+	Section  string
+	Instance string
+	// Forwards holds every forward by name.  A section currently has a single forward which is named after
+	// the section, so {{.Forwards.db.Port}} is the same as {{.Port}} in a section called db.  A name that is
+	// not a Go identifier, such as multi-hop, is not valid after a dot and needs index instead:
+	// {{(index .Forwards "multi-hop").Port}}.
+	Forwards map[string]Endpoint
+}
+
+// ExpandArgs evaluates Go template placeholders such as {{.Host}} and {{.Port}} in each argument.  This
+// means a command like psql can be given the listener details directly, without running it via a shell.
+// An argument without placeholders is returned unchanged.
+func ExpandArgs(opts Options, endpoint Endpoint) ([]string, error) {
+	data := templateData{
+		Endpoint: endpoint,
+		Section:  opts.Section,
+		Instance: opts.Instance,
+		Forwards: map[string]Endpoint{opts.Section: endpoint},
+	}
+
+	expanded := make([]string, len(opts.Args))
+
+	for i, arg := range opts.Args {
+		if !strings.Contains(arg, "{{") {
+			expanded[i] = arg
+
+			continue
+		}
+
+		tmpl, err := template.New(fmt.Sprintf("exec[%d]", i)).Option("missingkey=error").Parse(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", constants.ErrInvalidExecTemplate, err)
+		}
+
+		var sb strings.Builder
+
+		err = tmpl.Execute(&sb, data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", constants.ErrInvalidExecTemplate, err)
+		}
+
+		expanded[i] = sb.String()
+	}
+
+	return expanded, nil
+}
@@ -0,0 +1,83 @@
+package exec
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+)
+
+func TestExpandArgs(t *testing.T) {
+	endpoint := Endpoint{Host: "127.0.0.2", Port: 5432}
+
+	tests := []struct {
+		name    string
+		section string
+		args    []string
+		want    []string
+		wantErr error
+	}{
+		{
+			name: "no_placeholders",
+			args: []string{"bash", "-c", "echo $IAPGO_LISTEN_PORT {not a template}"},
+			want: []string{"bash", "-c", "echo $IAPGO_LISTEN_PORT {not a template}"},
+		},
+		{
+			name: "host_and_port",
+			args: []string{"psql", "-h", "{{.Host}}", "-p", "{{.Port}}", "postgres://{{.Host}}:{{.Port}}/db"},
+			want: []string{"psql", "-h", "127.0.0.2", "-p", "5432", "postgres://127.0.0.2:5432/db"},
+		},
+		{
+			name: "forwards",
+			args: []string{"{{.Forwards.db.Port}}", `{{(index .Forwards "db").Host}}`, "{{.Section}}/{{.Instance}}"},
+			want: []string{"5432", "127.0.0.2", "db/my-jumpbox"},
+		},
+		{
+			name:    "hyphenated_section",
+			section: "multi-hop",
+			args:    []string{`{{(index .Forwards "multi-hop").Port}}`, "{{.Section}}"},
+			want:    []string{"5432", "multi-hop"},
+		},
+		{
+			name:    "hyphenated_section_after_dot",
+			section: "multi-hop",
+			args:    []string{"{{.Forwards.multi-hop.Port}}"},
+			wantErr: constants.ErrInvalidExecTemplate,
+		},
+		{
+			name:    "unknown_forward",
+			args:    []string{"{{.Forwards.other.Port}}"},
+			wantErr: constants.ErrInvalidExecTemplate,
+		},
+		{
+			name:    "unknown_field",
+			args:    []string{"{{.Pot}}"},
+			wantErr: constants.ErrInvalidExecTemplate,
+		},
+		{
+			name:    "syntax_error",
+			args:    []string{"{{.Port"},
+			wantErr: constants.ErrInvalidExecTemplate,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			section := tt.section
+			if section == "" {
+				section = "db"
+			}
+
+			opts := Options{Args: tt.args, Section: section, Instance: "my-jumpbox"}
+
+			got, err := ExpandArgs(opts, endpoint)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ExpandArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ExpandArgs() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
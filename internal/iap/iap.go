@@ -7,10 +7,15 @@ import (
 	"net"
 	"time"
 
+	"github.com/LaoZhuBaba/iapgo/v2/internal/audit"
 	config "github.com/LaoZhuBaba/iapgo/v2/internal/config"
 	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/tracing"
 	"github.com/LaoZhuBaba/iapgo/v2/internal/util"
 	tunnel "github.com/davidspek/go-iap-tunnel/pkg"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type TunnelServer interface {
@@ -25,10 +30,28 @@ type IapTunnel struct {
 	tunnelMgr TunnelServer
 }
 
-func NewIapTunnel(cfg *config.Config, listener net.Listener, logger *slog.Logger) (*IapTunnel, error) {
-	if cfg == nil || logger == nil || listener == nil {
+// NewIapTunnel creates a tunnel that serves connections accepted by listener.  If SSH tunnelling is not used
+// then the listener's connections come from clients, so they are tracked by tunnelStats, recorded in auditLog
+// (which may be nil) and traced.
+func NewIapTunnel(
+	cfg *config.Config,
+	listener net.Listener,
+	tunnelStats *stats.Stats,
+	auditLog *audit.Log,
+	logger *slog.Logger,
+) (*IapTunnel, error) {
+	if cfg == nil || logger == nil || listener == nil || tunnelStats == nil {
 		return nil, constants.ErrNilParameter
 	}
+
+	// With SSH tunnelling the listener only carries the SSH session, and clients are tracked by the SSH
+	// listener instead.
+	if cfg.SshTunnel == nil {
+		listener = tracing.Listener(
+			auditLog.Listener(tunnelStats.Listener(keepAliveListener{Listener: listener})), "iapgo.connection",
+		)
+	}
+
 	target := tunnel.TunnelTarget{
 		Project:   cfg.ProjectID,
 		Zone:      cfg.Zone,
@@ -42,9 +65,30 @@ func NewIapTunnel(cfg *config.Config, listener net.Listener, logger *slog.Logger
 		target.Port = 22
 	}
 
-	logger.Debug("starting IAP Tunnel Manager", "remote port", target.Port)
+	var tunnelMgr TunnelServer
+
+	if cfg.IapPool != nil {
+		maxIdle := cfg.IapPool.MaxIdle
+		if maxIdle <= 0 {
+			maxIdle = config.DefaultIapPoolMaxIdle
+		}
+
+		logger.Debug("starting IAP connection pool", "remote port", target.Port, "size", cfg.IapPool.Size)
+
+		dial := countReconnects(newIapDialer(target, nil), tunnelStats, logger)
+		pool := NewPool(cfg.IapPool.Size, maxIdle, dial, logger)
+		tunnelMgr = newPoolServer(pool, tunnelStats, logger)
+	} else {
+		logger.Debug("starting IAP Tunnel Manager", "remote port", target.Port)
+
+		tunnelMgr = tunnel.NewTunnelManager(target, nil)
+
+		// The tunnel manager does not report client connections that it fails to connect through IAP.
+		if cfg.SshTunnel == nil {
+			listener = newConnectWatchListener(listener, iapConnectTimeout, tunnelStats, logger)
+		}
+	}
 
-	tunnelMgr := tunnel.NewTunnelManager(target, nil)
 	return &IapTunnel{
 		config:    cfg,
 		logger:    logger,
@@ -61,15 +105,28 @@ func (t *IapTunnel) Errors() <-chan error {
 	return t.tunnelMgr.Errors()
 }
 
-func (t *IapTunnel) Start(ctx context.Context) error {
+func (t *IapTunnel) Start(ctx context.Context) (err error) {
+	_, span := tracing.Tracer().Start(ctx, "iap.start", trace.WithAttributes(
+		attribute.String("iapgo.project", t.config.ProjectID),
+		attribute.String("iapgo.zone", t.config.Zone),
+		attribute.String("iapgo.instance", t.config.Instance),
+	))
+	defer span.End()
+	defer func() { _ = tracing.RecordError(span, err) }()
+
 	go t.startMgr(ctx)
 
-	iapLsnrPort, err := util.GetPortFromTcpAddr(t.listener, t.logger)
-	if err != nil {
-		return fmt.Errorf("failed to get port from IAP listener: %w", err)
-	}
+	// A Unix domain socket listener (local_socket) has no port to report.
+	if t.listener != nil && t.listener.Addr().Network() == "unix" {
+		t.logger.Debug("iapLsnr is listening on unix socket", "path", t.listener.Addr())
+	} else {
+		iapLsnrPort, err := util.GetPortFromTcpAddr(t.listener, t.logger)
+		if err != nil {
+			return fmt.Errorf("failed to get port from IAP listener: %w", err)
+		}
 
-	t.logger.Debug("iapLsnr is listening on TCP port", "port", iapLsnrPort)
+		t.logger.Debug("iapLsnr is listening on TCP port", "port", iapLsnrPort)
+	}
 
 	errCh := t.tunnelMgr.Errors()
 	readyCh := t.tunnelMgr.Ready()
@@ -11,6 +11,7 @@ import (
 
 	"github.com/LaoZhuBaba/iapgo/v2/internal/config"
 	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
 )
 
 type fakeTunnelServer struct {
@@ -196,3 +197,53 @@ func TestIapTunnel_Start(t *testing.T) {
 		})
 	}
 }
+
+func TestNewIapTunnel(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{}))
+
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen (listener): %v", err)
+	}
+
+	defer func() { _ = listener.Close() }()
+
+	tests := []struct {
+		name        string
+		config      *config.Config
+		tunnelStats *stats.Stats
+		wantErr     error
+		wantTracked bool
+	}{
+		{
+			name:        "tracks_client_connections",
+			config:      &config.Config{},
+			tunnelStats: stats.New("test"),
+			wantTracked: true,
+		},
+		{
+			name:        "ssh_tunnel_is_not_tracked",
+			config:      &config.Config{SshTunnel: &config.SshTunnelCfg{TunnelTo: "10.0.0.1"}},
+			tunnelStats: stats.New("test"),
+			wantTracked: false,
+		},
+		{
+			name:    "nil_stats",
+			config:  &config.Config{},
+			wantErr: constants.ErrNilParameter,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewIapTunnel(tt.config, listener, tt.tunnelStats, nil, logger)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("NewIapTunnel() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err == nil && (got.listener != listener) != tt.wantTracked {
+				t.Errorf("NewIapTunnel() listener tracked = %v, want %v", got.listener != listener, tt.wantTracked)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package iap
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/tracing"
+)
+
+// tcpKeepAlivePeriod matches the keepalive period that the IAP library's tunnel manager sets.
+const tcpKeepAlivePeriod = 30 * time.Second
+
+// keepAliveListener enables TCP keepalives on the connections that it accepts.  The IAP library's tunnel
+// manager only does this for a *net.TCPConn, so it has to be done before the connections are wrapped.
+type keepAliveListener struct {
+	net.Listener
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if tc, ok := conn.(*net.TCPConn); ok {
+		_ = tc.SetKeepAlive(true)
+		_ = tc.SetKeepAlivePeriod(tcpKeepAlivePeriod)
+	}
+
+	return conn, nil
+}
+
+// The states of a connectWatchConn.
+const (
+	connPending int32 = iota
+	connUsed
+	connFailed
+)
+
+// connectWatchListener wraps the listener that the IAP library's tunnel manager serves.  The tunnel manager
+// neither reports nor closes a local connection that it fails to connect through IAP, but it only reads
+// from or writes to a connection once its IAP connection is ready.  So a connection that has not been used
+// within timeout is counted as failed and closed rather than being left waiting forever.  A connection
+// that is connected after others have failed is counted as a reconnect.
+type connectWatchListener struct {
+	net.Listener
+	timeout time.Duration
+	stats   *stats.Stats
+	logger  *slog.Logger
+	// failing is set when a connection fails and cleared by the next one that is connected.
+	failing atomic.Bool
+}
+
+func newConnectWatchListener(
+	lsnr net.Listener,
+	timeout time.Duration,
+	tunnelStats *stats.Stats,
+	logger *slog.Logger,
+) *connectWatchListener {
+	return &connectWatchListener{
+		Listener: lsnr,
+		timeout:  timeout,
+		stats:    tunnelStats,
+		logger:   logger,
+	}
+}
+
+func (l *connectWatchListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &connectWatchConn{Conn: conn, lsnr: l}
+	c.timer = time.AfterFunc(l.timeout, func() { l.fail(c) })
+
+	return c, nil
+}
+
+// fail closes a connection that the tunnel manager has not started using, unless it has started in the
+// meantime.
+func (l *connectWatchListener) fail(c *connectWatchConn) {
+	if !c.state.CompareAndSwap(connPending, connFailed) {
+		return
+	}
+
+	err := fmt.Errorf("%w: not connected within %s", constants.ErrIapConnectFailed, l.timeout)
+
+	l.logger.Error("failed to connect through IAP", "peer", c.RemoteAddr(), "error", err)
+
+	stats.Connected(c.Conn, err)
+
+	if !stats.IsProbe(c.Conn) {
+		l.stats.AddFailed()
+		l.failing.Store(true)
+	}
+
+	if tc, ok := c.Conn.(*tracing.Conn); ok {
+		tc.Fail(err)
+	}
+
+	_ = c.Conn.Close()
+}
+
+// connected is called when c has been connected through IAP.  It counts a reconnect if c is the first
+// connection to be connected since one failed.
+func (l *connectWatchListener) connected(c *connectWatchConn) {
+	stats.Connected(c.Conn, nil)
+
+	if stats.IsProbe(c.Conn) || !l.failing.CompareAndSwap(true, false) {
+		return
+	}
+
+	l.logger.Info("connected through IAP again after failing", "peer", c.RemoteAddr())
+
+	l.stats.AddReconnect()
+}
+
+// connectWatchConn records whether the tunnel manager has started using a connection.
+type connectWatchConn struct {
+	net.Conn
+	lsnr  *connectWatchListener
+	state atomic.Int32
+	timer *time.Timer
+}
+
+func (c *connectWatchConn) Read(b []byte) (int, error) {
+	if c.markUsed() {
+		c.lsnr.connected(c)
+	}
+
+	return c.Conn.Read(b)
+}
+
+func (c *connectWatchConn) Write(b []byte) (int, error) {
+	if c.markUsed() {
+		c.lsnr.connected(c)
+	}
+
+	return c.Conn.Write(b)
+}
+
+// Close does not count the connection as failed if the tunnel manager closes it before using it, which only
+// happens when iapgo is stopping.
+func (c *connectWatchConn) Close() error {
+	c.markUsed()
+
+	return c.Conn.Close()
+}
+
+// markUsed reports whether this call is the one that marked the connection as used.
+func (c *connectWatchConn) markUsed() bool {
+	if !c.state.CompareAndSwap(connPending, connUsed) {
+		return false
+	}
+
+	c.timer.Stop()
+
+	return true
+}
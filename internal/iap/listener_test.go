@@ -0,0 +1,130 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/config"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/readiness"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+)
+
+func TestConnectWatchListener(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	tunnelStats := stats.New("test")
+	watchLsnr := newConnectWatchListener(tunnelStats.Listener(lsnr), 200*time.Millisecond, tunnelStats, logger)
+
+	defer func() { _ = watchLsnr.Close() }()
+
+	accept := func() (net.Conn, net.Conn) {
+		t.Helper()
+
+		client, err := net.Dial("tcp", lsnr.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+
+		conn, err := watchLsnr.Accept()
+		if err != nil {
+			t.Fatalf("Accept() error = %v", err)
+		}
+
+		return client, conn
+	}
+
+	// A connection that is used in time is left open.
+	usedClient, usedConn := accept()
+
+	defer func() { _ = usedClient.Close() }()
+
+	if _, err := usedConn.Write([]byte("x")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	// A connection that is not used in time is closed and counted as failed.
+	unusedClient, _ := accept()
+
+	defer func() { _ = unusedClient.Close() }()
+
+	_ = unusedClient.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := unusedClient.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("Read() error = %v, want %v", err, io.EOF)
+	}
+
+	waitFor(t, "unused connection to be closed", func() bool { return tunnelStats.ActiveCount() == 1 })
+
+	if snap := tunnelStats.Snapshot(); snap.FailedConnections != 1 || snap.Reconnects != 0 {
+		t.Errorf("stats = %+v, want 1 failed connection and no reconnects", snap)
+	}
+
+	if _, err := usedConn.Write([]byte("y")); err != nil {
+		t.Errorf("Write() to the used connection error = %v", err)
+	}
+
+	// The first connection to be used after one failed is counted as a reconnect, and later ones are not.
+	for range 2 {
+		client, conn := accept()
+
+		defer func() { _ = client.Close() }()
+
+		if _, err := conn.Write([]byte("x")); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	if snap := tunnelStats.Snapshot(); snap.Reconnects != 1 {
+		t.Errorf("stats = %+v, want 1 reconnect", snap)
+	}
+}
+
+func TestConnectWatchListener_TcpProbe(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	tunnelStats := stats.New("test")
+	watchLsnr := newConnectWatchListener(tunnelStats.Listener(lsnr), 200*time.Millisecond, tunnelStats, logger)
+
+	defer func() { _ = watchLsnr.Close() }()
+
+	// The remote side is unreachable, so like the IAP library's tunnel manager the connections are accepted
+	// but never used.
+	go func() {
+		for {
+			if _, err := watchLsnr.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cfg := &config.ReadinessCfg{Type: config.ProbeTcp}
+
+	err = readiness.Probe(ctx, cfg, "tcp", lsnr.Addr().String(), tunnelStats)
+	if !errors.Is(err, constants.ErrProbeNotConnected) {
+		t.Errorf("Probe() error = %v, want %v", err, constants.ErrProbeNotConnected)
+	}
+
+	if snap := tunnelStats.Snapshot(); snap.FailedConnections != 0 {
+		t.Errorf("stats = %+v, want the probe not to be counted as failed", snap)
+	}
+}
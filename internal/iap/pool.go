@@ -0,0 +1,295 @@
+package iap
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+)
+
+const (
+	// poolCheckInterval is how often the pool looks for connections that have been idle for too long.
+	poolCheckInterval = time.Second
+	// The delay before retrying after a failed dial starts at poolRetryBackoff and doubles up to
+	// poolMaxRetryBackoff.
+	poolRetryBackoff    = time.Second
+	poolMaxRetryBackoff = time.Minute
+	// poolReadBufferSize is the size of the read kept waiting on each idle connection.
+	poolReadBufferSize = 32 * 1024
+)
+
+// Dialer opens a new connection through IAP to the remote port.
+type Dialer func(ctx context.Context) (io.ReadWriteCloser, error)
+
+// countReconnects returns dial wrapped so that a successful dial after one or more failed dials is counted
+// as a reconnect.
+func countReconnects(dial Dialer, tunnelStats *stats.Stats, logger *slog.Logger) Dialer {
+	var failing atomic.Bool
+
+	return func(ctx context.Context) (io.ReadWriteCloser, error) {
+		conn, err := dial(ctx)
+		if err != nil {
+			// A dial that is abandoned because iapgo is stopping says nothing about IAP.
+			if ctx.Err() == nil {
+				failing.Store(true)
+			}
+
+			return nil, err
+		}
+
+		if failing.CompareAndSwap(true, false) {
+			logger.Info("connected through IAP again after failing")
+
+			tunnelStats.AddReconnect()
+		}
+
+		return conn, nil
+	}
+}
+
+// pooledConn is a connection in the pool.  While it is idle a read is kept waiting on it so that the pool
+// notices if it is closed, e.g., because the websocket was dropped.  Anything that the read returns is
+// passed on by Read once the connection has been handed out.
+type pooledConn struct {
+	io.ReadWriteCloser
+	created time.Time
+	buf     []byte
+	read    chan readResult
+	// result is the outcome of the idle read once it has finished, and pending is the part of its data
+	// that has not been passed on yet.
+	result  *readResult
+	pending []byte
+	started bool
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func newPooledConn(conn io.ReadWriteCloser) *pooledConn {
+	c := &pooledConn{
+		ReadWriteCloser: conn,
+		created:         time.Now(),
+		buf:             make([]byte, poolReadBufferSize),
+		read:            make(chan readResult, 1),
+	}
+
+	go func() {
+		n, err := conn.Read(c.buf)
+		c.read <- readResult{n: n, err: err}
+	}()
+
+	return c
+}
+
+// closed reports whether the idle read has failed without returning any data, which means that the
+// connection can no longer be used.
+func (c *pooledConn) closed() bool {
+	if c.result == nil {
+		select {
+		case r := <-c.read:
+			c.result = &r
+		default:
+			return false
+		}
+	}
+
+	return c.result.n == 0 && c.result.err != nil
+}
+
+// usable reports whether the connection is neither closed nor older than maxIdle.
+func (c *pooledConn) usable(maxIdle time.Duration) bool {
+	return time.Since(c.created) < maxIdle && !c.closed()
+}
+
+func (c *pooledConn) Read(p []byte) (int, error) {
+	if !c.started {
+		c.started = true
+
+		if c.result == nil {
+			r := <-c.read
+			c.result = &r
+		}
+
+		c.pending = c.buf[:c.result.n]
+	}
+
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+
+		return n, nil
+	}
+
+	if c.result.err != nil {
+		return 0, c.result.err
+	}
+
+	return c.ReadWriteCloser.Read(p)
+}
+
+// Pool keeps a number of IAP connections open and ready for new local connections.  Connections that are
+// not used within maxIdle, or that are closed while they are idle, are discarded and replaced.
+type Pool struct {
+	size    int
+	maxIdle time.Duration
+	dial    Dialer
+	logger  *slog.Logger
+
+	mu   sync.Mutex
+	idle []*pooledConn
+	// wake is signalled when a connection is taken so that Run replaces it straight away, unless Run is
+	// waiting to retry after a failed dial.
+	wake chan struct{}
+}
+
+func NewPool(size int, maxIdle time.Duration, dial Dialer, logger *slog.Logger) *Pool {
+	return &Pool{
+		size:    size,
+		maxIdle: maxIdle,
+		dial:    dial,
+		logger:  logger,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Run fills the pool and keeps it full until ctx is done, when the idle connections are closed.
+func (p *Pool) Run(ctx context.Context) {
+	defer p.closeIdle()
+
+	ticker := time.NewTicker(poolCheckInterval)
+	defer ticker.Stop()
+
+	backoff := poolRetryBackoff
+
+	for {
+		p.expire()
+
+		for p.idleCount() < p.size && ctx.Err() == nil {
+			conn, err := p.dial(ctx)
+			if err != nil {
+				p.logger.Warn("failed to open pooled IAP connection", "error", err, "retryIn", backoff)
+
+				break
+			}
+
+			backoff = poolRetryBackoff
+
+			p.put(conn)
+
+			p.logger.Debug("opened pooled IAP connection", "idle", p.idleCount())
+		}
+
+		wait := ticker.C
+		wake := p.wake
+
+		// If the pool is still not full then a dial failed, so wait before trying again.  Connections being
+		// taken must not cut the wait short, otherwise a busy tunnel would dial without any backoff.
+		var retry <-chan time.Time
+
+		if p.idleCount() < p.size {
+			retry = time.After(backoff)
+			backoff = min(2*backoff, poolMaxRetryBackoff)
+			wait = nil
+			wake = nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-wake:
+		case <-wait:
+		case <-retry:
+		}
+	}
+}
+
+// Get returns an idle connection from the pool if there is one, otherwise it dials a new one.  The second
+// result reports whether the connection came from the pool.
+func (p *Pool) Get(ctx context.Context) (io.ReadWriteCloser, bool, error) {
+	p.mu.Lock()
+
+	var pc *pooledConn
+
+	// The oldest connection is used first because it is the closest to being expired.
+	for len(p.idle) > 0 {
+		c := p.idle[0]
+		p.idle = p.idle[1:]
+
+		if c.usable(p.maxIdle) {
+			pc = c
+
+			break
+		}
+
+		_ = c.Close()
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+
+	if pc != nil {
+		return pc, true, nil
+	}
+
+	conn, err := p.dial(ctx)
+
+	return conn, false, err
+}
+
+// put adds a newly dialled connection to the pool.
+func (p *Pool) put(conn io.ReadWriteCloser) {
+	c := newPooledConn(conn)
+
+	p.mu.Lock()
+	p.idle = append(p.idle, c)
+	p.mu.Unlock()
+}
+
+func (p *Pool) idleCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.idle)
+}
+
+// expire discards the connections that have been idle for maxIdle or longer or that have been closed.
+func (p *Pool) expire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fresh := p.idle[:0]
+
+	for _, c := range p.idle {
+		if c.usable(p.maxIdle) {
+			fresh = append(fresh, c)
+
+			continue
+		}
+
+		p.logger.Debug("discarding pooled IAP connection that was closed or idle for too long")
+
+		_ = c.Close()
+	}
+
+	p.idle = fresh
+}
+
+func (p *Pool) closeIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, c := range p.idle {
+		_ = c.Close()
+	}
+
+	p.idle = nil
+}
@@ -0,0 +1,386 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+)
+
+// fakeDialer returns a Dialer whose connections are the client end of a pipe to an echo server, and a
+// counter of the connections it has made.
+func fakeDialer() (Dialer, *atomic.Int32) {
+	var dials atomic.Int32
+
+	return func(context.Context) (io.ReadWriteCloser, error) {
+		dials.Add(1)
+
+		client, server := net.Pipe()
+
+		go func() {
+			_, _ = io.Copy(server, server)
+			_ = server.Close()
+		}()
+
+		return client, nil
+	}, &dials
+}
+
+// waitFor polls cond until it is true or the test has waited too long.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPool(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	dial, dials := fakeDialer()
+	pool := NewPool(2, 500*time.Millisecond, dial, logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runDone := make(chan struct{})
+
+	go func() {
+		pool.Run(ctx)
+		close(runDone)
+	}()
+
+	waitFor(t, "pool to fill", func() bool { return pool.idleCount() == 2 })
+
+	conn, pooled, err := pool.Get(context.Background())
+	if err != nil || !pooled {
+		t.Fatalf("Get() = %v, %v, want a pooled connection", pooled, err)
+	}
+
+	_ = conn.Close()
+
+	// The connection that was taken is replaced straight away.
+	waitFor(t, "pool to refill", func() bool { return dials.Load() == 3 && pool.idleCount() == 2 })
+
+	// After max_idle the idle connections are replaced.
+	waitFor(t, "idle connections to be replaced", func() bool { return dials.Load() >= 5 })
+
+	cancel()
+	<-runDone
+
+	if got := pool.idleCount(); got != 0 {
+		t.Errorf("idle connections after Run() returned = %d, want 0", got)
+	}
+
+	// With nothing in the pool Get dials a new connection.
+	_, pooled, err = pool.Get(context.Background())
+	if err != nil || pooled {
+		t.Errorf("Get() on an empty pool = %v, %v, want a new connection", pooled, err)
+	}
+}
+
+func TestPoolServer(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	dial, _ := fakeDialer()
+	server := newPoolServer(NewPool(1, time.Minute, dial, logger), stats.New("test"), logger)
+
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	serveErr := make(chan error, 1)
+
+	go func() { serveErr <- server.Serve(context.Background(), lsnr) }()
+
+	select {
+	case <-server.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Ready() channel was not closed once Serve() started")
+	}
+
+	client, err := net.Dial("tcp", lsnr.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+
+	_, _ = client.Write([]byte("hello"))
+
+	buf := make([]byte, 5)
+
+	_, err = io.ReadFull(client, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Errorf("echo = %q, %v, want %q", buf, err, "hello")
+	}
+
+	_ = client.Close()
+	_ = lsnr.Close()
+
+	if err := <-serveErr; err != nil {
+		t.Errorf("Serve() error = %v", err)
+	}
+}
+
+func TestPoolServer_DialFailure(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	dialErr := errors.New("dial failed")
+	dial := func(context.Context) (io.ReadWriteCloser, error) { return nil, dialErr }
+
+	// An empty pool means that the connection is dialled when it is accepted.
+	tunnelStats := stats.New("test")
+	server := newPoolServer(NewPool(0, time.Minute, dial, logger), tunnelStats, logger)
+
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	defer func() { _ = lsnr.Close() }()
+
+	go func() { _ = server.Serve(context.Background(), tunnelStats.Listener(lsnr)) }()
+
+	client, err := net.Dial("tcp", lsnr.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+
+	defer func() { _ = client.Close() }()
+
+	// The local connection is closed rather than left waiting, so it is no longer active.
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("Read() error = %v, want %v", err, io.EOF)
+	}
+
+	waitFor(t, "connection to be closed", func() bool { return tunnelStats.ActiveCount() == 0 })
+
+	if snap := tunnelStats.Snapshot(); snap.FailedConnections != 1 {
+		t.Errorf("stats = %+v, want 1 failed connection", snap)
+	}
+
+	// A failure to connect only affects that connection so it does not stop the tunnel.
+	select {
+	case err := <-server.Errors():
+		t.Errorf("Errors() = %v, want no error", err)
+	default:
+	}
+}
+
+func TestPool_Get(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	tests := []struct {
+		name    string
+		maxIdle time.Duration
+		// idle is run with the server end of the pooled connection before Get is called.
+		idle       func(t *testing.T, pool *Pool, server net.Conn)
+		wantPooled bool
+		wantRead   string
+	}{
+		{
+			name:       "idle",
+			maxIdle:    time.Minute,
+			idle:       func(*testing.T, *Pool, net.Conn) {},
+			wantPooled: true,
+		},
+		{
+			name:    "sent_while_idle",
+			maxIdle: time.Minute,
+			idle: func(_ *testing.T, _ *Pool, server net.Conn) {
+				_, _ = server.Write([]byte("banner"))
+			},
+			wantPooled: true,
+			wantRead:   "banner",
+		},
+		{
+			name:    "closed",
+			maxIdle: time.Minute,
+			idle: func(t *testing.T, pool *Pool, server net.Conn) {
+				_ = server.Close()
+
+				waitFor(t, "idle read to fail", func() bool {
+					pool.mu.Lock()
+					defer pool.mu.Unlock()
+
+					return pool.idle[0].closed()
+				})
+			},
+		},
+		{
+			name:    "expired",
+			maxIdle: 50 * time.Millisecond,
+			idle: func(*testing.T, *Pool, net.Conn) {
+				time.Sleep(100 * time.Millisecond)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dial, dials := fakeDialer()
+			pool := NewPool(1, tt.maxIdle, dial, logger)
+
+			client, server := net.Pipe()
+			defer func() { _ = server.Close() }()
+
+			pool.put(client)
+			tt.idle(t, pool, server)
+
+			conn, pooled, err := pool.Get(context.Background())
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+
+			defer func() { _ = conn.Close() }()
+
+			if pooled != tt.wantPooled {
+				t.Errorf("Get() pooled = %v, want %v", pooled, tt.wantPooled)
+			}
+
+			if !tt.wantPooled && dials.Load() != 1 {
+				t.Errorf("dials = %d, want a new connection", dials.Load())
+			}
+
+			if tt.wantRead != "" {
+				buf := make([]byte, len(tt.wantRead))
+
+				_, err := io.ReadFull(conn, buf)
+				if err != nil || string(buf) != tt.wantRead {
+					t.Errorf("Read() = %q, %v, want %q", buf, err, tt.wantRead)
+				}
+			}
+
+			if !tt.wantPooled {
+				return
+			}
+
+			// The connection still works after the idle read has been passed on.
+			go func() {
+				buf := make([]byte, 5)
+				_, _ = io.ReadFull(server, buf)
+				_, _ = server.Write(buf)
+			}()
+
+			_, _ = conn.Write([]byte("hello"))
+
+			buf := make([]byte, 5)
+
+			_, err = io.ReadFull(conn, buf)
+			if err != nil || string(buf) != "hello" {
+				t.Errorf("echo = %q, %v, want %q", buf, err, "hello")
+			}
+		})
+	}
+}
+
+func TestPool_WakeDuringBackoff(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	var dials atomic.Int32
+
+	dial := func(context.Context) (io.ReadWriteCloser, error) {
+		dials.Add(1)
+
+		return nil, errors.New("dial failed")
+	}
+
+	pool := NewPool(1, time.Minute, dial, logger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go pool.Run(ctx)
+
+	waitFor(t, "first dial", func() bool { return dials.Load() == 1 })
+
+	// Each Get dials for itself, but must not make Run dial again before its backoff is over.
+	const gets = 10
+
+	for range gets {
+		if _, _, err := pool.Get(context.Background()); err == nil {
+			t.Fatal("Get() error = nil, want an error")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := dials.Load(); got != 1+gets {
+		t.Errorf("dials = %d, want %d", got, 1+gets)
+	}
+}
+
+func TestCountReconnects(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	tests := []struct {
+		name string
+		// fails holds whether each dial fails, in order.
+		fails          []bool
+		wantReconnects uint64
+	}{
+		{
+			name:           "no_failures",
+			fails:          []bool{false, false},
+			wantReconnects: 0,
+		},
+		{
+			name:           "still_failing",
+			fails:          []bool{false, true, true},
+			wantReconnects: 0,
+		},
+		{
+			name:           "recovered",
+			fails:          []bool{true, true, false, false},
+			wantReconnects: 1,
+		},
+		{
+			name:           "recovered_twice",
+			fails:          []bool{true, false, true, false},
+			wantReconnects: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			echo, _ := fakeDialer()
+			fails := tt.fails
+
+			dial := func(ctx context.Context) (io.ReadWriteCloser, error) {
+				fail := fails[0]
+				fails = fails[1:]
+
+				if fail {
+					return nil, errors.New("dial failed")
+				}
+
+				return echo(ctx)
+			}
+
+			tunnelStats := stats.New("test")
+			counted := countReconnects(dial, tunnelStats, logger)
+
+			for range tt.fails {
+				if conn, err := counted(context.Background()); err == nil {
+					_ = conn.Close()
+				}
+			}
+
+			if got := tunnelStats.Snapshot().Reconnects; got != tt.wantReconnects {
+				t.Errorf("reconnects = %d, want %d", got, tt.wantReconnects)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package iap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/tracing"
+	"github.com/coder/websocket"
+	tunnel "github.com/davidspek/go-iap-tunnel/pkg"
+	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	// iapConnectTimeout limits how long opening an IAP connection, including waiting for IAP to connect to
+	// the remote port, can take.
+	iapConnectTimeout = 30 * time.Second
+	// userinfoEmailScope is the OAuth scope that IAP tunnelling needs.
+	userinfoEmailScope = "https://www.googleapis.com/auth/userinfo.email"
+)
+
+// poolServer is used instead of the IAP library's tunnel manager when iap_pool is configured.  It serves
+// each local connection with a connection from the pool.
+type poolServer struct {
+	pool   *Pool
+	stats  *stats.Stats
+	errors chan error
+	// ready is closed once Serve has started accepting connections.
+	ready  chan struct{}
+	logger *slog.Logger
+}
+
+func newPoolServer(pool *Pool, tunnelStats *stats.Stats, logger *slog.Logger) *poolServer {
+	return &poolServer{
+		pool:   pool,
+		stats:  tunnelStats,
+		errors: make(chan error, 1),
+		ready:  make(chan struct{}),
+		logger: logger,
+	}
+}
+
+// Serve fills the pool and then accepts connections until lis is closed.  As with the IAP library's tunnel
+// manager, errors from the listener are reported on Errors and it keeps accepting.  A connection that
+// cannot be connected through IAP only affects that connection, so it is logged and counted but not
+// reported on Errors.
+func (s *poolServer) Serve(ctx context.Context, lis net.Listener) error {
+	go s.pool.Run(ctx)
+
+	close(s.ready)
+
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) || errors.Is(err, context.Canceled) {
+				return nil
+			}
+
+			select {
+			case s.errors <- fmt.Errorf("accept error: %w", err):
+			default:
+			}
+
+			continue
+		}
+
+		go s.handle(ctx, conn)
+	}
+}
+
+func (s *poolServer) handle(ctx context.Context, conn net.Conn) {
+	_, span := tracing.Tracer().Start(tracing.ConnContext(ctx, conn), "iap.connect")
+
+	upstream, pooled, err := s.pool.Get(ctx)
+	span.SetAttributes(attribute.Bool("iapgo.iap.pooled", pooled))
+	_ = tracing.RecordError(span, err)
+
+	span.End()
+
+	stats.Connected(conn, err)
+
+	if err != nil {
+		s.logger.Error("failed to connect through IAP", "error", err)
+
+		if !stats.IsProbe(conn) {
+			s.stats.AddFailed()
+		}
+
+		if tc, ok := conn.(*tracing.Conn); ok {
+			tc.Fail(err)
+		}
+
+		_ = conn.Close()
+
+		return
+	}
+
+	s.logger.Debug("serving connection", "peer", conn.RemoteAddr(), "pooled", pooled)
+
+	// Neither side can be half-closed, so when either direction finishes both connections are closed.
+	var once sync.Once
+
+	closeBoth := func() {
+		once.Do(func() {
+			_ = conn.Close()
+			_ = upstream.Close()
+		})
+	}
+
+	go func() {
+		_, _ = io.Copy(upstream, conn)
+
+		closeBoth()
+	}()
+
+	_, _ = io.Copy(conn, upstream)
+
+	closeBoth()
+}
+
+func (s *poolServer) Errors() <-chan error {
+	return s.errors
+}
+
+// Ready returns a channel that is closed once Serve has started.  The pool does not need to be full
+// because connections are made on demand until it is.
+func (s *poolServer) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// newIapDialer returns a Dialer that opens IAP connections to target.  If auth is nil then the application
+// default credentials are used, as the IAP library does.  The context passed to the Dialer is the one that
+// the tunnel runs with, so cancelling it stops any handshakes in progress and closes the connections.
+func newIapDialer(target tunnel.TunnelTarget, auth tunnel.TokenProvider) Dialer {
+	var mu sync.Mutex
+
+	return func(ctx context.Context) (io.ReadWriteCloser, error) {
+		mu.Lock()
+		if auth == nil {
+			src, err := google.DefaultTokenSource(ctx, userinfoEmailScope)
+			if err != nil {
+				mu.Unlock()
+
+				return nil, fmt.Errorf("%w: %w", constants.ErrIapConnectFailed, err)
+			}
+
+			auth = tunnel.NewOAuthTokenProvider(src)
+		}
+		mu.Unlock()
+
+		timeoutCtx, cancel := context.WithTimeout(ctx, iapConnectTimeout)
+		defer cancel()
+
+		u, err := tunnel.CreateWebSocketConnectURL(target, true)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", constants.ErrIapConnectFailed, err)
+		}
+
+		headers, err := auth.GetHeaders()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", constants.ErrIapConnectFailed, err)
+		}
+
+		wsConn, _, err := websocket.Dial(timeoutCtx, u, &websocket.DialOptions{
+			HTTPHeader:   headers,
+			Subprotocols: []string{tunnel.SUBPROTOCOL_NAME},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", constants.ErrIapConnectFailed, err)
+		}
+
+		// The adapter reads from the websocket for as long as the connection is in use, so it gets the
+		// long lived context rather than the dial timeout.
+		adapter := tunnel.NewTunnelAdapter(wsConn, target)
+		adapter.Start(ctx)
+
+		conn := &adapterConn{TunnelAdapter: adapter}
+
+		select {
+		case <-adapter.Ready():
+			return conn, nil
+		case <-timeoutCtx.Done():
+			_ = conn.Close()
+
+			return nil, fmt.Errorf("%w: %w", constants.ErrIapConnectFailed, timeoutCtx.Err())
+		}
+	}
+}
+
+// adapterConn makes it safe to close a TunnelAdapter more than once.
+type adapterConn struct {
+	*tunnel.TunnelAdapter
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (c *adapterConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.TunnelAdapter.Close()
+	})
+
+	return c.closeErr
+}
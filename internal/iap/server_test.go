@@ -0,0 +1,155 @@
+package iap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/coder/websocket"
+	tunnel "github.com/davidspek/go-iap-tunnel/pkg"
+	"golang.org/x/oauth2"
+)
+
+const testAccessToken = "test-token"
+
+// startFakeIap starts a websocket server that speaks enough of the IAP tunnel protocol to accept a
+// connection and echo the data sent over it.  If connect is false then it never reports that the connection
+// has succeeded.
+func startFakeIap(t *testing.T, connect bool) tunnel.TunnelTarget {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testAccessToken {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+
+		// The IAP library sends an Origin header that is not a URL, so it would fail the origin check.
+		wsConn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			Subprotocols:       []string{tunnel.SUBPROTOCOL_NAME},
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+
+		defer func() { _ = wsConn.CloseNow() }()
+
+		if connect {
+			frame := make([]byte, tunnel.SUBPROTOCOL_TAG_LEN+8)
+			binary.BigEndian.PutUint16(frame, tunnel.SUBPROTOCOL_TAG_CONNECT_SUCCESS_SID)
+			binary.BigEndian.PutUint64(frame[tunnel.SUBPROTOCOL_TAG_LEN:], 1)
+
+			if err := wsConn.Write(r.Context(), websocket.MessageBinary, frame); err != nil {
+				return
+			}
+		}
+
+		// Data frames are sent straight back.
+		for {
+			msgType, msg, err := wsConn.Read(r.Context())
+			if err != nil {
+				return
+			}
+
+			if binary.BigEndian.Uint16(msg) != tunnel.SUBPROTOCOL_TAG_DATA {
+				continue
+			}
+
+			if err := wsConn.Write(r.Context(), msgType, msg); err != nil {
+				return
+			}
+		}
+	}))
+
+	t.Cleanup(server.Close)
+
+	return tunnel.TunnelTarget{
+		Project:     "project",
+		Zone:        "zone",
+		Instance:    "instance",
+		Port:        22,
+		URLOverride: strings.Replace(server.URL, "http://", "ws://", 1),
+	}
+}
+
+func testTokenProvider(accessToken string) tunnel.TokenProvider {
+	return tunnel.NewOAuthTokenProvider(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: accessToken}))
+}
+
+func TestIapDialer(t *testing.T) {
+	target := startFakeIap(t, true)
+	dial := newIapDialer(target, testTokenProvider(testAccessToken))
+
+	conn, err := dial(context.Background())
+	if err != nil {
+		t.Fatalf("dial() error = %v", err)
+	}
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	buf := make([]byte, 5)
+
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Errorf("echo = %q, %v, want %q", buf, err, "hello")
+	}
+
+	// Closing the connection more than once is safe.
+	_ = conn.Close()
+
+	if err := conn.Close(); err != nil {
+		t.Errorf("second Close() error = %v", err)
+	}
+}
+
+func TestIapDialer_Failures(t *testing.T) {
+	tests := []struct {
+		name        string
+		connect     bool
+		accessToken string
+		timeout     time.Duration
+	}{
+		{
+			name:        "rejected",
+			connect:     true,
+			accessToken: "wrong-token",
+			timeout:     5 * time.Second,
+		},
+		{
+			name:        "never_connects",
+			connect:     false,
+			accessToken: testAccessToken,
+			timeout:     200 * time.Millisecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := startFakeIap(t, tt.connect)
+			dial := newIapDialer(target, testTokenProvider(tt.accessToken))
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+
+			conn, err := dial(ctx)
+			if !errors.Is(err, constants.ErrIapConnectFailed) {
+				t.Errorf("dial() error = %v, want %v", err, constants.ErrIapConnectFailed)
+			}
+
+			if conn != nil {
+				t.Errorf("dial() conn = %v, want nil", conn)
+			}
+		})
+	}
+}
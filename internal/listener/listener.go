@@ -0,0 +1,244 @@
+package listener
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/config"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+)
+
+// Listen creates the local listener that clients of the tunnel connect to.  This is a Unix domain socket
+// if local_socket is configured, otherwise it is a TCP port on local_address (localhost by default).  If
+// allowed_uids or allowed_users are configured then connections from other users are rejected by the
+// listener's Accept method.
+func Listen(cfg *config.Config, logger *slog.Logger) (net.Listener, error) {
+	if cfg == nil || logger == nil {
+		return nil, constants.ErrNilParameter
+	}
+
+	var (
+		lsnr net.Listener
+		err  error
+	)
+
+	if cfg.LocalSocket != nil {
+		lsnr, err = ListenUnix(cfg.LocalSocket, logger)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		lsnr, err = net.Listen("tcp", net.JoinHostPort(cfg.BindAddress(), strconv.Itoa(cfg.LocalPort)))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", constants.ErrFailedToListen, err)
+		}
+	}
+
+	filtered, err := newPeerFilterListener(cfg, lsnr, logger)
+	if err != nil {
+		_ = lsnr.Close()
+
+		return nil, err
+	}
+
+	return filtered, nil
+}
+
+// ListenLoopback creates the listener on an ephemeral loopback port that iapgo's own SSH client connects to
+// when SSH tunnelling is used.  If allowed_uids or allowed_users are configured then only connections from
+// iapgo's own user are accepted, so that other local users cannot use it to reach the jump box directly.
+func ListenLoopback(cfg *config.Config, logger *slog.Logger) (net.Listener, error) {
+	if cfg == nil || logger == nil {
+		return nil, constants.ErrNilParameter
+	}
+
+	lsnr, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", constants.ErrFailedToListen, err)
+	}
+
+	if len(cfg.AllowedUids) == 0 && len(cfg.AllowedUsers) == 0 {
+		return lsnr, nil
+	}
+
+	filtered, err := newOwnUidListener(lsnr, logger)
+	if err != nil {
+		_ = lsnr.Close()
+
+		return nil, err
+	}
+
+	return filtered, nil
+}
+
+// ListenUnix creates a Unix domain socket listener and applies the configured file mode and ownership.
+// A stale socket file left behind by a previous run is removed, but a socket that is still accepting
+// connections is not.
+//
+// The socket is created in a private directory and only moved to its path once its permissions have been
+// set, so nobody else can connect to it while it still has the permissions given by the umask.
+func ListenUnix(sockCfg *config.LocalSocketCfg, logger *slog.Logger) (net.Listener, error) {
+	mode, err := sockCfg.FileMode()
+	if err != nil {
+		return nil, err
+	}
+
+	err = removeStaleSocket(sockCfg.Path, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	// MkdirTemp creates the directory with mode 0700.  It is next to the socket's path so that the socket
+	// can be renamed rather than copied.
+	tmpDir, err := os.MkdirTemp(filepath.Dir(sockCfg.Path), ".iapgo-")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", constants.ErrFailedToListen, err)
+	}
+
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	tmpPath := filepath.Join(tmpDir, "sock")
+
+	lsnr, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmpPath, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", constants.ErrFailedToListen, err)
+	}
+
+	// The socket file is moved, so unixListener removes it from its final path instead.
+	lsnr.SetUnlinkOnClose(false)
+
+	err = setSocketPerms(tmpPath, mode, sockCfg)
+	if err != nil {
+		_ = lsnr.Close()
+
+		return nil, fmt.Errorf("%w: %w", constants.ErrFailedToSetSocketPerms, err)
+	}
+
+	err = os.Rename(tmpPath, sockCfg.Path)
+	if err != nil {
+		_ = lsnr.Close()
+
+		return nil, fmt.Errorf("%w: %w", constants.ErrFailedToListen, err)
+	}
+
+	logger.Debug("listening on unix socket", "path", sockCfg.Path, "mode", mode)
+
+	return &unixListener{UnixListener: lsnr, path: sockCfg.Path}, nil
+}
+
+// setSocketPerms applies the configured file mode and ownership to the socket file at path.
+func setSocketPerms(path string, mode os.FileMode, sockCfg *config.LocalSocketCfg) error {
+	err := os.Chmod(path, mode)
+	if err != nil {
+		return err
+	}
+
+	if sockCfg.Owner == "" && sockCfg.Group == "" {
+		return nil
+	}
+
+	uid, gid, err := lookupOwner(sockCfg.Owner, sockCfg.Group)
+	if err != nil {
+		return err
+	}
+
+	return os.Chown(path, uid, gid)
+}
+
+// unixListener is a Unix domain socket listener whose socket file was moved after it was created.  It
+// reports the final path as its address and removes the socket file from there when it is closed.
+type unixListener struct {
+	*net.UnixListener
+	path      string
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.closeErr = l.UnixListener.Close()
+		_ = os.Remove(l.path)
+	})
+
+	return l.closeErr
+}
+
+func removeStaleSocket(path string, logger *slog.Logger) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: %w", constants.ErrFailedToListen, err)
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%w: %s exists and is not a socket", constants.ErrFailedToListen, path)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		_ = conn.Close()
+
+		return fmt.Errorf("%w: %s is already in use", constants.ErrFailedToListen, path)
+	}
+
+	logger.Debug("removing stale unix socket", "path", path)
+
+	err = os.Remove(path)
+	if err != nil {
+		return fmt.Errorf("%w: %w", constants.ErrFailedToListen, err)
+	}
+
+	return nil
+}
+
+// lookupOwner converts user and group names (or numeric IDs) to the values needed by os.Chown.  An empty
+// name is returned as -1 which tells os.Chown to leave that value unchanged.
+func lookupOwner(owner string, group string) (int, int, error) {
+	uid, gid := -1, -1
+
+	if owner != "" {
+		u, err := user.Lookup(owner)
+		if err != nil {
+			u, err = user.LookupId(owner)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+
+		uid, err = strconv.Atoi(u.Uid)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			g, err = user.LookupGroupId(group)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return uid, gid, nil
+}
@@ -0,0 +1,184 @@
+package listener
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/config"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+)
+
+func TestListenUnix(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	dir := t.TempDir()
+
+	// A regular file must never be removed to make way for the socket.
+	regularFile := filepath.Join(dir, "regular")
+	if err := os.WriteFile(regularFile, nil, 0o600); err != nil {
+		t.Fatalf("failed to create regular file: %v", err)
+	}
+
+	// A socket that is still accepting connections must not be removed either.
+	inUse := filepath.Join(dir, "in-use.sock")
+
+	inUseLsnr, err := net.Listen("unix", inUse)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	defer func() { _ = inUseLsnr.Close() }()
+
+	// A socket file with nothing listening is stale and should be replaced.
+	stale := filepath.Join(dir, "stale.sock")
+
+	staleLsnr, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	staleLsnr.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = staleLsnr.Close()
+
+	tests := []struct {
+		name     string
+		sockCfg  *config.LocalSocketCfg
+		wantMode os.FileMode
+		wantErr  error
+	}{
+		{
+			name:     "default_mode",
+			sockCfg:  &config.LocalSocketCfg{Path: filepath.Join(dir, "default.sock")},
+			wantMode: config.DefaultLocalSocketMode,
+		},
+		{
+			name:     "explicit_mode",
+			sockCfg:  &config.LocalSocketCfg{Path: filepath.Join(dir, "explicit.sock"), Mode: "0660"},
+			wantMode: 0o660,
+		},
+		{
+			name:     "stale_socket",
+			sockCfg:  &config.LocalSocketCfg{Path: stale},
+			wantMode: config.DefaultLocalSocketMode,
+		},
+		{
+			name:    "socket_in_use",
+			sockCfg: &config.LocalSocketCfg{Path: inUse},
+			wantErr: constants.ErrFailedToListen,
+		},
+		{
+			name:    "not_a_socket",
+			sockCfg: &config.LocalSocketCfg{Path: regularFile},
+			wantErr: constants.ErrFailedToListen,
+		},
+		{
+			name:    "invalid_mode",
+			sockCfg: &config.LocalSocketCfg{Path: filepath.Join(dir, "invalid.sock"), Mode: "rw-------"},
+			wantErr: constants.ErrInvalidLocalSocketMode,
+		},
+		{
+			name:    "unknown_owner",
+			sockCfg: &config.LocalSocketCfg{Path: filepath.Join(dir, "owner.sock"), Owner: "no-such-user-iapgo"},
+			wantErr: constants.ErrFailedToSetSocketPerms,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lsnr, err := ListenUnix(tt.sockCfg, logger)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ListenUnix() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			defer func() { _ = lsnr.Close() }()
+
+			fi, err := os.Stat(tt.sockCfg.Path)
+			if err != nil {
+				t.Fatalf("failed to stat socket: %v", err)
+			}
+
+			if fi.Mode().Perm() != tt.wantMode {
+				t.Errorf("socket mode = %o, want %o", fi.Mode().Perm(), tt.wantMode)
+			}
+
+			if got := lsnr.Addr().String(); got != tt.sockCfg.Path {
+				t.Errorf("Addr() = %s, want %s", got, tt.sockCfg.Path)
+			}
+
+			conn, err := net.Dial("unix", tt.sockCfg.Path)
+			if err != nil {
+				t.Fatalf("failed to dial socket: %v", err)
+			}
+
+			_ = conn.Close()
+
+			// Closing the listener removes the socket file from its final path.
+			_ = lsnr.Close()
+
+			if _, err := os.Lstat(tt.sockCfg.Path); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("socket file after Close() error = %v, want %v", err, os.ErrNotExist)
+			}
+		})
+	}
+
+	// The private directories that the sockets were created in have all been removed.
+	tmpDirs, err := filepath.Glob(filepath.Join(dir, ".iapgo-*"))
+	if err != nil || len(tmpDirs) != 0 {
+		t.Errorf("temporary directories = %v, %v, want none", tmpDirs, err)
+	}
+}
+
+func TestListen(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	lsnr, err := Listen(&config.Config{}, logger)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	defer func() { _ = lsnr.Close() }()
+
+	if _, ok := lsnr.Addr().(*net.TCPAddr); !ok {
+		t.Errorf("Listen() addr = %v, want a TCP address", lsnr.Addr())
+	}
+
+	lsnr, err = Listen(&config.Config{LocalAddress: "127.0.0.1"}, logger)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	if addr, ok := lsnr.Addr().(*net.TCPAddr); !ok || !addr.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("Listen() addr = %v, want 127.0.0.1", lsnr.Addr())
+	}
+
+	_ = lsnr.Close()
+
+	socketPath := filepath.Join(t.TempDir(), "iapgo.sock")
+
+	lsnr, err = Listen(&config.Config{LocalSocket: &config.LocalSocketCfg{Path: socketPath}}, logger)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+
+	if _, ok := lsnr.Addr().(*net.UnixAddr); !ok {
+		t.Errorf("Listen() addr = %v, want a unix address", lsnr.Addr())
+	}
+
+	_ = lsnr.Close()
+
+	// The socket file should be removed when the listener is closed.
+	if _, err := os.Stat(socketPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("socket file still exists after Close(), err = %v", err)
+	}
+
+	if _, err := Listen(nil, logger); !errors.Is(err, constants.ErrNilParameter) {
+		t.Errorf("Listen(nil) error = %v, want %v", err, constants.ErrNilParameter)
+	}
+}
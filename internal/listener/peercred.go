@@ -0,0 +1,108 @@
+package listener
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/config"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+)
+
+// peerFilterListener wraps a listener so that Accept only returns connections from processes owned by one
+// of the allowed UIDs.  Other connections are logged and closed, and Accept waits for the next one.
+type peerFilterListener struct {
+	net.Listener
+	allowed map[uint32]bool
+	logger  *slog.Logger
+}
+
+// newPeerFilterListener returns lsnr unchanged unless allowed_uids or allowed_users are configured.
+func newPeerFilterListener(cfg *config.Config, lsnr net.Listener, logger *slog.Logger) (net.Listener, error) {
+	if len(cfg.AllowedUids) == 0 && len(cfg.AllowedUsers) == 0 {
+		return lsnr, nil
+	}
+
+	if !peerCredSupported {
+		return nil, constants.ErrPeerCredUnsupported
+	}
+
+	allowed := make(map[uint32]bool)
+
+	for _, uid := range cfg.AllowedUids {
+		allowed[uint32(uid)] = true
+	}
+
+	for _, name := range cfg.AllowedUsers {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", constants.ErrUnknownAllowedUser, name, err)
+		}
+
+		uid, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", constants.ErrUnknownAllowedUser, name, err)
+		}
+
+		allowed[uint32(uid)] = true
+	}
+
+	logger.Debug("restricting local listener to allowed UIDs", "allowed", allowed)
+
+	return &peerFilterListener{
+		Listener: lsnr,
+		allowed:  allowed,
+		logger:   logger,
+	}, nil
+}
+
+// newOwnUidListener returns lsnr wrapped so that only connections from processes owned by iapgo's own user
+// are accepted.
+func newOwnUidListener(lsnr net.Listener, logger *slog.Logger) (net.Listener, error) {
+	if !peerCredSupported {
+		return nil, constants.ErrPeerCredUnsupported
+	}
+
+	uid := uint32(os.Getuid())
+
+	logger.Debug("restricting internal listener to our own UID", "uid", uid)
+
+	return &peerFilterListener{
+		Listener: lsnr,
+		allowed:  map[uint32]bool{uid: true},
+		logger:   logger,
+	}, nil
+}
+
+func (l *peerFilterListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		uid, err := peerUid(conn)
+		if err != nil {
+			l.logger.Error("rejected connection because the peer UID is unknown", "peer", conn.RemoteAddr(), "error", err)
+
+			_ = conn.Close()
+
+			continue
+		}
+
+		if !l.allowed[uid] {
+			l.logger.Error("rejected connection from a user that is not allowed", "peer", conn.RemoteAddr(), "uid", uid)
+
+			_ = conn.Close()
+
+			continue
+		}
+
+		l.logger.Debug("accepted connection from allowed user", "peer", conn.RemoteAddr(), "uid", uid)
+
+		return conn, nil
+	}
+}
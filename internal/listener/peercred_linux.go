@@ -0,0 +1,176 @@
+//go:build linux
+
+package listener
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+)
+
+const peerCredSupported = true
+
+var procNetTcpFiles = []string{"/proc/net/tcp", "/proc/net/tcp6"}
+
+// peerUid returns the UID of the process at the other end of an accepted connection.  Unix domain sockets
+// use SO_PEERCRED.  For TCP the client's socket is found in /proc/net/tcp (or tcp6) by matching its local
+// and remote addresses against our connection, and the owner UID of that socket inode is returned.  This
+// only works for loopback connections because the client socket must be in the same network namespace.
+func peerUid(conn net.Conn) (uint32, error) {
+	switch c := conn.(type) {
+	case *net.UnixConn:
+		return unixPeerUid(c)
+	case *net.TCPConn:
+		return tcpPeerUid(c)
+	default:
+		return 0, fmt.Errorf("%w: unsupported connection type %T", constants.ErrPeerUidNotFound, conn)
+	}
+}
+
+func unixPeerUid(conn *net.UnixConn) (uint32, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", constants.ErrPeerUidNotFound, err)
+	}
+
+	var (
+		cred    *syscall.Ucred
+		credErr error
+	)
+
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err == nil {
+		err = credErr
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", constants.ErrPeerUidNotFound, err)
+	}
+
+	return cred.Uid, nil
+}
+
+func tcpPeerUid(conn *net.TCPConn) (uint32, error) {
+	peer, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !peer.IP.IsLoopback() {
+		return 0, fmt.Errorf("%w: %s is not a loopback address", constants.ErrPeerUidNotFound, conn.RemoteAddr())
+	}
+
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return 0, fmt.Errorf("%w: %s is not a TCP address", constants.ErrPeerUidNotFound, conn.LocalAddr())
+	}
+
+	for _, fileName := range procNetTcpFiles {
+		uid, err := findTcpSocketUid(fileName, peer, local)
+		if err == nil {
+			return uid, nil
+		}
+
+		if !errors.Is(err, constants.ErrPeerUidNotFound) {
+			return 0, err
+		}
+	}
+
+	return 0, fmt.Errorf("%w: no socket found for %s", constants.ErrPeerUidNotFound, peer)
+}
+
+func findTcpSocketUid(fileName string, localAddr *net.TCPAddr, remoteAddr *net.TCPAddr) (uint32, error) {
+	f, err := os.Open(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		// tcp6 does not exist if IPv6 is disabled.
+		return 0, constants.ErrPeerUidNotFound
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", constants.ErrPeerUidNotFound, err)
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return parseProcNetTcp(f, localAddr, remoteAddr)
+}
+
+// parseProcNetTcp scans the /proc/net/tcp format for the socket with the given local and remote addresses
+// and returns the value of its uid column.
+func parseProcNetTcp(r io.Reader, localAddr *net.TCPAddr, remoteAddr *net.TCPAddr) (uint32, error) {
+	scanner := bufio.NewScanner(r)
+
+	// Skip the header line.
+	scanner.Scan()
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 {
+			continue
+		}
+
+		local, err := parseProcNetAddr(fields[1])
+		if err != nil || !tcpAddrEqual(local, localAddr) {
+			continue
+		}
+
+		remote, err := parseProcNetAddr(fields[2])
+		if err != nil || !tcpAddrEqual(remote, remoteAddr) {
+			continue
+		}
+
+		uid, err := strconv.ParseUint(fields[7], 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %w", constants.ErrPeerUidNotFound, err)
+		}
+
+		return uint32(uid), nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("%w: %w", constants.ErrPeerUidNotFound, err)
+	}
+
+	return 0, constants.ErrPeerUidNotFound
+}
+
+// parseProcNetAddr parses an address such as "0100007F:1F90".  The IP address is written as a sequence of
+// 32-bit words in host byte order and the port is written as a big-endian number.
+func parseProcNetAddr(s string) (*net.TCPAddr, error) {
+	ipHex, portHex, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+
+	raw, err := hex.DecodeString(ipHex)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		binary.BigEndian.PutUint32(ip[i:], binary.NativeEndian.Uint32(raw[i:]))
+	}
+
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q", s)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// tcpAddrEqual compares addresses so that an IPv4 address matches its IPv4-mapped IPv6 form.
+func tcpAddrEqual(a *net.TCPAddr, b *net.TCPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
@@ -0,0 +1,236 @@
+//go:build linux
+
+package listener
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/config"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+)
+
+const testProcNetTcp = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 1111 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:D431 0100007F:1F90 01 00000000:00000000 00:00000000 00000000  1001        0 2222 1 0000000000000000 20 4 30 10 -1
+   2: 0100007F:1F90 0100007F:D431 01 00000000:00000000 00:00000000 00000000  1000        0 3333 1 0000000000000000 20 4 30 10 -1
+`
+
+func TestParseProcNetTcp(t *testing.T) {
+	localhost := net.ParseIP("127.0.0.1")
+
+	tests := []struct {
+		name       string
+		localAddr  *net.TCPAddr
+		remoteAddr *net.TCPAddr
+		want       uint32
+		wantErr    error
+	}{
+		{
+			name:       "client_socket",
+			localAddr:  &net.TCPAddr{IP: localhost, Port: 0xD431},
+			remoteAddr: &net.TCPAddr{IP: localhost, Port: 0x1F90},
+			want:       1001,
+		},
+		{
+			name:       "server_socket",
+			localAddr:  &net.TCPAddr{IP: localhost, Port: 0x1F90},
+			remoteAddr: &net.TCPAddr{IP: localhost, Port: 0xD431},
+			want:       1000,
+		},
+		{
+			name:       "ipv4_mapped",
+			localAddr:  &net.TCPAddr{IP: net.ParseIP("::ffff:127.0.0.1"), Port: 0xD431},
+			remoteAddr: &net.TCPAddr{IP: localhost, Port: 0x1F90},
+			want:       1001,
+		},
+		{
+			name:       "not_found",
+			localAddr:  &net.TCPAddr{IP: localhost, Port: 1},
+			remoteAddr: &net.TCPAddr{IP: localhost, Port: 0x1F90},
+			wantErr:    constants.ErrPeerUidNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseProcNetTcp(strings.NewReader(testProcNetTcp), tt.localAddr, tt.remoteAddr)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("parseProcNetTcp() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("parseProcNetTcp() got = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseProcNetAddr_IPv6(t *testing.T) {
+	// This is ::1 port 8080 as written by a little-endian kernel.
+	got, err := parseProcNetAddr("00000000000000000000000001000000:1F90")
+	if err != nil {
+		t.Fatalf("parseProcNetAddr() error = %v", err)
+	}
+
+	if !got.IP.Equal(net.IPv6loopback) || got.Port != 8080 {
+		t.Errorf("parseProcNetAddr() got = %v, want [::1]:8080", got)
+	}
+}
+
+func TestPeerFilterListener(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	myUid := os.Getuid()
+
+	tests := []struct {
+		name        string
+		cfg         *config.Config
+		wantAllowed bool
+	}{
+		{
+			name:        "tcp_allowed",
+			cfg:         &config.Config{AllowedUids: []int{myUid}},
+			wantAllowed: true,
+		},
+		{
+			name:        "tcp_rejected",
+			cfg:         &config.Config{AllowedUids: []int{myUid + 1}},
+			wantAllowed: false,
+		},
+		{
+			name: "unix_allowed",
+			cfg: &config.Config{
+				AllowedUids: []int{myUid},
+				LocalSocket: &config.LocalSocketCfg{Path: filepath.Join(t.TempDir(), "allowed.sock")},
+			},
+			wantAllowed: true,
+		},
+		{
+			name: "unix_rejected",
+			cfg: &config.Config{
+				AllowedUids: []int{myUid + 1},
+				LocalSocket: &config.LocalSocketCfg{Path: filepath.Join(t.TempDir(), "rejected.sock")},
+			},
+			wantAllowed: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lsnr, err := Listen(tt.cfg, logger)
+			if err != nil {
+				t.Fatalf("Listen() error = %v", err)
+			}
+
+			defer func() { _ = lsnr.Close() }()
+
+			accepted := make(chan net.Conn, 1)
+
+			go func() {
+				conn, err := lsnr.Accept()
+				if err == nil {
+					accepted <- conn
+				}
+			}()
+
+			conn, err := net.Dial(lsnr.Addr().Network(), lsnr.Addr().String())
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+
+			defer func() { _ = conn.Close() }()
+
+			if tt.wantAllowed {
+				select {
+				case serverConn := <-accepted:
+					_ = serverConn.Close()
+				case <-time.After(5 * time.Second):
+					t.Fatal("connection was not accepted")
+				}
+
+				return
+			}
+
+			// A rejected connection is closed by the listener so the client sees EOF.
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+			if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+				t.Errorf("Read() error = %v, want %v", err, io.EOF)
+			}
+
+			select {
+			case <-accepted:
+				t.Error("rejected connection was returned by Accept()")
+			default:
+			}
+		})
+	}
+}
+
+func TestListenLoopback(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	// Our own user is not in allowed_uids, but the loopback listener is only for iapgo's SSH client so it
+	// accepts our connections and nobody else's.
+	lsnr, err := ListenLoopback(&config.Config{AllowedUids: []int{os.Getuid() + 1}}, logger)
+	if err != nil {
+		t.Fatalf("ListenLoopback() error = %v", err)
+	}
+
+	defer func() { _ = lsnr.Close() }()
+
+	filter, ok := lsnr.(*peerFilterListener)
+	if !ok || len(filter.allowed) != 1 || !filter.allowed[uint32(os.Getuid())] {
+		t.Fatalf("ListenLoopback() = %#v, want a listener that only allows UID %d", lsnr, os.Getuid())
+	}
+
+	accepted := make(chan net.Conn, 1)
+
+	go func() {
+		conn, err := lsnr.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	conn, err := net.Dial("tcp", lsnr.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	select {
+	case serverConn := <-accepted:
+		_ = serverConn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not accepted")
+	}
+
+	// Without allowed_uids or allowed_users the listener is not filtered.
+	plain, err := ListenLoopback(&config.Config{}, logger)
+	if err != nil {
+		t.Fatalf("ListenLoopback() error = %v", err)
+	}
+
+	defer func() { _ = plain.Close() }()
+
+	if _, ok := plain.(*peerFilterListener); ok {
+		t.Error("ListenLoopback() filtered connections without allowed_uids or allowed_users")
+	}
+}
+
+func TestListen_UnknownAllowedUser(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	_, err := Listen(&config.Config{AllowedUsers: []string{"no-such-user-iapgo"}}, logger)
+	if !errors.Is(err, constants.ErrUnknownAllowedUser) {
+		t.Errorf("Listen() error = %v, want %v", err, constants.ErrUnknownAllowedUser)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package listener
+
+import (
+	"net"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+)
+
+const peerCredSupported = false
+
+func peerUid(conn net.Conn) (uint32, error) {
+	return 0, constants.ErrPeerCredUnsupported
+}
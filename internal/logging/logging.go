@@ -0,0 +1,181 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+)
+
+const (
+	FormatText = "text"
+	FormatJson = "json"
+)
+
+// Components that can be given their own level with Options.Levels.
+const (
+	ComponentConfig = "config"
+	ComponentIap    = "iap"
+	ComponentSsh    = "ssh"
+	ComponentExec   = "exec"
+)
+
+// componentKey is the attribute that identifies which part of iapgo a message came from.
+const componentKey = "component"
+
+const (
+	DefaultMaxFileSize = 10 * 1024 * 1024
+	DefaultMaxBackups  = 3
+)
+
+type Options struct {
+	// Format is either FormatText (the default) or FormatJson.
+	Format string
+	// File is the path of the log file.  If it is empty then messages are written to stderr.
+	File string
+	// MaxFileSize is the size in bytes at which the log file is rotated.  Zero means DefaultMaxFileSize.
+	MaxFileSize int64
+	// MaxBackups is the number of rotated log files to keep.  Zero means DefaultMaxBackups.
+	MaxBackups int
+	// Verbose sets the default level to debug.
+	Verbose bool
+	// Levels is a comma separated list of levels.  An entry such as "ssh=debug" sets the level of one
+	// component and an entry without a component, such as "warn", sets the default level.
+	Levels string
+}
+
+// New creates the logger described by opts.  The returned io.Closer closes the log file, if there is one,
+// and must be called before iapgo exits.
+func New(opts Options) (*slog.Logger, io.Closer, error) {
+	defaultLevel := slog.LevelInfo
+	if opts.Verbose {
+		defaultLevel = slog.LevelDebug
+	}
+
+	defaultLevel, levels, err := ParseLevels(opts.Levels, defaultLevel)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		w      io.Writer = os.Stderr
+		closer io.Closer = nopCloser{}
+	)
+
+	if opts.File != "" {
+		f, err := OpenRotatingFile(opts.File, opts.MaxFileSize, opts.MaxBackups)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		w, closer = f, f
+	}
+
+	// Filtering is done by componentHandler so the underlying handler accepts everything.
+	handlerOpts := &slog.HandlerOptions{Level: slog.LevelDebug}
+
+	var handler slog.Handler
+
+	switch opts.Format {
+	case "", FormatText:
+		handler = slog.NewTextHandler(w, handlerOpts)
+	case FormatJson:
+		handler = slog.NewJSONHandler(w, handlerOpts)
+	default:
+		_ = closer.Close()
+
+		return nil, nil, fmt.Errorf("%w: %s", constants.ErrInvalidLogFormat, opts.Format)
+	}
+
+	return slog.New(&componentHandler{
+		Handler: handler,
+		level:   defaultLevel,
+		levels:  levels,
+	}), closer, nil
+}
+
+// ParseLevels parses a Options.Levels string.  It returns the default level, which is defaultLevel unless
+// the string overrides it, and the level of each component that has been given one.
+func ParseLevels(s string, defaultLevel slog.Level) (slog.Level, map[string]slog.Level, error) {
+	levels := make(map[string]slog.Level)
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		component, levelName, found := strings.Cut(entry, "=")
+		if !found {
+			levelName = component
+		}
+
+		var level slog.Level
+
+		err := level.UnmarshalText([]byte(levelName))
+		if err != nil {
+			return 0, nil, fmt.Errorf("%w: %s", constants.ErrInvalidLogLevel, entry)
+		}
+
+		if !found {
+			defaultLevel = level
+
+			continue
+		}
+
+		switch component {
+		case ComponentConfig, ComponentIap, ComponentSsh, ComponentExec:
+			levels[component] = level
+		default:
+			return 0, nil, fmt.Errorf("%w: unknown component %q", constants.ErrInvalidLogLevel, component)
+		}
+	}
+
+	return defaultLevel, levels, nil
+}
+
+// ForComponent returns a logger whose messages are tagged with component, so that they are filtered using
+// that component's level.
+func ForComponent(logger *slog.Logger, component string) *slog.Logger {
+	return logger.With(componentKey, component)
+}
+
+// componentHandler filters messages using the level of the component that the logger was created for by
+// ForComponent, or the default level if there is no component or it has not been given a level.
+type componentHandler struct {
+	slog.Handler
+	level  slog.Level
+	levels map[string]slog.Level
+}
+
+func (h *componentHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level && h.Handler.Enabled(ctx, level)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	level := h.level
+
+	for _, attr := range attrs {
+		if attr.Key != componentKey {
+			continue
+		}
+
+		if l, ok := h.levels[attr.Value.String()]; ok {
+			level = l
+		}
+	}
+
+	return &componentHandler{Handler: h.Handler.WithAttrs(attrs), level: level, levels: h.levels}
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return &componentHandler{Handler: h.Handler.WithGroup(name), level: h.level, levels: h.levels}
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
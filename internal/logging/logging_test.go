@@ -0,0 +1,174 @@
+package logging
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+)
+
+func TestParseLevels(t *testing.T) {
+	tests := []struct {
+		name        string
+		levels      string
+		wantDefault slog.Level
+		wantLevels  map[string]slog.Level
+		wantErr     error
+	}{
+		{
+			name:        "empty",
+			levels:      "",
+			wantDefault: slog.LevelInfo,
+			wantLevels:  map[string]slog.Level{},
+		},
+		{
+			name:        "default_only",
+			levels:      "warn",
+			wantDefault: slog.LevelWarn,
+			wantLevels:  map[string]slog.Level{},
+		},
+		{
+			name:        "components",
+			levels:      "error, ssh=debug,iap=WARN",
+			wantDefault: slog.LevelError,
+			wantLevels:  map[string]slog.Level{ComponentSsh: slog.LevelDebug, ComponentIap: slog.LevelWarn},
+		},
+		{
+			name:    "unknown_level",
+			levels:  "ssh=loud",
+			wantErr: constants.ErrInvalidLogLevel,
+		},
+		{
+			name:    "unknown_component",
+			levels:  "websocket=debug",
+			wantErr: constants.ErrInvalidLogLevel,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotDefault, gotLevels, err := ParseLevels(tt.levels, slog.LevelInfo)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseLevels() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if gotDefault != tt.wantDefault {
+				t.Errorf("ParseLevels() default = %v, want %v", gotDefault, tt.wantDefault)
+			}
+
+			if len(gotLevels) != len(tt.wantLevels) {
+				t.Fatalf("ParseLevels() levels = %v, want %v", gotLevels, tt.wantLevels)
+			}
+
+			for k, v := range tt.wantLevels {
+				if gotLevels[k] != v {
+					t.Errorf("ParseLevels() level of %s = %v, want %v", k, gotLevels[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "iapgo.log")
+
+	logger, closer, err := New(Options{Format: FormatJson, File: path, Levels: "ssh=debug,iap=error"})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	logger.Debug("default debug")
+	logger.Info("default info")
+	ForComponent(logger, ComponentSsh).Debug("ssh debug")
+	ForComponent(logger, ComponentIap).Warn("iap warn")
+	ForComponent(logger, ComponentIap).Error("iap error")
+
+	_ = closer.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open log file: %v", err)
+	}
+
+	defer func() { _ = f.Close() }()
+
+	var got []string
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record struct {
+			Msg string
+		}
+
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			t.Fatalf("log line is not JSON: %v: %s", err, scanner.Text())
+		}
+
+		got = append(got, record.Msg)
+	}
+
+	want := []string{"default info", "ssh debug", "iap error"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("logged messages = %v, want %v", got, want)
+	}
+
+	_, _, err = New(Options{Format: "xml"})
+	if !errors.Is(err, constants.ErrInvalidLogFormat) {
+		t.Errorf("New() error = %v, want %v", err, constants.ErrInvalidLogFormat)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "iapgo.log")
+
+	r, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile() error = %v", err)
+	}
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n", "six\n"} {
+		_, err = r.Write([]byte(line))
+		if err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	_ = r.Close()
+
+	// Each rotation happens before a write that would take the file past 10 bytes, and only two backups
+	// are kept so "one\ntwo\n" has been removed.
+	want := map[string]string{
+		path:        "six\n",
+		path + ".1": "four\nfive\n",
+		path + ".2": "three\n",
+	}
+
+	for p, content := range want {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", p, err)
+		}
+
+		if string(data) != content {
+			t.Errorf("%s = %q, want %q", p, data, content)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("%s.3 exists, err = %v", path, err)
+	}
+
+	if _, err := r.Write([]byte("seven\n")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write() after Close() error = %v, want %v", err, os.ErrClosed)
+	}
+}
@@ -0,0 +1,133 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+)
+
+// RotatingFile is a log file that is rotated when it reaches a maximum size.  The current file is renamed
+// to path.1, any existing path.1 to path.2 and so on, and the oldest file beyond the number of backups is
+// removed.
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// OpenRotatingFile opens path for appending, creating it if necessary.  Zero values of maxSize and
+// maxBackups mean DefaultMaxFileSize and DefaultMaxBackups.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxFileSize
+	}
+
+	if maxBackups <= 0 {
+		maxBackups = DefaultMaxBackups
+	}
+
+	r := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("%w: %w", constants.ErrFailedToOpenLogFile, err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+
+		return fmt.Errorf("%w: %w", constants.ErrFailedToOpenLogFile, err)
+	}
+
+	r.file = f
+	r.size = fi.Size()
+
+	return nil
+}
+
+// Write writes p to the file, first rotating it if p would take it past the maximum size.  A single write
+// is never split across files so that each log message stays whole.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+
+	return n, err
+}
+
+func (r *RotatingFile) rotate() error {
+	err := r.file.Close()
+	r.file = nil
+
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(r.backupPath(r.maxBackups))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	for i := r.maxBackups - 1; i >= 1; i-- {
+		err = os.Rename(r.backupPath(i), r.backupPath(i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	err = os.Rename(r.path, r.backupPath(1))
+	if err != nil {
+		return err
+	}
+
+	return r.open()
+}
+
+func (r *RotatingFile) backupPath(n int) string {
+	return r.path + "." + strconv.Itoa(n)
+}
+
+// Close closes the current file.  Any later writes fail.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.file.Close()
+	r.file = nil
+
+	return err
+}
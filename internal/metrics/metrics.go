@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+)
+
+// contentType is the Prometheus text exposition format.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// metric describes one metric family.  samples returns its samples for a snapshot.  Each sample's labels
+// are added to the section and forward labels.
+type metric struct {
+	name    string
+	help    string
+	kind    string
+	samples func(snap stats.Snapshot) []sample
+}
+
+type sample struct {
+	labels string
+	value  float64
+}
+
+func single(f func(snap stats.Snapshot) float64) func(snap stats.Snapshot) []sample {
+	return func(snap stats.Snapshot) []sample {
+		return []sample{{value: f(snap)}}
+	}
+}
+
+var metrics = []metric{
+	{
+		name:    "iapgo_uptime_seconds",
+		help:    "Time since the tunnel was started.",
+		kind:    "gauge",
+		samples: single(func(snap stats.Snapshot) float64 { return snap.UptimeSeconds }),
+	},
+	{
+		name:    "iapgo_connections_active",
+		help:    "Number of open local connections.",
+		kind:    "gauge",
+		samples: single(func(snap stats.Snapshot) float64 { return float64(snap.ActiveConnections) }),
+	},
+	{
+		name:    "iapgo_connections_accepted_total",
+		help:    "Number of local connections accepted.",
+		kind:    "counter",
+		samples: single(func(snap stats.Snapshot) float64 { return float64(snap.TotalConnections) }),
+	},
+	{
+		name:    "iapgo_connections_failed_total",
+		help:    "Number of local connections that could not be connected to the remote service.",
+		kind:    "counter",
+		samples: single(func(snap stats.Snapshot) float64 { return float64(snap.FailedConnections) }),
+	},
+	{
+		name: "iapgo_bytes_total",
+		help: "Bytes transferred through the tunnel.",
+		kind: "counter",
+		samples: func(snap stats.Snapshot) []sample {
+			return []sample{
+				{labels: `direction="to_remote"`, value: float64(snap.BytesToRemote)},
+				{labels: `direction="from_remote"`, value: float64(snap.BytesFromRemote)},
+			}
+		},
+	},
+	{
+		name:    "iapgo_reconnects_total",
+		help:    "Number of times the tunnel has connected again after failing.",
+		kind:    "counter",
+		samples: single(func(snap stats.Snapshot) float64 { return float64(snap.Reconnects) }),
+	},
+	{
+		name:    "iapgo_ssh_dial_failures_total",
+		help:    "Number of failures to open an SSH channel to the remote service.",
+		kind:    "counter",
+		samples: single(func(snap stats.Snapshot) float64 { return float64(snap.SshDialFailures) }),
+	},
+	{
+		name: "iapgo_readiness_latency_seconds",
+		help: "Time taken for the readiness probe to succeed.",
+		kind: "gauge",
+		samples: func(snap stats.Snapshot) []sample {
+			if snap.ReadinessSeconds == 0 {
+				return nil
+			}
+
+			return []sample{{value: snap.ReadinessSeconds}}
+		},
+	},
+}
+
+// Write writes the metrics for each snapshot in the Prometheus text exposition format.  Every sample is
+// labelled with the section and the forward, which is named after the section.
+func Write(w io.Writer, snaps ...stats.Snapshot) error {
+	bw := bufio.NewWriter(w)
+
+	for _, m := range metrics {
+		_, _ = fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+		for _, snap := range snaps {
+			labels := fmt.Sprintf(`section="%s",forward="%s"`, escape(snap.Section), escape(snap.Section))
+
+			for _, s := range m.samples(snap) {
+				sampleLabels := labels
+				if s.labels != "" {
+					sampleLabels += "," + s.labels
+				}
+
+				_, _ = fmt.Fprintf(bw, "%s{%s} %g\n", m.name, sampleLabels, s.value)
+			}
+		}
+	}
+
+	return bw.Flush()
+}
+
+// escape escapes a label value as required by the text exposition format.
+func escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// Handler serves the metrics for tunnelStats.
+func Handler(tunnelStats *stats.Stats, logger *slog.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+
+		err := Write(w, tunnelStats.Snapshot())
+		if err != nil {
+			logger.Debug("failed to write metrics", "error", err)
+		}
+	})
+}
+
+// Serve serves the metrics on /metrics until lsnr is closed.
+func Serve(lsnr net.Listener, tunnelStats *stats.Stats, logger *slog.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(tunnelStats, logger))
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	err := srv.Serve(lsnr)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		logger.Error("metrics server failed", "error", err)
+	}
+}
@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+)
+
+func TestWrite(t *testing.T) {
+	snap := stats.Snapshot{
+		Section:           `db"1`,
+		UptimeSeconds:     90,
+		ActiveConnections: 2,
+		TotalConnections:  10,
+		FailedConnections: 1,
+		Reconnects:        3,
+		SshDialFailures:   4,
+		BytesToRemote:     1000,
+		BytesFromRemote:   2500000,
+	}
+
+	var buf bytes.Buffer
+	if err := Write(&buf, snap); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	want := []string{
+		"# TYPE iapgo_connections_active gauge",
+		`iapgo_uptime_seconds{section="db\"1",forward="db\"1"} 90`,
+		`iapgo_connections_active{section="db\"1",forward="db\"1"} 2`,
+		`iapgo_connections_accepted_total{section="db\"1",forward="db\"1"} 10`,
+		`iapgo_connections_failed_total{section="db\"1",forward="db\"1"} 1`,
+		`iapgo_bytes_total{section="db\"1",forward="db\"1",direction="to_remote"} 1000`,
+		`iapgo_bytes_total{section="db\"1",forward="db\"1",direction="from_remote"} 2.5e+06`,
+		`iapgo_reconnects_total{section="db\"1",forward="db\"1"} 3`,
+		`iapgo_ssh_dial_failures_total{section="db\"1",forward="db\"1"} 4`,
+	}
+
+	for _, line := range want {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Write() output does not contain %q:\n%s", line, buf.String())
+		}
+	}
+
+	// There is no readiness sample until a probe has succeeded.
+	if strings.Contains(buf.String(), "iapgo_readiness_latency_seconds{") {
+		t.Errorf("Write() output contains a readiness sample:\n%s", buf.String())
+	}
+}
+
+func TestServe(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	defer func() { _ = lsnr.Close() }()
+
+	tunnelStats := stats.New("db")
+	tunnelStats.SetReadinessLatency(1500 * time.Millisecond)
+
+	go Serve(lsnr, tunnelStats, logger)
+
+	resp, err := http.Get("http://" + lsnr.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to get metrics: %v", err)
+	}
+
+	defer func() { _ = resp.Body.Close() }()
+
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != contentType {
+		t.Errorf("GET /metrics = %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	if !strings.Contains(string(body), `iapgo_readiness_latency_seconds{section="db",forward="db"} 1.5`) {
+		t.Errorf("GET /metrics did not include the readiness latency:\n%s", body)
+	}
+}
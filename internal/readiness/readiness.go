@@ -0,0 +1,343 @@
+package readiness
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/config"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+)
+
+// tcpSettleTime is how long a tcp probe waits for the connection to be closed once it has been connected
+// to the remote service.  The local listener accepts connections before the remote side has been dialled,
+// so a successful connect alone proves nothing.
+const tcpSettleTime = 500 * time.Millisecond
+
+// postgresSslRequest is the SSLRequest message.  Every PostgreSQL server answers this with a single byte
+// before any authentication takes place.
+var postgresSslRequest = []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}
+
+// Wait runs the probe described by cfg against the local listener at network and address until it
+// succeeds or the configured number of retries has been used up.  The probe's connections are reported to
+// tunnelStats, if it is not nil, so that they are not counted as client connections.
+func Wait(
+	ctx context.Context,
+	cfg *config.ReadinessCfg,
+	network string,
+	address string,
+	tunnelStats *stats.Stats,
+	logger *slog.Logger,
+) error {
+	if cfg == nil || logger == nil {
+		return constants.ErrNilParameter
+	}
+
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = config.DefaultReadinessTimeout
+	}
+
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = config.DefaultReadinessInterval
+	}
+
+	retries := config.DefaultReadinessRetries
+	if cfg.Retries != nil {
+		retries = *cfg.Retries
+	}
+
+	start := time.Now()
+
+	for attempt := 1; ; attempt++ {
+		probeCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := Probe(probeCtx, cfg, network, address, tunnelStats)
+
+		cancel()
+
+		if err == nil {
+			logger.Info("readiness probe succeeded", "type", cfg.Type, "attempts", attempt, "elapsed", time.Since(start))
+
+			return nil
+		}
+
+		if attempt > retries {
+			return fmt.Errorf("%w: %s after %d attempts: %w", constants.ErrReadinessProbeFailed, cfg.Type, attempt, err)
+		}
+
+		logger.Debug("readiness probe failed so retrying", "type", cfg.Type, "attempt", attempt, "error", err)
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", constants.ErrReadinessProbeFailed, context.Cause(ctx))
+		}
+	}
+}
+
+// Probe makes a single attempt to check that the remote service answers.  ctx should have a deadline.
+func Probe(
+	ctx context.Context,
+	cfg *config.ReadinessCfg,
+	network string,
+	address string,
+	tunnelStats *stats.Stats,
+) error {
+	if cfg.Type == config.ProbeHttp || cfg.Type == config.ProbeHttps {
+		return probeHttp(ctx, cfg, network, address, tunnelStats)
+	}
+
+	conn, connected, err := dial(ctx, network, address, tunnelStats)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	switch cfg.Type {
+	case config.ProbeTcp:
+		return probeTcp(ctx, conn, connected)
+	case config.ProbeTls:
+		return probeTls(ctx, cfg, conn, address)
+	case config.ProbePostgres:
+		return probePostgres(conn)
+	case config.ProbeMysql:
+		return probeMysql(conn)
+	case config.ProbeRedis:
+		return probeRedis(conn)
+	default:
+		return fmt.Errorf("%w: %s", constants.ErrInvalidReadinessType, cfg.Type)
+	}
+}
+
+// dial connects to the local listener and tells tunnelStats, if it is not nil, which connection is the
+// probe's.  The returned channel receives the outcome of connecting through to the remote service, and is
+// nil if tunnelStats is.
+func dial(
+	ctx context.Context,
+	network string,
+	address string,
+	tunnelStats *stats.Stats,
+) (net.Conn, <-chan error, error) {
+	var dialer net.Dialer
+
+	if tunnelStats == nil {
+		conn, err := dialer.DialContext(ctx, network, address)
+
+		return conn, nil, err
+	}
+
+	tunnelStats.StartProbe()
+
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		tunnelStats.EndProbe(nil)
+
+		return nil, nil, err
+	}
+
+	return conn, tunnelStats.EndProbe(conn.LocalAddr()), nil
+}
+
+// probeTcp succeeds if, once the tunnel has connected it through to the remote service, the connection is
+// still open after tcpSettleTime or the server sends something.  connected may be nil, e.g., in tests,
+// in which case only the settle time is used.
+func probeTcp(ctx context.Context, conn net.Conn, connected <-chan error) error {
+	if connected != nil {
+		select {
+		case err := <-connected:
+			if err != nil {
+				return fmt.Errorf("%w: %w", constants.ErrProbeNotConnected, err)
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", constants.ErrProbeNotConnected, ctx.Err())
+		}
+	}
+
+	deadline := time.Now().Add(tcpSettleTime)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	_ = conn.SetReadDeadline(deadline)
+
+	_, err := conn.Read(make([]byte, 1))
+
+	var netErr net.Error
+	if err == nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return nil
+	}
+
+	return err
+}
+
+func probeHttp(
+	ctx context.Context,
+	cfg *config.ReadinessCfg,
+	network string,
+	address string,
+	tunnelStats *stats.Stats,
+) error {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+			conn, _, err := dial(ctx, network, address, tunnelStats)
+
+			return conn, err
+		},
+		DisableKeepAlives: true,
+		TLSClientConfig:   tlsConfig(cfg, address),
+	}
+	defer transport.CloseIdleConnections()
+
+	host := address
+	if network == "unix" {
+		host = "localhost"
+	}
+
+	path := cfg.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.Type+"://"+host+path, nil)
+	if err != nil {
+		return err
+	}
+
+	if cfg.ServerName != "" {
+		req.Host = cfg.ServerName
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = resp.Body.Close() }()
+
+	expectStatus := cfg.ExpectStatus
+	if expectStatus == 0 {
+		expectStatus = http.StatusOK
+	}
+
+	if resp.StatusCode != expectStatus {
+		return fmt.Errorf("%w: http status %d, want %d", constants.ErrUnexpectedProbeResponse, resp.StatusCode, expectStatus)
+	}
+
+	return nil
+}
+
+func probeTls(ctx context.Context, cfg *config.ReadinessCfg, conn net.Conn, address string) error {
+	return tls.Client(conn, tlsConfig(cfg, address)).HandshakeContext(ctx)
+}
+
+// tlsConfig uses server_name to verify the certificate, or the host that the probe connects to if it is
+// not set.
+func tlsConfig(cfg *config.ReadinessCfg, address string) *tls.Config {
+	serverName := cfg.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(address)
+		if err == nil {
+			serverName = host
+		}
+	}
+
+	return &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+}
+
+func probePostgres(conn net.Conn) error {
+	_, err := conn.Write(postgresSslRequest)
+	if err != nil {
+		return err
+	}
+
+	reply := make([]byte, 1)
+
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+
+	if reply[0] != 'S' && reply[0] != 'N' {
+		return fmt.Errorf("%w: postgres replied %q to SSLRequest", constants.ErrUnexpectedProbeResponse, reply[0])
+	}
+
+	return nil
+}
+
+// probeMysql reads the initial handshake packet that a MySQL server sends as soon as a client connects.
+func probeMysql(conn net.Conn) error {
+	header := make([]byte, 4)
+
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return err
+	}
+
+	length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if length == 0 {
+		return fmt.Errorf("%w: mysql sent an empty packet", constants.ErrUnexpectedProbeResponse)
+	}
+
+	payload := make([]byte, length)
+
+	_, err = io.ReadFull(conn, payload)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case payload[0] == 10:
+		return nil
+	case payload[0] == 0xff && length >= 3:
+		// An error packet, e.g., because the host is blocked or there are too many connections.
+		return fmt.Errorf(
+			"%w: mysql error %d: %s",
+			constants.ErrUnexpectedProbeResponse,
+			binary.LittleEndian.Uint16(payload[1:3]),
+			payload[3:],
+		)
+	default:
+		return fmt.Errorf("%w: mysql protocol version %d", constants.ErrUnexpectedProbeResponse, payload[0])
+	}
+}
+
+// probeRedis sends PING.  A NOAUTH error also shows that the server is answering, so it counts as ready.
+func probeRedis(conn net.Conn) error {
+	_, err := conn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+	if err != nil {
+		return err
+	}
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+
+	line = bytes.TrimRight(line, "\r\n")
+
+	if bytes.Equal(line, []byte("+PONG")) || bytes.HasPrefix(line, []byte("-NOAUTH")) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: redis replied %q to PING", constants.ErrUnexpectedProbeResponse, line)
+}
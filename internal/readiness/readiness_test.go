@@ -0,0 +1,376 @@
+package readiness
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/audit"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/config"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+)
+
+// startFakeServer accepts connections on network and passes each one to handle, then closes it.
+func startFakeServer(t *testing.T, network string, handle func(conn net.Conn)) string {
+	t.Helper()
+
+	address := "127.0.0.1:0"
+	if network == "unix" {
+		address = filepath.Join(t.TempDir(), "probe.sock")
+	}
+
+	lsnr, err := net.Listen(network, address)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	t.Cleanup(func() { _ = lsnr.Close() })
+
+	go func() {
+		for {
+			conn, err := lsnr.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() { _ = conn.Close() }()
+
+				handle(conn)
+			}()
+		}
+	}()
+
+	return lsnr.Addr().String()
+}
+
+// reply reads want bytes from the client, if any, and then writes response.
+func reply(want int, response string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		_, err := io.ReadFull(conn, make([]byte, want))
+		if err != nil {
+			return
+		}
+
+		_, _ = conn.Write([]byte(response))
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	httpSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer httpSrv.Close()
+
+	tlsSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer tlsSrv.Close()
+
+	httpAddr := strings.TrimPrefix(httpSrv.URL, "http://")
+	tlsAddr := strings.TrimPrefix(tlsSrv.URL, "https://")
+
+	tests := []struct {
+		name    string
+		cfg     config.ReadinessCfg
+		network string
+		address string
+		wantErr error
+	}{
+		{
+			name:    "tcp_stays_open",
+			cfg:     config.ReadinessCfg{Type: config.ProbeTcp},
+			network: "tcp",
+			address: startFakeServer(t, "tcp", func(conn net.Conn) { time.Sleep(time.Second) }),
+		},
+		{
+			name:    "tcp_closed_by_server",
+			cfg:     config.ReadinessCfg{Type: config.ProbeTcp},
+			network: "tcp",
+			address: startFakeServer(t, "tcp", func(conn net.Conn) {}),
+			wantErr: io.EOF,
+		},
+		{
+			name:    "http",
+			cfg:     config.ReadinessCfg{Type: config.ProbeHttp, Path: "/healthz"},
+			network: "tcp",
+			address: httpAddr,
+		},
+		{
+			name:    "http_expect_status",
+			cfg:     config.ReadinessCfg{Type: config.ProbeHttp, Path: "/missing", ExpectStatus: http.StatusNotFound},
+			network: "tcp",
+			address: httpAddr,
+		},
+		{
+			name:    "http_unexpected_status",
+			cfg:     config.ReadinessCfg{Type: config.ProbeHttp, Path: "/missing"},
+			network: "tcp",
+			address: httpAddr,
+			wantErr: constants.ErrUnexpectedProbeResponse,
+		},
+		{
+			name:    "https",
+			cfg:     config.ReadinessCfg{Type: config.ProbeHttps, InsecureSkipVerify: true},
+			network: "tcp",
+			address: tlsAddr,
+		},
+		{
+			name:    "tls",
+			cfg:     config.ReadinessCfg{Type: config.ProbeTls, InsecureSkipVerify: true},
+			network: "tcp",
+			address: tlsAddr,
+		},
+		{
+			name:    "postgres",
+			cfg:     config.ReadinessCfg{Type: config.ProbePostgres},
+			network: "tcp",
+			address: startFakeServer(t, "tcp", reply(len(postgresSslRequest), "N")),
+		},
+		{
+			name:    "postgres_unexpected_reply",
+			cfg:     config.ReadinessCfg{Type: config.ProbePostgres},
+			network: "tcp",
+			address: startFakeServer(t, "tcp", reply(len(postgresSslRequest), "X")),
+			wantErr: constants.ErrUnexpectedProbeResponse,
+		},
+		{
+			name:    "mysql",
+			cfg:     config.ReadinessCfg{Type: config.ProbeMysql},
+			network: "tcp",
+			address: startFakeServer(t, "tcp", reply(0, "\x06\x00\x00\x00\x0a8.0\x00\x00")),
+		},
+		{
+			name:    "mysql_error_packet",
+			cfg:     config.ReadinessCfg{Type: config.ProbeMysql},
+			network: "tcp",
+			address: startFakeServer(t, "tcp", reply(0, "\x07\x00\x00\x00\xff\x10\x04busy")),
+			wantErr: constants.ErrUnexpectedProbeResponse,
+		},
+		{
+			name:    "redis",
+			cfg:     config.ReadinessCfg{Type: config.ProbeRedis},
+			network: "tcp",
+			address: startFakeServer(t, "tcp", reply(14, "+PONG\r\n")),
+		},
+		{
+			name:    "redis_noauth",
+			cfg:     config.ReadinessCfg{Type: config.ProbeRedis},
+			network: "tcp",
+			address: startFakeServer(t, "tcp", reply(14, "-NOAUTH Authentication required.\r\n")),
+		},
+		{
+			name:    "redis_unix_socket",
+			cfg:     config.ReadinessCfg{Type: config.ProbeRedis},
+			network: "unix",
+			address: startFakeServer(t, "unix", reply(14, "+PONG\r\n")),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			err := Probe(ctx, &tt.cfg, tt.network, tt.address, nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Probe() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProbe_TcpConnected(t *testing.T) {
+	tests := []struct {
+		name string
+		// connect is called with each accepted connection, which is left open like the tunnel does when it
+		// cannot reach the remote service.
+		connect func(conn net.Conn)
+		wantErr error
+	}{
+		{
+			name:    "connected",
+			connect: func(conn net.Conn) { stats.Connected(conn, nil) },
+			wantErr: nil,
+		},
+		{
+			name:    "unreachable",
+			connect: func(conn net.Conn) { stats.Connected(conn, errors.New("connection refused")) },
+			wantErr: constants.ErrProbeNotConnected,
+		},
+		{
+			name:    "never_connected",
+			connect: func(net.Conn) {},
+			wantErr: constants.ErrProbeNotConnected,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("failed to listen: %v", err)
+			}
+
+			tunnelStats := stats.New("test")
+			lsnr := tunnelStats.Listener(inner)
+
+			t.Cleanup(func() { _ = lsnr.Close() })
+
+			go func() {
+				for {
+					conn, err := lsnr.Accept()
+					if err != nil {
+						return
+					}
+
+					t.Cleanup(func() { _ = conn.Close() })
+
+					tt.connect(conn)
+				}
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			err = Probe(ctx, &config.ReadinessCfg{Type: config.ProbeTcp}, "tcp", inner.Addr().String(), tunnelStats)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Probe() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWait(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	// The server closes the first two connections, as the local listener does while the remote service
+	// is still starting, and then starts answering.
+	var attempts atomic.Int32
+
+	address := startFakeServer(t, "tcp", func(conn net.Conn) {
+		if attempts.Add(1) > 2 {
+			reply(14, "+PONG\r\n")(conn)
+		}
+	})
+
+	tests := []struct {
+		name         string
+		retries      int
+		wantAttempts int32
+		wantErr      error
+	}{
+		{
+			name:         "no_retries",
+			retries:      0,
+			wantAttempts: 1,
+			wantErr:      constants.ErrReadinessProbeFailed,
+		},
+		{
+			name:         "retries_exhausted",
+			retries:      1,
+			wantAttempts: 2,
+			wantErr:      constants.ErrReadinessProbeFailed,
+		},
+		{
+			name:         "ready_after_retries",
+			retries:      3,
+			wantAttempts: 3,
+			wantErr:      nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts.Store(0)
+
+			retries := tt.retries
+
+			cfg := &config.ReadinessCfg{
+				Type:     config.ProbeRedis,
+				Retries:  &retries,
+				Interval: 10 * time.Millisecond,
+				Timeout:  time.Second,
+			}
+
+			err := Wait(context.Background(), cfg, "tcp", address, nil, logger)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Wait() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got := attempts.Load(); got != tt.wantAttempts {
+				t.Errorf("Wait() made %d attempts, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestWait_ProbeNotCounted(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	auditLog, err := audit.Open(auditPath, "test", logger)
+	if err != nil {
+		t.Fatalf("audit.Open() error = %v", err)
+	}
+
+	defer func() { _ = auditLog.Close() }()
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	// The listener is wrapped in the same way as the tunnel's, and answers like a redis server.
+	tunnelStats := stats.New("test")
+	lsnr := auditLog.Listener(tunnelStats.Listener(inner))
+
+	t.Cleanup(func() { _ = lsnr.Close() })
+
+	go func() {
+		for {
+			conn, err := lsnr.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer func() { _ = conn.Close() }()
+
+				reply(14, "+PONG\r\n")(conn)
+			}()
+		}
+	}()
+
+	cfg := &config.ReadinessCfg{Type: config.ProbeRedis, Timeout: time.Second}
+
+	if err := Wait(context.Background(), cfg, "tcp", inner.Addr().String(), tunnelStats, logger); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+
+	if got := tunnelStats.TotalCount(); got != 0 {
+		t.Errorf("TotalCount() = %d, want 0", got)
+	}
+
+	data, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatalf("failed to read audit log: %v", err)
+	}
+
+	if len(data) != 0 {
+		t.Errorf("audit log = %q, want it empty", data)
+	}
+}
@@ -0,0 +1,181 @@
+package readyfile
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+)
+
+// These are the formats that the connection details can be written in.
+const (
+	FormatJson   = "json"
+	FormatDotenv = "dotenv"
+)
+
+// Info holds the connection details that other tools need once the tunnel is ready.
+type Info struct {
+	Section  string `json:"section"`
+	Instance string `json:"instance"`
+	Host     string `json:"host,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	// Socket is set instead of Host and Port when the tunnel listens on a Unix domain socket.
+	Socket string `json:"socket,omitempty"`
+	// Ports maps each forward to its local port.  A section has a single forward which is named after
+	// the section.
+	Ports map[string]int `json:"ports,omitempty"`
+	Pid   int            `json:"pid"`
+}
+
+// FormatForPath returns format if it is set, otherwise it returns FormatDotenv for paths ending in .env
+// and FormatJson for anything else.
+func FormatForPath(path string, format string) (string, error) {
+	switch format {
+	case FormatJson, FormatDotenv:
+		return format, nil
+	case "":
+		if strings.HasSuffix(path, ".env") {
+			return FormatDotenv, nil
+		}
+
+		return FormatJson, nil
+	default:
+		return "", fmt.Errorf("%w: %s", constants.ErrInvalidReadyFormat, format)
+	}
+}
+
+// Marshal encodes info.  The dotenv format uses the same variable names as the environment of the exec
+// command.
+func Marshal(info Info, format string) ([]byte, error) {
+	switch format {
+	case FormatJson:
+		data, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+
+		return append(data, '\n'), nil
+	case FormatDotenv:
+		vars := map[string]string{
+			"IAPGO_SECTION":  info.Section,
+			"IAPGO_INSTANCE": info.Instance,
+			"IAPGO_PID":      strconv.Itoa(info.Pid),
+		}
+
+		if info.Socket != "" {
+			vars["IAPGO_LISTEN_SOCKET"] = info.Socket
+		} else {
+			vars["IAPGO_LISTEN_HOST"] = info.Host
+			vars["IAPGO_LISTEN_PORT"] = strconv.Itoa(info.Port)
+		}
+
+		keys := make([]string, 0, len(vars))
+		for k := range vars {
+			keys = append(keys, k)
+		}
+
+		sort.Strings(keys)
+
+		var buf bytes.Buffer
+		for _, k := range keys {
+			fmt.Fprintf(&buf, "%s=%s\n", k, strconv.Quote(vars[k]))
+		}
+
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", constants.ErrInvalidReadyFormat, format)
+	}
+}
+
+// WriteFile writes info to path.  The data is written to a temporary file in the same directory which is
+// then renamed, so a reader never sees a partly written file.
+func WriteFile(path string, format string, info Info) error {
+	data, err := Marshal(info, format)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("%w: %w", constants.ErrFailedToWriteReadyFile, err)
+	}
+
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: %w", constants.ErrFailedToWriteReadyFile, err)
+	}
+
+	return nil
+}
+
+// WriteFd writes info to an inherited file descriptor and then closes it, so that a parent process reading
+// from the other end of a pipe sees EOF once the payload is complete.  Standard input, output and error are
+// left open because iapgo and the exec command still use them.
+func WriteFd(fd int, format string, info Info) error {
+	data, err := Marshal(info, format)
+	if err != nil {
+		return err
+	}
+
+	switch fd {
+	case 0:
+		_, err = os.Stdin.Write(data)
+	case 1:
+		_, err = os.Stdout.Write(data)
+	case 2:
+		_, err = os.Stderr.Write(data)
+	default:
+		f := os.NewFile(uintptr(fd), "ready-fd")
+		if f == nil {
+			return fmt.Errorf("%w: invalid file descriptor %d", constants.ErrFailedToWriteReadyFile, fd)
+		}
+
+		_, err = f.Write(data)
+		closeErr := f.Close()
+
+		if err == nil {
+			err = closeErr
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: file descriptor %d: %w", constants.ErrFailedToWriteReadyFile, fd, err)
+	}
+
+	return nil
+}
+
+// ReadFile reads connection details that were written by WriteFile in the json format.
+func ReadFile(path string) (Info, error) {
+	var info Info
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return info, err
+	}
+
+	err = json.Unmarshal(data, &info)
+
+	return info, err
+}
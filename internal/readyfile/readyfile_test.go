@@ -0,0 +1,141 @@
+package readyfile
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+)
+
+var testInfo = Info{
+	Section:  "db",
+	Instance: "instance",
+	Host:     "localhost",
+	Port:     5432,
+	Ports:    map[string]int{"db": 5432},
+	Pid:      42,
+}
+
+func TestFormatForPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		format  string
+		want    string
+		wantErr error
+	}{
+		{name: "default", path: "", format: "", want: FormatJson},
+		{name: "json_file", path: "/tmp/iapgo.json", format: "", want: FormatJson},
+		{name: "env_file", path: "/tmp/iapgo.env", format: "", want: FormatDotenv},
+		{name: "explicit_format", path: "/tmp/iapgo.env", format: FormatJson, want: FormatJson},
+		{name: "invalid_format", path: "", format: "yaml", wantErr: constants.ErrInvalidReadyFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FormatForPath(tt.path, tt.format)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("FormatForPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("FormatForPath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		name   string
+		info   Info
+		format string
+		want   string
+	}{
+		{
+			name:   "json",
+			info:   testInfo,
+			format: FormatJson,
+			want: `{
+  "section": "db",
+  "instance": "instance",
+  "host": "localhost",
+  "port": 5432,
+  "ports": {
+    "db": 5432
+  },
+  "pid": 42
+}
+`,
+		},
+		{
+			name:   "dotenv",
+			info:   testInfo,
+			format: FormatDotenv,
+			want: `IAPGO_INSTANCE="instance"
+IAPGO_LISTEN_HOST="localhost"
+IAPGO_LISTEN_PORT="5432"
+IAPGO_PID="42"
+IAPGO_SECTION="db"
+`,
+		},
+		{
+			name:   "dotenv_socket",
+			info:   Info{Section: "docker", Instance: "instance", Socket: "/tmp/docker.sock", Pid: 42},
+			format: FormatDotenv,
+			want: `IAPGO_INSTANCE="instance"
+IAPGO_LISTEN_SOCKET="/tmp/docker.sock"
+IAPGO_PID="42"
+IAPGO_SECTION="docker"
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Marshal(tt.info, tt.format)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+
+			if string(got) != tt.want {
+				t.Errorf("Marshal() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "iapgo.env")
+
+	// An existing file is replaced.
+	if err := os.WriteFile(path, []byte("old"), 0o600); err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+
+	err := WriteFile(path, FormatDotenv, testInfo)
+	if err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	want, _ := Marshal(testInfo, FormatDotenv)
+
+	got, err := os.ReadFile(path)
+	if err != nil || string(got) != string(want) {
+		t.Errorf("WriteFile() wrote %q (error %v), want %q", got, err, want)
+	}
+
+	// The temporary file must not be left behind.
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("WriteFile() left %d files in the directory, want 1", len(entries))
+	}
+
+	err = WriteFile(filepath.Join(dir, "missing", "iapgo.json"), FormatJson, testInfo)
+	if !errors.Is(err, constants.ErrFailedToWriteReadyFile) {
+		t.Errorf("WriteFile() error = %v, wantErr %v", err, constants.ErrFailedToWriteReadyFile)
+	}
+}
@@ -0,0 +1,75 @@
+//go:build !windows
+
+package readyfile
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestWriteFd(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+
+	defer func() { _ = r.Close() }()
+
+	// WriteFd takes ownership of the descriptor, so it is given a duplicate to stop w closing it again.
+	fd, err := syscall.Dup(int(w.Fd()))
+	if err != nil {
+		t.Fatalf("failed to dup pipe: %v", err)
+	}
+
+	_ = w.Close()
+
+	err = WriteFd(fd, FormatJson, testInfo)
+	if err != nil {
+		t.Fatalf("WriteFd() error = %v", err)
+	}
+
+	// WriteFd closes the descriptor, so reading to EOF returns the whole payload.
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read pipe: %v", err)
+	}
+
+	want, _ := Marshal(testInfo, FormatJson)
+	if string(got) != string(want) {
+		t.Errorf("WriteFd() wrote %q, want %q", got, want)
+	}
+}
+
+func TestWriteFd_Stdout(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+
+	defer func() { _ = r.Close() }()
+
+	stdout := os.Stdout
+	os.Stdout = w
+
+	defer func() { os.Stdout = stdout }()
+
+	if err := WriteFd(1, FormatJson, testInfo); err != nil {
+		t.Fatalf("WriteFd() error = %v", err)
+	}
+
+	// Standard output must still be usable afterwards.
+	if _, err := os.Stdout.WriteString("after\n"); err != nil {
+		t.Errorf("write to stdout after WriteFd() error = %v", err)
+	}
+
+	_ = w.Close()
+
+	want, _ := Marshal(testInfo, FormatJson)
+
+	got, err := io.ReadAll(r)
+	if err != nil || string(got) != string(want)+"after\n" {
+		t.Errorf("stdout = %q (error %v), want %q", got, err, string(want)+"after\n")
+	}
+}
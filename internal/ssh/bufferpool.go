@@ -0,0 +1,45 @@
+package ssh
+
+import "sync"
+
+// DefaultBufferSize is the size of the buffers used to copy data through the SSH tunnel unless
+// copy_buffer_size is set.  It is larger than io.Copy's 32KiB because an SSH channel can carry up to
+// 32KiB per packet and a larger read lets several be written in one call.
+const DefaultBufferSize = 64 * 1024
+
+// defaultBufferPool is used by handlers that were not given a pool.
+var defaultBufferPool = NewBufferPool(DefaultBufferSize)
+
+// BufferPool reuses copy buffers between connections so that a busy tunnel does not allocate two new
+// buffers for every connection.
+type BufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewBufferPool returns a pool of size byte buffers.  A size of zero or less means DefaultBufferSize.
+func NewBufferPool(size int) *BufferPool {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+
+	p := &BufferPool{size: size}
+	p.pool.New = func() any {
+		buf := make([]byte, p.size)
+
+		return &buf
+	}
+
+	return p
+}
+
+// Get returns a buffer from the pool.  A pointer is used so that returning it to the pool with Put does
+// not allocate.
+func (p *BufferPool) Get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+// Put returns a buffer to the pool.
+func (p *BufferPool) Put(buf *[]byte) {
+	p.pool.Put(buf)
+}
@@ -3,41 +3,242 @@ package ssh
 import (
 	"io"
 	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
 )
 
+// HandlerOptions holds the per-forward settings for a Handler.  The zero value means no timeouts and the
+// default buffer pool.
+type HandlerOptions struct {
+	// If IdleTimeout is not zero then both connections are closed when no data has been copied in either
+	// direction for that long.  If MaxLifetime is not zero then they are closed that long after Handle
+	// starts, however busy they are.
+	IdleTimeout time.Duration
+	MaxLifetime time.Duration
+	// BufferPool supplies the copy buffers.  If it is nil then a shared pool of DefaultBufferSize buffers
+	// is used.
+	BufferPool *BufferPool
+}
+
 type Handler struct {
-	logger     *slog.Logger
-	localConn  io.ReadWriteCloser
-	tunnelConn io.ReadWriteCloser
+	logger      *slog.Logger
+	localConn   io.ReadWriteCloser
+	tunnelConn  io.ReadWriteCloser
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	bufferPool  *BufferPool
+
+	// lastActivity is the time of the last copy in either direction, in Unix nanoseconds.
+	lastActivity atomic.Int64
+	closeOnce    sync.Once
+	closeReason  error
+	closed       atomic.Bool
 }
 
-func NewHandler(localConn io.ReadWriteCloser, tunnelConn io.ReadWriteCloser, logger *slog.Logger) *Handler {
+func NewHandler(
+	localConn io.ReadWriteCloser,
+	tunnelConn io.ReadWriteCloser,
+	opts HandlerOptions,
+	logger *slog.Logger,
+) *Handler {
 	return &Handler{
-		logger:     logger,
-		localConn:  localConn,
-		tunnelConn: tunnelConn,
+		logger:      logger,
+		localConn:   localConn,
+		tunnelConn:  tunnelConn,
+		idleTimeout: opts.IdleTimeout,
+		maxLifetime: opts.MaxLifetime,
+		bufferPool:  opts.BufferPool,
 	}
 }
 
+// closeWriter is implemented by connections that can be half-closed, such as *net.TCPConn, *net.UnixConn and
+// SSH channels.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Handle copies data in both directions until both are finished.  When one direction reaches EOF the write
+// side of the other connection is closed, if it supports that, so that the EOF is passed on while data can
+// still flow the other way.  It returns the error from each direction, or the reason the connections were
+// closed if a timeout expired.
 func (h *Handler) Handle() (error, error) {
-	localConnCh := make(chan error)
-	tunnelConnCh := make(chan error)
 	h.logger.Debug("started handling tunnel i/o")
-	go func() {
-		_, err := io.Copy(h.tunnelConn, h.localConn)
-		localConnCh <- err
-		h.logger.Debug("io.Copy local connection completed")
-	}()
+
+	h.touch()
+
+	stopTimers := h.startTimers()
+	defer stopTimers()
+
+	// Only one extra goroutine is needed because the calling goroutine copies the other direction.
+	localConnCh := make(chan error, 1)
 
 	go func() {
-		_, err := io.Copy(h.localConn, h.tunnelConn)
-		tunnelConnCh <- err
-		h.logger.Debug("io.Copy tunnel connection completed")
+		localConnCh <- h.copy(h.tunnelConn, h.localConn)
+
+		h.logger.Debug("copy from local connection completed")
 	}()
 
+	tunnelConnErr := h.copy(h.localConn, h.tunnelConn)
+
+	h.logger.Debug("copy from tunnel connection completed")
+
 	localConnErr := <-localConnCh
-	tunnelConnErr := <-tunnelConnCh
-	_ = h.localConn.Close()
-	_ = h.tunnelConn.Close()
+
+	h.close(nil)
+
+	if h.closeReason != nil {
+		return h.closeReason, tunnelConnErr
+	}
+
 	return localConnErr, tunnelConnErr
 }
+
+// copy copies from src to dst until EOF and then half-closes dst.  If dst cannot be half-closed, or the copy
+// fails, then both connections are closed so that the other direction does not wait forever.
+func (h *Handler) copy(dst io.ReadWriteCloser, src io.ReadWriteCloser) error {
+	err := h.copyData(dst, src)
+	if err != nil {
+		h.close(nil)
+
+		return err
+	}
+
+	if !closeWrite(dst) {
+		h.close(nil)
+	}
+
+	return nil
+}
+
+// copyData is io.Copy using a pooled buffer, and recording activity for the idle timer.  The buffer is
+// always used, rather than letting dst or src choose as io.Copy does, because the connections are usually
+// wrapped and would allocate their own.
+func (h *Handler) copyData(dst io.Writer, src io.Reader) error {
+	pool := h.bufferPool
+	if pool == nil {
+		pool = defaultBufferPool
+	}
+
+	bufp := pool.Get()
+	defer pool.Put(bufp)
+
+	buf := *bufp
+
+	for {
+		nr, readErr := src.Read(buf)
+		if nr > 0 {
+			if h.idleTimeout > 0 {
+				h.touch()
+			}
+
+			nw, err := dst.Write(buf[:nr])
+			if err != nil {
+				return err
+			}
+
+			if nw != nr {
+				return io.ErrShortWrite
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		}
+
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// closeWrite half-closes conn, unwrapping connections that were wrapped for statistics or tracing.  It
+// returns false if conn cannot be half-closed.
+func closeWrite(conn io.ReadWriteCloser) bool {
+	var c any = conn
+
+	for {
+		if cw, ok := c.(closeWriter); ok {
+			return cw.CloseWrite() == nil
+		}
+
+		wrapper, ok := c.(stats.Wrapper)
+		if !ok {
+			return false
+		}
+
+		c = wrapper.NetConn()
+	}
+}
+
+// close closes both connections.  The first reason given is returned by Handle.
+func (h *Handler) close(reason error) {
+	h.closeOnce.Do(func() {
+		h.closed.Store(true)
+		h.closeReason = reason
+		_ = h.localConn.Close()
+		_ = h.tunnelConn.Close()
+	})
+}
+
+func (h *Handler) touch() {
+	h.lastActivity.Store(time.Now().UnixNano())
+}
+
+// startTimers starts the idle and maximum lifetime timers and returns a function that stops them.
+func (h *Handler) startTimers() func() {
+	var timers []*time.Timer
+
+	if h.maxLifetime > 0 {
+		timers = append(timers, time.AfterFunc(h.maxLifetime, func() {
+			if h.closed.Load() {
+				return
+			}
+
+			h.logger.Info(
+				"closing connection because it reached its maximum lifetime", "maxLifetime", h.maxLifetime,
+			)
+			h.close(constants.ErrConnectionMaxLifetime)
+		}))
+	}
+
+	if h.idleTimeout > 0 {
+		var (
+			mu        sync.Mutex
+			idleTimer *time.Timer
+		)
+
+		// The timer is re-armed for the rest of the timeout if there has been activity since it was set.
+		checkIdle := func() {
+			if h.closed.Load() {
+				return
+			}
+
+			idle := time.Since(time.Unix(0, h.lastActivity.Load()))
+			if idle >= h.idleTimeout {
+				h.logger.Info("closing connection because it was idle", "idleTimeout", h.idleTimeout)
+				h.close(constants.ErrConnectionIdleTimeout)
+
+				return
+			}
+
+			mu.Lock()
+			idleTimer.Reset(h.idleTimeout - idle)
+			mu.Unlock()
+		}
+
+		mu.Lock()
+		idleTimer = time.AfterFunc(h.idleTimeout, checkIdle)
+		timers = append(timers, idleTimer)
+		mu.Unlock()
+	}
+
+	return func() {
+		for _, t := range timers {
+			t.Stop()
+		}
+	}
+}
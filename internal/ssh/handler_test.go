@@ -1,11 +1,18 @@
 package ssh
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"os"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
 )
 
 type testReadWriteCloser struct {
@@ -120,3 +127,205 @@ func TestHandler_Handle(t *testing.T) {
 		})
 	}
 }
+
+// tcpPair returns both ends of a TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	defer func() { _ = lsnr.Close() }()
+
+	client, err := net.Dial("tcp", lsnr.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+
+	server, err := lsnr.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	return client, server
+}
+
+func TestHandler_HalfClose(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	client, local := tcpPair(t)
+	tunnel, remote := tcpPair(t)
+
+	// The local connection is wrapped, as it is by the SSH listener, to check that it is unwrapped to find
+	// CloseWrite.
+	lsnrStats := stats.New("test")
+	h := NewHandler(lsnrStats.Track(local), tunnel, HandlerOptions{}, logger)
+
+	done := make(chan [2]error, 1)
+
+	go func() {
+		err1, err2 := h.Handle()
+		done <- [2]error{err1, err2}
+	}()
+
+	// The client sends a request and half-closes, and the remote service only responds once it sees EOF.
+	_, _ = client.Write([]byte("request"))
+	_ = client.(*net.TCPConn).CloseWrite()
+
+	request, err := io.ReadAll(remote)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("remote read %q, %v, want %q", request, err, "request")
+	}
+
+	_, _ = remote.Write([]byte("response"))
+	_ = remote.Close()
+
+	response, err := io.ReadAll(client)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("client read %q, %v, want %q", response, err, "response")
+	}
+
+	select {
+	case errs := <-done:
+		if errs[0] != nil || errs[1] != nil {
+			t.Errorf("Handle() = %v, %v, want nil, nil", errs[0], errs[1])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handle() did not return")
+	}
+}
+
+func TestHandler_Timeouts(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	tests := []struct {
+		name        string
+		idleTimeout time.Duration
+		maxLifetime time.Duration
+		// If busy is true then data is sent throughout so that the connection is never idle.
+		busy    bool
+		wantErr error
+	}{
+		{
+			name:        "idle",
+			idleTimeout: 200 * time.Millisecond,
+			wantErr:     constants.ErrConnectionIdleTimeout,
+		},
+		{
+			name:        "max_lifetime",
+			idleTimeout: 200 * time.Millisecond,
+			maxLifetime: 500 * time.Millisecond,
+			busy:        true,
+			wantErr:     constants.ErrConnectionMaxLifetime,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, local := tcpPair(t)
+			tunnel, remote := tcpPair(t)
+
+			go func() { _, _ = io.Copy(io.Discard, remote) }()
+
+			if tt.busy {
+				go func() {
+					for {
+						_, err := client.Write([]byte("ping"))
+						if err != nil {
+							return
+						}
+
+						time.Sleep(50 * time.Millisecond)
+					}
+				}()
+			}
+
+			start := time.Now()
+
+			opts := HandlerOptions{IdleTimeout: tt.idleTimeout, MaxLifetime: tt.maxLifetime}
+
+			err, _ := NewHandler(local, tunnel, opts, logger).Handle()
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Handle() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("Handle() took %v", elapsed)
+			}
+		})
+	}
+}
+
+// BenchmarkHandler measures the throughput of a bulk transfer from the remote service to the client, as in
+// a pg_dump, through a handler with different copy buffer sizes.
+func BenchmarkHandler(b *testing.B) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	const transferSize = 64 * 1024 * 1024
+
+	for _, size := range []int{32 * 1024, DefaultBufferSize, 256 * 1024} {
+		b.Run(fmt.Sprintf("buffer_%dKiB", size/1024), func(b *testing.B) {
+			pool := NewBufferPool(size)
+			chunk := make([]byte, 1024*1024)
+
+			b.SetBytes(transferSize)
+			b.ReportAllocs()
+
+			for b.Loop() {
+				client, local := benchTcpPair(b)
+				tunnel, remote := benchTcpPair(b)
+
+				go func() {
+					for sent := 0; sent < transferSize; sent += len(chunk) {
+						_, _ = remote.Write(chunk)
+					}
+
+					_ = remote.Close()
+				}()
+
+				go func() {
+					_, _ = NewHandler(local, tunnel, HandlerOptions{BufferPool: pool}, logger).Handle()
+				}()
+
+				_ = client.(*net.TCPConn).CloseWrite()
+
+				n, err := io.Copy(io.Discard, client)
+				if err != nil || n != transferSize {
+					b.Fatalf("client received %d bytes, %v, want %d", n, err, transferSize)
+				}
+
+				_ = client.Close()
+			}
+		})
+	}
+}
+
+// benchTcpPair is tcpPair for benchmarks.
+func benchTcpPair(b *testing.B) (net.Conn, net.Conn) {
+	b.Helper()
+
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("failed to listen: %v", err)
+	}
+
+	defer func() { _ = lsnr.Close() }()
+
+	client, err := net.Dial("tcp", lsnr.Addr().String())
+	if err != nil {
+		b.Fatalf("failed to dial: %v", err)
+	}
+
+	server, err := lsnr.Accept()
+	if err != nil {
+		b.Fatalf("failed to accept: %v", err)
+	}
+
+	return client, server
+}
@@ -8,14 +8,27 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
+	"time"
 
+	"github.com/LaoZhuBaba/iapgo/v2/internal/audit"
 	"github.com/LaoZhuBaba/iapgo/v2/internal/config"
 	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/listener"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/tracing"
 	"github.com/LaoZhuBaba/iapgo/v2/internal/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
+// lazyCheckInterval is the longest that a lazy tunnel waits between checks for whether its SSH session has
+// been idle for lazy_idle_timeout.
+const lazyCheckInterval = time.Second
+
 type SshDialer func(network string, addr string, config *ssh.ClientConfig) (*ssh.Client, error)
 
 type SshTunnel struct {
@@ -26,6 +39,19 @@ type SshTunnel struct {
 	logger    *slog.Logger
 	Listener  net.Listener
 	sshDial   SshDialer
+	stats     *stats.Stats
+	auditLog  *audit.Log
+	// bufferPool is shared by the handlers for all of the tunnel's connections.
+	bufferPool *BufferPool
+	// clients holds the SSH client for the jump box followed by the client for each hop.  client is the
+	// last of these, or nil if there is no session.
+	clients []*ssh.Client
+	client  *ssh.Client
+	// sessionFailed is set when a session is closed because it failed, so that starting the next one is
+	// counted as a reconnect.
+	sessionFailed bool
+	// lastUsed is when a connection was last accepted or finished.
+	lastUsed time.Time
 }
 
 func NewSshTunnel(
@@ -33,14 +59,19 @@ func NewSshTunnel(
 	sshDial SshDialer,
 	destPort int,
 	localPort int,
+	tunnelStats *stats.Stats,
+	auditLog *audit.Log,
 	logger *slog.Logger,
 ) SshTunnel {
 	return SshTunnel{
-		config:    config,
-		destPort:  destPort,
-		localPort: localPort,
-		logger:    logger,
-		sshDial:   sshDial,
+		config:     config,
+		destPort:   destPort,
+		localPort:  localPort,
+		logger:     logger,
+		sshDial:    sshDial,
+		stats:      tunnelStats,
+		auditLog:   auditLog,
+		bufferPool: NewBufferPool(config.CopyBufferSize),
 	}
 }
 
@@ -51,43 +82,185 @@ func (c *SshTunnel) GetLsnrPort() int {
 	return c.localPort
 }
 
+// Start starts the SSH session and then the listener.  If the tunnel is lazy then the session is started
+// by the first connection instead.
 func (c *SshTunnel) Start(ctx context.Context) error {
-	sshClient, err := c.init()
+	if !c.config.Lazy {
+		_, err := c.init(ctx)
+		if err != nil {
+			return fmt.Errorf("%w: %w", constants.ErrSshDialFailed, err)
+		}
+
+		c.logger.Debug("underlying SSH session started okay")
+	}
+
+	lsnr, err := listener.Listen(c.config, c.logger)
 	if err != nil {
-		return fmt.Errorf("%w: %w", constants.ErrSshDialFailed, err)
+		return fmt.Errorf("(sshLsnr): %w", err)
 	}
 
-	c.logger.Debug("underlying SSH session started okay")
+	c.Listener = tracing.Listener(c.auditLog.Listener(c.stats.Listener(lsnr)), "iapgo.connection")
+
+	// A Unix domain socket listener has no port so localPort is left as zero.
+	if c.config.LocalSocket == nil {
+		c.localPort, err = util.GetPortFromTcpAddr(c.Listener, c.logger)
+		if err != nil {
+			return fmt.Errorf("%w: %w", constants.ErrFailedToGetPort, err)
+		}
+	}
+
+	c.logger.Debug("sshLsnr is listening", "addr", c.Listener.Addr())
+
+	go c.loop(ctx)
+
+	if c.config.Lazy && c.config.LazyIdleTimeout > 0 {
+		go c.closeWhenIdle(ctx)
+	}
+
+	return nil
+}
+
+// This method starts the underlying SSH session. If hops are configured then each one is dialled through
+// the client for the previous hop and the client for the final hop is returned.  It sets the c.clients
+// field so it requires a pointer receiver.
+func (c *SshTunnel) init(ctx context.Context) (_ *ssh.Client, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	c.Listener, err = net.Listen("tcp", fmt.Sprintf("localhost:%d", c.config.LocalPort))
+	ctx, span := tracing.Tracer().Start(ctx, "ssh.handshake", trace.WithAttributes(
+		attribute.Int("iapgo.ssh.hops", len(c.config.SshTunnel.Hops)),
+	))
+	defer span.End()
+	defer func() { _ = tracing.RecordError(span, err) }()
+
+	// The configuration only leaves the account name unresolved for a lazy tunnel.
+	if c.config.Lazy && c.config.SshTunnel.AccountName == "" {
+		err = config.ResolveAccountName(ctx, c.config.SshTunnel, c.logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The jump box host key is not checked.  It is reached through an IAP tunnel to the instance named by
+	// project, zone and instance, so IAP has already established which host we are talking to.
+	cfg, err := c.clientConfig(
+		c.config.SshTunnel.AccountName, c.config.SshTunnel.PrivateKeyFile, ssh.InsecureIgnoreHostKey(),
+	)
 	if err != nil {
-		return fmt.Errorf("%w (sshLsnr): %w", constants.ErrFailedToListen, err)
+		return nil, err
 	}
 
-	c.localPort, err = util.GetPortFromTcpAddr(c.Listener, c.logger)
+	// Load all the hop keys before dialling anything so that a bad key file is reported before
+	// any connection is made.
+	hopCfgs := make([]*ssh.ClientConfig, len(c.config.SshTunnel.Hops))
+
+	for i, hop := range c.config.SshTunnel.Hops {
+		accountName := hop.AccountName
+		if accountName == "" {
+			accountName = c.config.SshTunnel.AccountName
+		}
+
+		pkFile := hop.PrivateKeyFile
+		if pkFile == "" {
+			pkFile = c.config.SshTunnel.PrivateKeyFile
+		}
+
+		// A hop is reached over the network from the jump box rather than through IAP so its host key
+		// must be checked.
+		hostKeyCallback, err := hopHostKeyCallback(hop)
+		if err != nil {
+			return nil, fmt.Errorf("hop %d (%s): %w", i, hop.Host, err)
+		}
+
+		hopCfgs[i], err = c.clientConfig(accountName, pkFile, hostKeyCallback)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.logger.Debug("starting ssh tunnel", "destPort", c.destPort)
+
+	// Any error from sshDial() is hendled in the calling function.
+	client, err := c.sshDial("tcp", fmt.Sprintf("%s:%d", "localhost", c.destPort), cfg)
 	if err != nil {
-		return fmt.Errorf("%w: %w", constants.ErrFailedToGetPort, err)
+		return nil, err
 	}
 
-	c.logger.Debug("sshLsnr is listening on TCP port", "port", c.localPort)
+	clients := []*ssh.Client{client}
 
-	go c.loop(ctx, sshClient)
+	for i, hop := range c.config.SshTunnel.Hops {
+		_, hopSpan := tracing.Tracer().Start(ctx, "ssh.hop", trace.WithAttributes(
+			attribute.Int("iapgo.ssh.hop", i),
+			attribute.String("server.address", hop.Host),
+		))
 
-	return nil
+		client, err = c.dialHop(client, hop, hopCfgs[i])
+		_ = tracing.RecordError(hopSpan, err)
+
+		hopSpan.End()
+
+		if err != nil {
+			// Close the chain starting from the client furthest away.
+			for j := len(clients) - 1; j >= 0; j-- {
+				_ = clients[j].Close()
+			}
+
+			return nil, fmt.Errorf("%w: hop %d (%s): %w", constants.ErrSshHopDialFailed, i, hop.Host, err)
+		}
+
+		clients = append(clients, client)
+	}
+
+	c.clients = clients
+	c.client = client
+
+	c.auditLog.Write(audit.Record{
+		Event:        audit.EventSshSessionStart,
+		PosixAccount: c.config.SshTunnel.AccountName,
+		TunnelTo:     c.config.SshTunnel.TunnelTo,
+		RemoteSocket: c.config.SshTunnel.RemoteSocket,
+	})
+
+	if c.sessionFailed {
+		c.stats.AddReconnect()
+		c.sessionFailed = false
+	}
+
+	return client, nil
 }
 
-// This method starts the underlying SSH session. It sets the c.client field
-// so it requires a pointer receiver.
-func (c *SshTunnel) init() (*ssh.Client, error) {
-	var pkFile string
+// closeClients closes the current SSH session, if there is one, starting from the client furthest away.  The
+// caller must hold c.mu.
+func (c *SshTunnel) closeClients() {
+	for i := len(c.clients) - 1; i >= 0; i-- {
+		_ = c.clients[i].Close()
+	}
+
+	c.clients = nil
+	c.client = nil
+}
 
+// dropSession closes the SSH session if client still belongs to it.  Another connection may already have
+// started a new session, which is left alone.
+func (c *SshTunnel) dropSession(client *ssh.Client) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if c.config.SshTunnel.PrivateKeyFile == "" {
+	if c.client != client {
+		return
+	}
+
+	c.logger.Warn("closing SSH session that failed so the next connection starts a new one")
+	c.closeClients()
+	c.sessionFailed = true
+}
+
+// clientConfig builds the SSH client configuration for a single hop.
+func (c *SshTunnel) clientConfig(
+	accountName string, pkFile string, hostKeyCallback ssh.HostKeyCallback,
+) (*ssh.ClientConfig, error) {
+	if pkFile == "" {
 		pkFile = filepath.Join(os.Getenv("HOME"), ".ssh", "google_compute_engine")
-	} else {
-		pkFile = c.config.SshTunnel.PrivateKeyFile
 	}
 
 	c.logger.Debug("private key path", "pkFile", pkFile)
@@ -103,32 +276,127 @@ func (c *SshTunnel) init() (*ssh.Client, error) {
 		return nil, fmt.Errorf("%w: %w", constants.ErrInvalidPrivateKeyFile, err)
 	}
 
-	// This disables normal checking to ensure that the host you are connecting matches the host recorded
-	// in known_hosts.  But in our case we are connecting via an IAP tunnel so the host is already trusted.
-	hostKeyCallback := ssh.InsecureIgnoreHostKey()
-
 	algorithms := ssh.SupportedAlgorithms()
-	cfg := &ssh.ClientConfig{
+
+	return &ssh.ClientConfig{
 		Config: ssh.Config{
 			KeyExchanges: algorithms.KeyExchanges,
 			Ciphers:      algorithms.Ciphers,
 			MACs:         algorithms.MACs,
 		},
-		User: c.config.SshTunnel.AccountName,
+		User: accountName,
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
 		},
 		HostKeyCallback:   hostKeyCallback,
 		HostKeyAlgorithms: algorithms.HostKeys,
+	}, nil
+}
+
+// hopHostKeyCallback returns the callback that checks a hop's host key.  The key given by host_key is used
+// if it is set, otherwise the key is looked up in the known_hosts file.
+func hopHostKeyCallback(hop config.SshHopCfg) (ssh.HostKeyCallback, error) {
+	if hop.HostKey != "" {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hop.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", constants.ErrInvalidSshHostKey, err)
+		}
+
+		return ssh.FixedHostKey(key), nil
 	}
 
-	c.logger.Debug("starting ssh tunnel", "destPort", c.destPort)
+	knownHostsFile := hop.KnownHosts
+	if knownHostsFile == "" {
+		knownHostsFile = filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+	}
 
-	// Any error from sshDial() is hendled in the calling function.
-	return c.sshDial("tcp", fmt.Sprintf("%s:%d", "localhost", c.destPort), cfg)
+	callback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", constants.ErrFailedToReadKnownHosts, err)
+	}
+
+	return callback, nil
+}
+
+// dialHop opens a TCP connection to the hop via the previous client and starts a new SSH session over it.
+func (c *SshTunnel) dialHop(prev *ssh.Client, hop config.SshHopCfg, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	port := hop.Port
+	if port == 0 {
+		port = 22
+	}
+
+	addr := net.JoinHostPort(hop.Host, strconv.Itoa(port))
+
+	c.logger.Debug("dialling ssh hop", "addr", addr, "AccountName", cfg.User)
+
+	conn, err := prev.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		_ = conn.Close()
+
+		return nil, err
+	}
+
+	return ssh.NewClient(clientConn, chans, reqs), nil
 }
 
-func (c *SshTunnel) loop(ctx context.Context, client *ssh.Client) {
+// sessionClient returns the client for the current SSH session.  If there is no session, because the tunnel
+// is lazy or the session was closed for being idle or after failing, then a new one is started.
+func (c *SshTunnel) sessionClient(ctx context.Context) (*ssh.Client, error) {
+	c.mu.Lock()
+	client := c.client
+	c.mu.Unlock()
+
+	if client != nil {
+		return client, nil
+	}
+
+	c.logger.Info("starting SSH session for new connection")
+
+	client, err := c.init(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", constants.ErrSshDialFailed, err)
+	}
+
+	return client, nil
+}
+
+// closeWhenIdle closes the SSH session of a lazy tunnel once there have been no connections for
+// lazy_idle_timeout.  The next connection starts a new session.
+func (c *SshTunnel) closeWhenIdle(ctx context.Context) {
+	timeout := c.config.LazyIdleTimeout
+
+	ticker := time.NewTicker(min(timeout, lazyCheckInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		if c.client != nil && c.stats.ActiveCount() == 0 && time.Since(c.lastUsed) >= timeout {
+			c.logger.Info("closing SSH session because there have been no connections", "lazyIdleTimeout", timeout)
+			c.closeClients()
+		}
+		c.mu.Unlock()
+	}
+}
+
+// markUsed records that a connection has been accepted or has finished, for closeWhenIdle.
+func (c *SshTunnel) markUsed() {
+	c.mu.Lock()
+	c.lastUsed = time.Now()
+	c.mu.Unlock()
+}
+
+func (c *SshTunnel) loop(ctx context.Context) {
 	for {
 		localConn, err := c.Listener.Accept()
 		if err != nil {
@@ -145,30 +413,91 @@ func (c *SshTunnel) loop(ctx context.Context, client *ssh.Client) {
 
 		c.logger.Debug("SSH tunnel listener accepted a connection", "localPort", c.localPort)
 
-		tunnelConn, err := c.dialSshTunnel(client)
+		c.markUsed()
+
+		connCtx := tracing.ConnContext(ctx, localConn)
+
+		client, err := c.sessionClient(connCtx)
+		if err != nil {
+			c.logger.Error("failed to start ssh session", "err", err)
+			c.stats.AddSshDialFailure()
+			c.reject(localConn, err)
+
+			continue
+		}
+
+		tunnelConn, err := c.dialSshTunnel(connCtx, client)
 		if err != nil {
 			c.logger.Error("error dialing ssh tunnel", "err", err)
+			c.stats.AddSshDialFailure()
+			c.reject(localConn, err)
+
+			// If the remote side refused the channel then the SSH session is fine.  Any other error means
+			// that the session has probably dropped (e.g., because the IAP websocket closed), so close it
+			// and let the next connection start a new one.
+			var openErr *ssh.OpenChannelError
+			if !errors.As(err, &openErr) {
+				c.dropSession(client)
+			}
 
-			return
+			continue
 		}
 
+		stats.Connected(localConn, nil)
+
 		c.logger.Debug(
 			"successfully dialled ssh tunnel",
 			"TunnelTo", c.config.SshTunnel.TunnelTo,
 			"remotePort", c.config.RemotePort,
+			"remoteSocket", c.config.SshTunnel.RemoteSocket,
 		)
 
 		go func() {
-			err1, err2 := NewHandler(localConn, tunnelConn, c.logger).Handle()
+			handlerOpts := HandlerOptions{
+				IdleTimeout: c.config.ConnectionIdleTimeout,
+				MaxLifetime: c.config.ConnectionMaxLifetime,
+				BufferPool:  c.bufferPool,
+			}
+
+			err1, err2 := NewHandler(localConn, tunnelConn, handlerOpts, c.logger).Handle()
 			c.logger.Debug("handler exited", "local conn error", err1, "tunnel conn error", err2)
+
+			c.markUsed()
 		}()
 	}
 }
 
+// reject closes a local connection that could not be forwarded.
+func (c *SshTunnel) reject(localConn net.Conn, err error) {
+	stats.Connected(localConn, err)
+
+	if !stats.IsProbe(localConn) {
+		c.stats.AddFailed()
+	}
+
+	if tc, ok := localConn.(*tracing.Conn); ok {
+		tc.Fail(err)
+	}
+
+	_ = localConn.Close()
+}
+
+// dialSshTunnel opens a channel to the remote side of the forward.  This is either tunnel_to:remote_port or,
+// if remote_socket is set, a Unix domain socket using the direct-streamlocal@openssh.com channel type.
 func (c *SshTunnel) dialSshTunnel(
+	ctx context.Context,
 	client *ssh.Client,
-) (net.Conn, error) {
-	conn, err := client.DialTCP("tcp", nil, &net.TCPAddr{IP: net.ParseIP(c.config.SshTunnel.TunnelTo), Port: c.config.RemotePort})
+) (conn net.Conn, err error) {
+	_, span := tracing.Tracer().Start(ctx, "ssh.dial", trace.WithSpanKind(trace.SpanKindClient))
+	defer span.End()
+	defer func() { _ = tracing.RecordError(span, err) }()
+
+	if c.config.SshTunnel.RemoteSocket != "" {
+		conn, err = client.Dial("unix", c.config.SshTunnel.RemoteSocket)
+	} else {
+		conn, err = client.DialTCP("tcp", nil, &net.TCPAddr{IP: net.ParseIP(c.config.SshTunnel.TunnelTo), Port: c.config.RemotePort})
+	}
+
 	if err != nil {
 		return conn, fmt.Errorf("error starting ssh tunnel: %w", err)
 	}
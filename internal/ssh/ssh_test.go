@@ -2,22 +2,31 @@ package ssh
 
 import (
 	"context"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"net"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/LaoZhuBaba/iapgo/v2/internal/audit"
 	"github.com/LaoZhuBaba/iapgo/v2/internal/config"
 	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 func test_sshDialerReturnsErr(s1 string, s2 string, config *ssh.ClientConfig) (*ssh.Client, error) {
@@ -174,6 +183,37 @@ func TestSshTunnel_Start(t *testing.T) {
 			},
 			wantErr: constants.ErrSshDialFailed,
 		},
+		{
+			name: "ssh_hop_missing_private_key_file",
+			fields: fields{
+				destPort:  100,
+				localPort: 200,
+				logger:    logger,
+				Listener:  nil,
+				sshDial:   test_sshDialerReturnsNoErr,
+				config: &config.Config{
+					ProjectID:  "project-id",
+					Zone:       "zone",
+					Instance:   "instance",
+					RemotePort: 100,
+					LocalPort:  200,
+					RemoteNic:  "remote-nic",
+					SshTunnel: &config.SshTunnelCfg{
+						TunnelTo:       "tunnel-to",
+						AccountName:    "account-name",
+						PrivateKeyFile: privateKeyFilename,
+						Hops: []config.SshHopCfg{
+							{Host: "hop1", KnownHosts: "testdata/empty_file"},
+							{Host: "hop2", KnownHosts: "testdata/empty_file", PrivateKeyFile: "does-not-exist"},
+						},
+					},
+				},
+			},
+			args: args{
+				ctx: context.Background(),
+			},
+			wantErr: constants.ErrPrivateKeyFileNotFound,
+		},
 		{
 			name: "ssh_client_succeeds",
 			fields: fields{
@@ -221,3 +261,654 @@ func TestSshTunnel_Start(t *testing.T) {
 		})
 	}
 }
+
+// testSshServer is a minimal SSH server that accepts any public key and supports direct-tcpip channels.
+// Each channel target is recorded so that tests can check which server was used to reach which host.
+type testSshServer struct {
+	mu       sync.Mutex
+	port     int
+	hostKey  ssh.PublicKey
+	listener net.Listener
+	targets  []string
+	sessions int
+}
+
+func startTestSshServer(t *testing.T) *testSshServer {
+	t.Helper()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate host key: %v", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatalf("failed to create host key signer: %v", err)
+	}
+
+	serverCfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	serverCfg.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	s := &testSshServer{
+		listener: listener,
+		port:     listener.Addr().(*net.TCPAddr).Port,
+		hostKey:  signer.PublicKey(),
+	}
+
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go s.serve(conn, serverCfg)
+		}
+	}()
+
+	return s
+}
+
+func (s *testSshServer) serve(conn net.Conn, serverCfg *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, serverCfg)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.sessions++
+	s.mu.Unlock()
+
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		var network, target string
+
+		switch newChannel.ChannelType() {
+		case "direct-tcpip":
+			var payload struct {
+				Host     string
+				Port     uint32
+				OrigHost string
+				OrigPort uint32
+			}
+
+			if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+				_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+
+				continue
+			}
+
+			network = "tcp"
+			target = net.JoinHostPort(payload.Host, fmt.Sprintf("%d", payload.Port))
+
+		case "direct-streamlocal@openssh.com":
+			var payload struct {
+				SocketPath string
+				Reserved0  string
+				Reserved1  uint32
+			}
+
+			if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+				_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+
+				continue
+			}
+
+			network = "unix"
+			target = payload.SocketPath
+
+		default:
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+
+			continue
+		}
+
+		s.mu.Lock()
+		s.targets = append(s.targets, target)
+		s.mu.Unlock()
+
+		targetConn, err := net.Dial(network, target)
+		if err != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+
+			continue
+		}
+
+		channel, chReqs, err := newChannel.Accept()
+		if err != nil {
+			_ = targetConn.Close()
+
+			continue
+		}
+
+		go ssh.DiscardRequests(chReqs)
+
+		go func() {
+			_, _ = io.Copy(channel, targetConn)
+			_ = channel.Close()
+		}()
+
+		go func() {
+			_, _ = io.Copy(targetConn, channel)
+			_ = targetConn.Close()
+		}()
+	}
+}
+
+func (s *testSshServer) getSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sessions
+}
+
+func (s *testSshServer) getTargets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string(nil), s.targets...)
+}
+
+func startEchoServer(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	serveEcho(t, listener)
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func startUnixEchoServer(t *testing.T) string {
+	t.Helper()
+
+	socketPath := filepath.Join(t.TempDir(), "echo.sock")
+
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	serveEcho(t, listener)
+
+	return socketPath
+}
+
+func serveEcho(t *testing.T, listener net.Listener) {
+	t.Helper()
+
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+}
+
+// checkEcho writes test data to the tunnel listener and checks that it is echoed back.
+func checkEcho(t *testing.T, listener net.Listener) {
+	t.Helper()
+
+	conn, err := net.Dial(listener.Addr().Network(), listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial tunnel listener: %v", err)
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	if _, err := conn.Write(testData1); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	got := make([]byte, len(testData1))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+
+	if string(got) != string(testData1) {
+		t.Errorf("got %q, want %q", got, testData1)
+	}
+}
+
+func TestSshTunnel_StartWithHops(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	jumpBox := startTestSshServer(t)
+	bastion := startTestSshServer(t)
+	echoPort := startEchoServer(t)
+
+	cfg := &config.Config{
+		RemotePort: echoPort,
+		SshTunnel: &config.SshTunnelCfg{
+			TunnelTo:       "127.0.0.1",
+			AccountName:    "account-name",
+			PrivateKeyFile: privateKeyFilename,
+			Hops: []config.SshHopCfg{
+				{Host: "127.0.0.1", Port: bastion.port, HostKey: string(ssh.MarshalAuthorizedKey(bastion.hostKey))},
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewSshTunnel(cfg, ssh.Dial, jumpBox.port, 0, stats.New("test"), nil, logger)
+	if err := c.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	defer func() { _ = c.Listener.Close() }()
+
+	checkEcho(t, c.Listener)
+
+	bastionAddr := net.JoinHostPort("127.0.0.1", fmt.Sprintf("%d", bastion.port))
+	if targets := jumpBox.getTargets(); len(targets) != 1 || targets[0] != bastionAddr {
+		t.Errorf("jump box targets = %v, want [%s]", targets, bastionAddr)
+	}
+
+	echoAddr := net.JoinHostPort("127.0.0.1", fmt.Sprintf("%d", echoPort))
+	if targets := bastion.getTargets(); len(targets) != 1 || targets[0] != echoAddr {
+		t.Errorf("bastion targets = %v, want [%s]", targets, echoAddr)
+	}
+}
+
+func TestSshTunnel_HopHostKey(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	jumpBox := startTestSshServer(t)
+	bastion := startTestSshServer(t)
+	echoPort := startEchoServer(t)
+
+	bastionAddr := net.JoinHostPort("127.0.0.1", fmt.Sprintf("%d", bastion.port))
+
+	writeKnownHosts := func(lines ...string) string {
+		t.Helper()
+
+		path := filepath.Join(t.TempDir(), "known_hosts")
+
+		var content string
+		for _, line := range lines {
+			content += line + "\n"
+		}
+
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("failed to write known_hosts: %v", err)
+		}
+
+		return path
+	}
+
+	tests := []struct {
+		name    string
+		hop     config.SshHopCfg
+		wantErr error
+	}{
+		{
+			name: "known_hosts",
+			hop: config.SshHopCfg{
+				KnownHosts: writeKnownHosts(knownhosts.Line([]string{bastionAddr}, bastion.hostKey)),
+			},
+			wantErr: nil,
+		},
+		{
+			name: "not_in_known_hosts",
+			hop: config.SshHopCfg{
+				KnownHosts: writeKnownHosts(),
+			},
+			wantErr: constants.ErrSshHopDialFailed,
+		},
+		{
+			name: "wrong_host_key",
+			hop: config.SshHopCfg{
+				HostKey: string(ssh.MarshalAuthorizedKey(jumpBox.hostKey)),
+			},
+			wantErr: constants.ErrSshHopDialFailed,
+		},
+		{
+			name: "invalid_host_key",
+			hop: config.SshHopCfg{
+				HostKey: "not a key",
+			},
+			wantErr: constants.ErrInvalidSshHostKey,
+		},
+		{
+			name: "missing_known_hosts",
+			hop: config.SshHopCfg{
+				KnownHosts: filepath.Join(t.TempDir(), "missing"),
+			},
+			wantErr: constants.ErrFailedToReadKnownHosts,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hop := tt.hop
+			hop.Host = "127.0.0.1"
+			hop.Port = bastion.port
+
+			cfg := &config.Config{
+				RemotePort: echoPort,
+				SshTunnel: &config.SshTunnelCfg{
+					TunnelTo:       "127.0.0.1",
+					AccountName:    "account-name",
+					PrivateKeyFile: privateKeyFilename,
+					Hops:           []config.SshHopCfg{hop},
+				},
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			c := NewSshTunnel(cfg, ssh.Dial, jumpBox.port, 0, stats.New("test"), nil, logger)
+
+			err := c.Start(ctx)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Start() error = %v, want %v", err, tt.wantErr)
+			}
+
+			if err == nil {
+				defer func() { _ = c.Listener.Close() }()
+
+				checkEcho(t, c.Listener)
+			}
+		})
+	}
+}
+
+func TestSshTunnel_StartWithRemoteSocket(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	jumpBox := startTestSshServer(t)
+	socketPath := startUnixEchoServer(t)
+
+	cfg := &config.Config{
+		SshTunnel: &config.SshTunnelCfg{
+			RemoteSocket:   socketPath,
+			AccountName:    "account-name",
+			PrivateKeyFile: privateKeyFilename,
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewSshTunnel(cfg, ssh.Dial, jumpBox.port, 0, stats.New("test"), nil, logger)
+	if err := c.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	defer func() { _ = c.Listener.Close() }()
+
+	checkEcho(t, c.Listener)
+
+	if targets := jumpBox.getTargets(); len(targets) != 1 || targets[0] != socketPath {
+		t.Errorf("jump box targets = %v, want [%s]", targets, socketPath)
+	}
+}
+
+func TestSshTunnel_Stats(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	jumpBox := startTestSshServer(t)
+	echoPort := startEchoServer(t)
+
+	cfg := &config.Config{
+		RemotePort: echoPort,
+		SshTunnel: &config.SshTunnelCfg{
+			TunnelTo:       "127.0.0.1",
+			AccountName:    "account-name",
+			PrivateKeyFile: privateKeyFilename,
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tunnelStats := stats.New("test")
+
+	c := NewSshTunnel(cfg, ssh.Dial, jumpBox.port, 0, tunnelStats, nil, logger)
+	if err := c.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	defer func() { _ = c.Listener.Close() }()
+
+	checkEcho(t, c.Listener)
+	checkEcho(t, c.Listener)
+
+	// The byte counts are updated just after the data is written, so allow them a moment to catch up.
+	var snap stats.Snapshot
+
+	for i := 0; i < 100; i++ {
+		snap = tunnelStats.Snapshot()
+		if snap.BytesFromRemote == uint64(2*len(testData1)) {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if snap.TotalConnections != 2 || snap.FailedConnections != 0 {
+		t.Errorf("stats = %+v, want 2 connections and no failures", snap)
+	}
+
+	if snap.BytesToRemote != uint64(2*len(testData1)) || snap.BytesFromRemote != uint64(2*len(testData1)) {
+		t.Errorf("stats = %+v, want %d bytes in each direction", snap, 2*len(testData1))
+	}
+}
+
+func TestSshTunnel_NewSessionAfterSessionDrops(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	jumpBox := startTestSshServer(t)
+	echoPort := startEchoServer(t)
+
+	cfg := &config.Config{
+		RemotePort: echoPort,
+		SshTunnel: &config.SshTunnelCfg{
+			TunnelTo:       "127.0.0.1",
+			AccountName:    "account-name",
+			PrivateKeyFile: privateKeyFilename,
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tunnelStats := stats.New("test")
+
+	c := NewSshTunnel(cfg, ssh.Dial, jumpBox.port, 0, tunnelStats, nil, logger)
+	if err := c.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	defer func() { _ = c.Listener.Close() }()
+
+	checkEcho(t, c.Listener)
+
+	// Simulate the SSH session dropping.  The next connection fails but the listener keeps accepting.
+	c.mu.Lock()
+	_ = c.clients[0].Close()
+	c.mu.Unlock()
+
+	conn, err := net.Dial(c.Listener.Addr().Network(), c.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial tunnel listener: %v", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("Read() error = %v, want %v", err, io.EOF)
+	}
+
+	_ = conn.Close()
+
+	// The failed session was closed so this connection starts a new one.
+	checkEcho(t, c.Listener)
+
+	if sessions := jumpBox.getSessions(); sessions != 2 {
+		t.Errorf("sessions = %d, want 2", sessions)
+	}
+
+	if snap := tunnelStats.Snapshot(); snap.FailedConnections != 1 || snap.SshDialFailures != 1 || snap.Reconnects != 1 {
+		t.Errorf("stats = %+v, want 1 failed connection, 1 SSH dial failure and 1 reconnect", snap)
+	}
+}
+
+func TestSshTunnel_Lazy(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	jumpBox := startTestSshServer(t)
+	echoPort := startEchoServer(t)
+
+	cfg := &config.Config{
+		RemotePort:      echoPort,
+		Lazy:            true,
+		LazyIdleTimeout: 200 * time.Millisecond,
+		SshTunnel: &config.SshTunnelCfg{
+			TunnelTo:       "127.0.0.1",
+			AccountName:    "account-name",
+			PrivateKeyFile: privateKeyFilename,
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tunnelStats := stats.New("test")
+
+	c := NewSshTunnel(cfg, ssh.Dial, jumpBox.port, 0, tunnelStats, nil, logger)
+	if err := c.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	defer func() { _ = c.Listener.Close() }()
+
+	if sessions := jumpBox.getSessions(); sessions != 0 {
+		t.Fatalf("sessions before the first connection = %d, want 0", sessions)
+	}
+
+	checkEcho(t, c.Listener)
+	checkEcho(t, c.Listener)
+
+	if sessions := jumpBox.getSessions(); sessions != 1 {
+		t.Fatalf("sessions after two connections = %d, want 1", sessions)
+	}
+
+	// Wait for the session to be closed for being idle.  The next connection should start a new one.
+	for i := 0; i < 100; i++ {
+		c.mu.Lock()
+		closed := c.client == nil
+		c.mu.Unlock()
+
+		if closed {
+			break
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	checkEcho(t, c.Listener)
+
+	if sessions := jumpBox.getSessions(); sessions != 2 {
+		t.Errorf("sessions after the idle timeout = %d, want 2", sessions)
+	}
+
+	// Starting a session again after the idle timeout is not a reconnect.
+	if snap := tunnelStats.Snapshot(); snap.Reconnects != 0 {
+		t.Errorf("stats = %+v, want no reconnects", snap)
+	}
+}
+
+func TestSshTunnel_LazyAudit(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	jumpBox := startTestSshServer(t)
+	echoPort := startEchoServer(t)
+
+	cfg := &config.Config{
+		RemotePort: echoPort,
+		Lazy:       true,
+		SshTunnel: &config.SshTunnelCfg{
+			TunnelTo:       "127.0.0.1",
+			AccountName:    "account-name",
+			PrivateKeyFile: privateKeyFilename,
+		},
+	}
+
+	auditPath := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	auditLog, err := audit.Open(auditPath, "test", logger)
+	if err != nil {
+		t.Fatalf("audit.Open() error = %v", err)
+	}
+
+	defer func() { _ = auditLog.Close() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := NewSshTunnel(cfg, ssh.Dial, jumpBox.port, 0, stats.New("test"), auditLog, logger)
+	if err := c.Start(ctx); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	defer func() { _ = c.Listener.Close() }()
+
+	sshSessionStarts := func() []audit.Record {
+		t.Helper()
+
+		data, err := os.ReadFile(auditPath)
+		if err != nil {
+			t.Fatalf("failed to read audit log: %v", err)
+		}
+
+		var recs []audit.Record
+
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var rec audit.Record
+			if err := json.Unmarshal([]byte(line), &rec); err == nil && rec.Event == audit.EventSshSessionStart {
+				recs = append(recs, rec)
+			}
+		}
+
+		return recs
+	}
+
+	// The session, and so the account, is not set up until the first connection.
+	if recs := sshSessionStarts(); len(recs) != 0 {
+		t.Fatalf("ssh_session_start records before the first connection = %+v, want none", recs)
+	}
+
+	checkEcho(t, c.Listener)
+
+	recs := sshSessionStarts()
+	if len(recs) != 1 || recs[0].PosixAccount != "account-name" || recs[0].TunnelTo != "127.0.0.1" {
+		t.Errorf("ssh_session_start records = %+v, want one for account-name", recs)
+	}
+}
@@ -0,0 +1,142 @@
+package stats
+
+import (
+	"net"
+	"sync"
+)
+
+// ProbeConn is a local connection made by the readiness probe.  It is passed on by Stats.Listener without
+// being tracked so that the probe does not show up as a client.
+type ProbeConn struct {
+	net.Conn
+	// result receives the outcome of connecting the probe through to the remote service.
+	result     chan<- error
+	resultOnce sync.Once
+}
+
+// IsProbe always returns true.
+func (c *ProbeConn) IsProbe() bool {
+	return true
+}
+
+// NetConn returns the probe's connection.
+func (c *ProbeConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Connected passes the outcome of connecting the probe through to the remote service on to the probe,
+// which cannot tell from its own end because the local listener accepts connections before the remote side
+// is dialled.  err is nil if the connection succeeded.  Only the first outcome is passed on.
+func (c *ProbeConn) Connected(err error) {
+	c.resultOnce.Do(func() {
+		if c.result != nil {
+			c.result <- err
+		}
+	})
+}
+
+// Close closes the connection, which counts as a failure to connect if no outcome has been passed on yet.
+func (c *ProbeConn) Close() error {
+	c.Connected(net.ErrClosed)
+
+	return c.Conn.Close()
+}
+
+// IsProbe reports whether conn, or a connection that it wraps, was made by the readiness probe.
+func IsProbe(conn net.Conn) bool {
+	for conn != nil {
+		if p, ok := conn.(Prober); ok {
+			return p.IsProbe()
+		}
+
+		wrapper, ok := conn.(Wrapper)
+		if !ok {
+			return false
+		}
+
+		conn = wrapper.NetConn()
+	}
+
+	return false
+}
+
+// Connected is called once conn has been connected through to the remote service, or has failed to be with
+// err.  If conn, or a connection that it wraps, is a *ProbeConn then the outcome is passed on to the
+// readiness probe.
+func Connected(conn net.Conn, err error) {
+	for conn != nil {
+		if p, ok := conn.(*ProbeConn); ok {
+			p.Connected(err)
+
+			return
+		}
+
+		wrapper, ok := conn.(Wrapper)
+		if !ok {
+			return
+		}
+
+		conn = wrapper.NetConn()
+	}
+}
+
+// StartProbe is called by the readiness probe before it dials the local listener.  Until EndProbe is called
+// the listener holds on to connections that it accepts, because one of them may be the probe's.
+func (s *Stats) StartProbe() {
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+
+	s.probesDialling++
+}
+
+// EndProbe is called by the readiness probe once its dial has finished, with the local address of the
+// connection or nil if the dial failed.  The connection accepted from that address is the probe's.  The
+// returned channel receives the outcome of connecting it through to the remote service, and is nil if addr
+// is nil.
+func (s *Stats) EndProbe(addr net.Addr) <-chan error {
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+
+	var result chan error
+
+	if addr != nil {
+		// Unix domain socket clients normally have no name and so all share the same address.  This can
+		// only mistake a client for the probe if both connect at once.
+		result = make(chan error, 1)
+		s.probeAddrs[addr.String()] = append(s.probeAddrs[addr.String()], result)
+	}
+
+	s.probesDialling--
+	s.probeDone.Broadcast()
+
+	return result
+}
+
+// matchProbe returns conn as a *ProbeConn if it was accepted from the address of a readiness probe
+// connection, waiting for any probe that is still dialling to report its address first.
+func (s *Stats) matchProbe(conn net.Conn) (*ProbeConn, bool) {
+	s.probeMu.Lock()
+	defer s.probeMu.Unlock()
+
+	for s.probesDialling > 0 {
+		s.probeDone.Wait()
+	}
+
+	var peer string
+	if addr := conn.RemoteAddr(); addr != nil {
+		peer = addr.String()
+	}
+
+	results := s.probeAddrs[peer]
+	if len(results) == 0 {
+		return nil, false
+	}
+
+	if len(results) == 1 {
+		delete(s.probeAddrs, peer)
+	} else {
+		s.probeAddrs[peer] = results[1:]
+	}
+
+	return &ProbeConn{Conn: conn, result: results[0]}, true
+}
@@ -0,0 +1,106 @@
+package stats
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListener_Probe(t *testing.T) {
+	tests := []struct {
+		name    string
+		network string
+		address string
+	}{
+		{
+			name:    "tcp",
+			network: "tcp",
+			address: "127.0.0.1:0",
+		},
+		{
+			name:    "unix",
+			network: "unix",
+			address: filepath.Join(t.TempDir(), "probe.sock"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("db")
+
+			lsnr, err := net.Listen(tt.network, tt.address)
+			if err != nil {
+				t.Fatalf("failed to listen: %v", err)
+			}
+
+			tracked := s.Listener(lsnr)
+			defer func() { _ = tracked.Close() }()
+
+			// A client connects while the probe is dialling.  Accept waits for the probe to report its
+			// address before deciding which connection is which.
+			s.StartProbe()
+
+			client, err := net.Dial(tt.network, lsnr.Addr().String())
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+
+			defer func() { _ = client.Close() }()
+
+			accepted := make(chan net.Conn, 2)
+
+			go func() {
+				for range 2 {
+					conn, err := tracked.Accept()
+					if err != nil {
+						return
+					}
+
+					accepted <- conn
+				}
+			}()
+
+			select {
+			case conn := <-accepted:
+				t.Fatalf("Accept() returned %v before the probe finished dialling", conn.RemoteAddr())
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			s.EndProbe(nil)
+			s.StartProbe()
+
+			probe, err := net.Dial(tt.network, lsnr.Addr().String())
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+
+			defer func() { _ = probe.Close() }()
+
+			s.EndProbe(probe.LocalAddr())
+
+			var probes int
+
+			for range 2 {
+				select {
+				case conn := <-accepted:
+					if IsProbe(conn) {
+						probes++
+					}
+
+					defer func() { _ = conn.Close() }()
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for Accept()")
+				}
+			}
+
+			if probes != 1 {
+				t.Errorf("accepted %d probe connections, want 1", probes)
+			}
+
+			if snap := s.Snapshot(); snap.TotalConnections != 1 || snap.ActiveConnections != 1 {
+				t.Errorf("Snapshot() = %+v, want 1 total and 1 active connection", snap)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+)
+
+// Serve writes a JSON snapshot to each connection accepted by lsnr and then closes it.  It returns when
+// lsnr is closed.
+func (s *Stats) Serve(lsnr net.Listener, logger *slog.Logger) {
+	for {
+		conn, err := lsnr.Accept()
+		if err != nil {
+			return
+		}
+
+		_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+
+		err = json.NewEncoder(conn).Encode(s.Snapshot())
+		if err != nil {
+			logger.Debug("failed to send stats", "error", err)
+		}
+
+		_ = conn.Close()
+	}
+}
+
+// Fetch reads a snapshot from a socket served by Serve.
+func Fetch(socketPath string) (*Snapshot, error) {
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", constants.ErrFailedToFetchStats, err)
+	}
+
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	var snap Snapshot
+
+	err = json.NewDecoder(conn).Decode(&snap)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", constants.ErrFailedToFetchStats, err)
+	}
+
+	return &snap, nil
+}
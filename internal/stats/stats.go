@@ -0,0 +1,346 @@
+package stats
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// idlePollInterval is how often WaitIdle checks the number of active connections.
+const idlePollInterval = 100 * time.Millisecond
+
+// Stats tracks the connections made through a tunnel.  The zero value is not usable, so use New.
+type Stats struct {
+	section string
+	started time.Time
+
+	mu     sync.Mutex
+	nextID uint64
+	active map[uint64]*Conn
+
+	totalConns      atomic.Uint64
+	failedConns     atomic.Uint64
+	reconnects      atomic.Uint64
+	sshDialFailures atomic.Uint64
+	// readiness holds the time taken for the readiness probe to succeed, in nanoseconds.
+	readiness atomic.Int64
+	// These hold the bytes for connections that have closed.  Active connections are added by Snapshot.
+	closedToRemote   atomic.Uint64
+	closedFromRemote atomic.Uint64
+
+	// These match connections made by the readiness probe.  probeAddrs holds the result channel of each
+	// probe connection that has not been accepted yet, by its local address.
+	probeMu        sync.Mutex
+	probeDone      *sync.Cond
+	probesDialling int
+	probeAddrs     map[string][]chan error
+}
+
+// Conn wraps a local connection and counts the bytes read from it (sent to the remote service) and
+// written to it (received from the remote service).  It is removed from the active connections when it
+// is closed.
+type Conn struct {
+	net.Conn
+	stats       *Stats
+	id          uint64
+	peer        string
+	started     time.Time
+	toRemote    atomic.Uint64
+	fromRemote  atomic.Uint64
+	closeOnce   sync.Once
+	closeResult error
+}
+
+// ByteCounter is implemented by connections that count the bytes passing through them.  *Conn implements it,
+// and so do the wrappers that other packages put around a *Conn so that its counts can still be read.
+type ByteCounter interface {
+	BytesToRemote() uint64
+	BytesFromRemote() uint64
+}
+
+// Prober is implemented by connections that know whether they were made by the readiness probe.
+type Prober interface {
+	IsProbe() bool
+}
+
+// Wrapper is implemented by connections that wrap another connection, such as *Conn, so that the
+// connections inside can be reached.
+type Wrapper interface {
+	NetConn() net.Conn
+}
+
+// Snapshot is a point in time copy of the statistics which can be encoded as JSON.
+type Snapshot struct {
+	Section           string    `json:"section"`
+	Started           time.Time `json:"started"`
+	UptimeSeconds     float64   `json:"uptime_seconds"`
+	ActiveConnections int       `json:"active_connections"`
+	TotalConnections  uint64    `json:"total_connections"`
+	FailedConnections uint64    `json:"failed_connections"`
+	Reconnects        uint64    `json:"reconnects"`
+	SshDialFailures   uint64    `json:"ssh_dial_failures"`
+	BytesToRemote     uint64    `json:"bytes_to_remote"`
+	BytesFromRemote   uint64    `json:"bytes_from_remote"`
+	// ReadinessSeconds is zero unless a readiness probe has succeeded.
+	ReadinessSeconds float64        `json:"readiness_seconds,omitempty"`
+	Connections      []ConnSnapshot `json:"connections"`
+}
+
+// ConnSnapshot describes an active connection.
+type ConnSnapshot struct {
+	ID              uint64    `json:"id"`
+	Peer            string    `json:"peer"`
+	Started         time.Time `json:"started"`
+	BytesToRemote   uint64    `json:"bytes_to_remote"`
+	BytesFromRemote uint64    `json:"bytes_from_remote"`
+}
+
+// New returns an empty Stats for the given configuration section.  Uptime is measured from now.
+func New(section string) *Stats {
+	s := &Stats{
+		section:    section,
+		started:    time.Now(),
+		active:     make(map[uint64]*Conn),
+		probeAddrs: make(map[string][]chan error),
+	}
+	s.probeDone = sync.NewCond(&s.probeMu)
+
+	return s
+}
+
+// Track starts counting a newly accepted local connection.
+func (s *Stats) Track(conn net.Conn) *Conn {
+	peer := "-"
+	if addr := conn.RemoteAddr(); addr != nil && addr.String() != "" {
+		peer = addr.String()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	c := &Conn{Conn: conn, stats: s, id: s.nextID, peer: peer, started: time.Now()}
+	s.active[c.id] = c
+	s.totalConns.Add(1)
+
+	return c
+}
+
+// AddFailed counts a local connection that could not be connected to the remote service.  Callers skip
+// connections made by the readiness probe, which is expected to fail until the remote service is up.
+func (s *Stats) AddFailed() {
+	s.failedConns.Add(1)
+}
+
+// AddReconnect counts the tunnel connecting again after it failed.  For an SSH tunnel this is the SSH
+// session being started again, and otherwise it is a connection through IAP succeeding after others failed.
+func (s *Stats) AddReconnect() {
+	s.reconnects.Add(1)
+}
+
+// AddSshDialFailure counts a failure to start the SSH session or open an SSH channel to the remote
+// service.
+func (s *Stats) AddSshDialFailure() {
+	s.sshDialFailures.Add(1)
+}
+
+// SetReadinessLatency records how long the readiness probe took to succeed.
+func (s *Stats) SetReadinessLatency(d time.Duration) {
+	s.readiness.Store(int64(d))
+}
+
+// Listener wraps lsnr so that every connection that it accepts is tracked, apart from those made by the
+// readiness probe which are returned as a *ProbeConn.
+func (s *Stats) Listener(lsnr net.Listener) net.Listener {
+	return &listener{Listener: lsnr, stats: s}
+}
+
+// ActiveCount returns the number of local connections that are open.
+func (s *Stats) ActiveCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.active)
+}
+
+// TotalCount returns the number of local connections that have been accepted.
+func (s *Stats) TotalCount() uint64 {
+	return s.totalConns.Load()
+}
+
+// WaitIdle blocks until there are no active connections or ctx is done, in which case it returns the
+// context's error.
+func (s *Stats) WaitIdle(ctx context.Context) error {
+	ticker := time.NewTicker(idlePollInterval)
+	defer ticker.Stop()
+
+	for s.ActiveCount() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	return nil
+}
+
+// CloseActive closes every active connection and returns how many there were.  Closing the local side
+// makes the code copying data for the connection give up, so the upstream side is closed too.
+func (s *Stats) CloseActive() int {
+	s.mu.Lock()
+	conns := make([]*Conn, 0, len(s.active))
+
+	for _, c := range s.active {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	// Conn.Close takes the lock to remove itself so it cannot be called while the lock is held.
+	for _, c := range conns {
+		_ = c.Close()
+	}
+
+	return len(conns)
+}
+
+// Snapshot returns the current statistics with the active connections in the order they were accepted.
+func (s *Stats) Snapshot() Snapshot {
+	now := time.Now()
+
+	snap := Snapshot{
+		Section:           s.section,
+		Started:           s.started,
+		UptimeSeconds:     now.Sub(s.started).Seconds(),
+		TotalConnections:  s.totalConns.Load(),
+		FailedConnections: s.failedConns.Load(),
+		Reconnects:        s.reconnects.Load(),
+		SshDialFailures:   s.sshDialFailures.Load(),
+		ReadinessSeconds:  time.Duration(s.readiness.Load()).Seconds(),
+		Connections:       []ConnSnapshot{},
+	}
+
+	// The closed totals are read while holding the lock so that a connection closing at the same time is
+	// counted exactly once.
+	s.mu.Lock()
+	snap.BytesToRemote = s.closedToRemote.Load()
+	snap.BytesFromRemote = s.closedFromRemote.Load()
+
+	for _, c := range s.active {
+		cs := ConnSnapshot{
+			ID:              c.id,
+			Peer:            c.peer,
+			Started:         c.started,
+			BytesToRemote:   c.toRemote.Load(),
+			BytesFromRemote: c.fromRemote.Load(),
+		}
+
+		snap.BytesToRemote += cs.BytesToRemote
+		snap.BytesFromRemote += cs.BytesFromRemote
+		snap.Connections = append(snap.Connections, cs)
+	}
+	s.mu.Unlock()
+
+	snap.ActiveConnections = len(snap.Connections)
+
+	sort.Slice(snap.Connections, func(i, j int) bool { return snap.Connections[i].ID < snap.Connections[j].ID })
+
+	return snap
+}
+
+// WriteText writes a human readable summary of the snapshot followed by a table of active connections.
+func (snap Snapshot) WriteText(w io.Writer) error {
+	uptime := time.Duration(snap.UptimeSeconds * float64(time.Second)).Round(time.Second)
+
+	_, err := fmt.Fprintf(
+		w,
+		"section %s up %s: %d active, %d total and %d failed connections, %d reconnects, "+
+			"%d bytes to remote, %d bytes from remote\n",
+		snap.Section, uptime, snap.ActiveConnections, snap.TotalConnections, snap.FailedConnections,
+		snap.Reconnects, snap.BytesToRemote, snap.BytesFromRemote,
+	)
+	if err != nil || len(snap.Connections) == 0 {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "ID\tPEER\tDURATION\tTO REMOTE\tFROM REMOTE")
+
+	for _, c := range snap.Connections {
+		_, _ = fmt.Fprintf(
+			tw, "%d\t%s\t%s\t%d\t%d\n",
+			c.ID, c.Peer, time.Since(c.Started).Round(time.Second), c.BytesToRemote, c.BytesFromRemote,
+		)
+	}
+
+	return tw.Flush()
+}
+
+// BytesToRemote returns the number of bytes read from the local connection so far.
+func (c *Conn) BytesToRemote() uint64 {
+	return c.toRemote.Load()
+}
+
+// BytesFromRemote returns the number of bytes written to the local connection so far.
+func (c *Conn) BytesFromRemote() uint64 {
+	return c.fromRemote.Load()
+}
+
+// NetConn returns the connection being tracked.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.toRemote.Add(uint64(n))
+
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.fromRemote.Add(uint64(n))
+
+	return n, err
+}
+
+// Close closes the connection and moves its byte counts into the totals.  It is safe to call more than
+// once, which happens when both copy directions finish.
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeResult = c.Conn.Close()
+
+		c.stats.mu.Lock()
+		delete(c.stats.active, c.id)
+		c.stats.closedToRemote.Add(c.toRemote.Load())
+		c.stats.closedFromRemote.Add(c.fromRemote.Load())
+		c.stats.mu.Unlock()
+	})
+
+	return c.closeResult
+}
+
+type listener struct {
+	net.Listener
+	stats *Stats
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if probe, ok := l.stats.matchProbe(conn); ok {
+		return probe, nil
+	}
+
+	return l.stats.Track(conn), nil
+}
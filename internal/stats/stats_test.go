@@ -0,0 +1,169 @@
+package stats
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	s := New("db")
+
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	tracked := s.Listener(lsnr)
+	defer func() { _ = tracked.Close() }()
+
+	client, err := net.Dial("tcp", lsnr.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+
+	defer func() { _ = client.Close() }()
+
+	server, err := tracked.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+
+	// Reads from the local connection are sent to the remote service and writes come back from it.
+	_, _ = client.Write([]byte("hello"))
+	_, _ = io.ReadFull(server, make([]byte, 5))
+	_, _ = server.Write([]byte("hi"))
+
+	s.AddFailed()
+	s.AddReconnect()
+
+	snap := s.Snapshot()
+	if snap.Section != "db" || snap.ActiveConnections != 1 || snap.TotalConnections != 1 ||
+		snap.FailedConnections != 1 || snap.Reconnects != 1 {
+		t.Errorf("Snapshot() = %+v", snap)
+	}
+
+	if snap.BytesToRemote != 5 || snap.BytesFromRemote != 2 {
+		t.Errorf("Snapshot() bytes = %d to remote and %d from remote, want 5 and 2", snap.BytesToRemote, snap.BytesFromRemote)
+	}
+
+	if len(snap.Connections) != 1 || snap.Connections[0].Peer != client.LocalAddr().String() {
+		t.Errorf("Snapshot() connections = %+v, want peer %s", snap.Connections, client.LocalAddr())
+	}
+
+	var buf bytes.Buffer
+	if err := snap.WriteText(&buf); err != nil {
+		t.Fatalf("WriteText() error = %v", err)
+	}
+
+	if !strings.Contains(buf.String(), "1 active, 1 total") || !strings.Contains(buf.String(), client.LocalAddr().String()) {
+		t.Errorf("WriteText() = %s", buf.String())
+	}
+
+	// Closing twice must not count the bytes twice.
+	_ = server.Close()
+	_ = server.Close()
+
+	snap = s.Snapshot()
+	if snap.ActiveConnections != 0 || snap.BytesToRemote != 5 || snap.BytesFromRemote != 2 {
+		t.Errorf("Snapshot() after close = %+v", snap)
+	}
+}
+
+func TestWaitIdleAndCloseActive(t *testing.T) {
+	s := New("db")
+
+	lsnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	tracked := s.Listener(lsnr)
+	defer func() { _ = tracked.Close() }()
+
+	// With no connections WaitIdle returns straight away.
+	if err := s.WaitIdle(context.Background()); err != nil {
+		t.Fatalf("WaitIdle() error = %v", err)
+	}
+
+	for range 2 {
+		client, err := net.Dial("tcp", lsnr.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+
+		defer func() { _ = client.Close() }()
+
+		_, err = tracked.Accept()
+		if err != nil {
+			t.Fatalf("failed to accept: %v", err)
+		}
+	}
+
+	if got := s.ActiveCount(); got != 2 {
+		t.Fatalf("ActiveCount() = %d, want 2", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*idlePollInterval)
+	defer cancel()
+
+	if err := s.WaitIdle(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitIdle() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if got := s.CloseActive(); got != 2 {
+		t.Errorf("CloseActive() = %d, want 2", got)
+	}
+
+	if err := s.WaitIdle(context.Background()); err != nil {
+		t.Errorf("WaitIdle() after CloseActive() error = %v", err)
+	}
+}
+
+func TestServeAndFetch(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+
+	// Unix socket paths are limited to around 100 bytes, which t.TempDir() can exceed on macOS.
+	dir, err := os.MkdirTemp("", "iapgo")
+	if err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	socketPath := filepath.Join(dir, "stats.sock")
+
+	lsnr, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	defer func() { _ = lsnr.Close() }()
+
+	s := New("db")
+	s.AddReconnect()
+
+	go s.Serve(lsnr, logger)
+
+	snap, err := Fetch(socketPath)
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+
+	if snap.Section != "db" || snap.Reconnects != 1 || time.Since(snap.Started) > time.Minute {
+		t.Errorf("Fetch() = %+v", snap)
+	}
+
+	_, err = Fetch(filepath.Join(dir, "missing.sock"))
+	if err == nil {
+		t.Error("Fetch() of a missing socket succeeded")
+	}
+}
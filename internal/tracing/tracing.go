@@ -0,0 +1,182 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/constants"
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/LaoZhuBaba/iapgo/v2"
+
+// Tracer returns the tracer used for all of iapgo's spans.  Until Setup has been called this is a no-op
+// tracer, so instrumented code costs almost nothing when tracing is not enabled.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// Setup installs a global tracer provider that exports spans to an OTLP/HTTP collector at otlpEndpoint
+// (e.g., http://localhost:4318) and/or as JSON, one span per line, to the file at filePath.  The returned
+// function flushes any buffered spans and must be called before iapgo exits.
+func Setup(ctx context.Context, otlpEndpoint string, filePath string, section string) (func(context.Context) error, error) {
+	var (
+		opts    []sdktrace.TracerProviderOption
+		closers []func(context.Context) error
+	)
+
+	if otlpEndpoint != "" {
+		exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(otlpEndpoint))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", constants.ErrFailedToSetUpTracing, err)
+		}
+
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+
+	if filePath != "" {
+		f, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", constants.ErrFailedToSetUpTracing, err)
+		}
+
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			_ = f.Close()
+
+			return nil, fmt.Errorf("%w: %w", constants.ErrFailedToSetUpTracing, err)
+		}
+
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+		closers = append(closers, func(context.Context) error { return f.Close() })
+	}
+
+	res, err := resource.Merge(
+		resource.Default(),
+		resource.NewSchemaless(
+			attribute.String("service.name", "iapgo"),
+			attribute.String("iapgo.section", section),
+		),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", constants.ErrFailedToSetUpTracing, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(append(opts, sdktrace.WithResource(res))...)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		// The provider must be shut down first so that the exporters flush to the file before it closes.
+		errs := []error{provider.Shutdown(ctx)}
+		for _, c := range closers {
+			errs = append(errs, c(ctx))
+		}
+
+		return errors.Join(errs...)
+	}, nil
+}
+
+// RecordError marks span as failed if err is not nil.  It returns err so that it can be used in return
+// statements.
+func RecordError(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return err
+}
+
+// Conn is a local connection with a span that lasts for the lifetime of the connection.
+type Conn struct {
+	net.Conn
+	ctx       context.Context
+	span      trace.Span
+	closeOnce sync.Once
+}
+
+// Listener wraps lsnr so that a span named name is started for each accepted connection and ended when
+// the connection is closed.
+func Listener(lsnr net.Listener, name string) net.Listener {
+	return &listener{Listener: lsnr, name: name}
+}
+
+type listener struct {
+	net.Listener
+	name string
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, span := Tracer().Start(
+		context.Background(),
+		l.name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("network.transport", conn.LocalAddr().Network()),
+			attribute.String("network.peer.address", conn.RemoteAddr().String()),
+		),
+	)
+
+	// Connections made by the readiness probe are still traced, but marked so that they can be told apart.
+	if stats.IsProbe(conn) {
+		span.SetAttributes(attribute.Bool("iapgo.readiness_probe", true))
+	}
+
+	return &Conn{Conn: conn, ctx: ctx, span: span}, nil
+}
+
+// ConnContext returns ctx with the span of conn, if it has one, so that work done for the connection
+// (e.g., dialling the remote service) is recorded as part of the connection's trace.
+func ConnContext(ctx context.Context, conn net.Conn) context.Context {
+	c, ok := conn.(*Conn)
+	if !ok {
+		return ctx
+	}
+
+	return trace.ContextWithSpan(ctx, c.span)
+}
+
+// NetConn returns the connection being traced.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Fail records err on the connection's span.
+func (c *Conn) Fail(err error) {
+	_ = RecordError(c.span, err)
+}
+
+// Close closes the connection and ends its span, recording the bytes transferred if they were counted.
+func (c *Conn) Close() error {
+	err := c.Conn.Close()
+
+	c.closeOnce.Do(func() {
+		if counter, ok := c.Conn.(stats.ByteCounter); ok {
+			c.span.SetAttributes(
+				attribute.Int64("iapgo.bytes_to_remote", int64(counter.BytesToRemote())),
+				attribute.Int64("iapgo.bytes_from_remote", int64(counter.BytesFromRemote())),
+			)
+		}
+
+		c.span.End()
+	})
+
+	return err
+}
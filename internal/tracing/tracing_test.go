@@ -0,0 +1,142 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/LaoZhuBaba/iapgo/v2/internal/stats"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestListener(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	inner, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	lsnr := Listener(stats.New("test").Listener(inner), "iapgo.connection")
+	defer func() { _ = lsnr.Close() }()
+
+	go func() {
+		client, err := net.Dial("tcp", lsnr.Addr().String())
+		if err != nil {
+			return
+		}
+
+		_, _ = client.Write([]byte("hello"))
+		_ = client.Close()
+	}()
+
+	conn, err := lsnr.Accept()
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+
+	_, _ = io.ReadAll(conn)
+
+	// Work done for the connection should be recorded as a child of its span.
+	_, child := Tracer().Start(ConnContext(context.Background(), conn), "ssh.dial")
+	child.End()
+
+	conn.(*Conn).Fail(errors.New("dial failed"))
+
+	_ = conn.Close()
+	_ = conn.Close()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("got %d ended spans, want 2", len(spans))
+	}
+
+	dial, connSpan := spans[0], spans[1]
+
+	if connSpan.Name() != "iapgo.connection" {
+		t.Errorf("span name = %q, want iapgo.connection", connSpan.Name())
+	}
+
+	if dial.Parent().SpanID() != connSpan.SpanContext().SpanID() {
+		t.Errorf("ssh.dial parent = %v, want %v", dial.Parent().SpanID(), connSpan.SpanContext().SpanID())
+	}
+
+	if connSpan.Status().Code != codes.Error {
+		t.Errorf("span status = %v, want %v", connSpan.Status().Code, codes.Error)
+	}
+
+	want := attribute.Int64("iapgo.bytes_to_remote", 5)
+	found := false
+
+	for _, attr := range connSpan.Attributes() {
+		if attr == want {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Errorf("span attributes = %v, want %v", connSpan.Attributes(), want)
+	}
+
+	// A connection that was not accepted by a tracing listener leaves the context unchanged.
+	ctx := context.Background()
+	if got := ConnContext(ctx, &net.TCPConn{}); got != ctx {
+		t.Errorf("ConnContext() changed the context of an untraced connection")
+	}
+}
+
+func TestSetup(t *testing.T) {
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	path := filepath.Join(t.TempDir(), "trace.json")
+
+	shutdown, err := Setup(context.Background(), "", path, "test")
+	if err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+
+	_, span := Tracer().Start(context.Background(), "iapgo.start")
+	span.End()
+
+	err = shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("shutdown() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read trace file: %v", err)
+	}
+
+	var got struct {
+		Name string
+	}
+
+	err = json.Unmarshal(data, &got)
+	if err != nil {
+		t.Fatalf("trace file is not JSON: %v: %s", err, data)
+	}
+
+	if got.Name != "iapgo.start" {
+		t.Errorf("span name = %q, want iapgo.start", got.Name)
+	}
+
+	_, err = Setup(context.Background(), "", filepath.Join(t.TempDir(), "missing", "trace.json"), "test")
+	if err == nil {
+		t.Errorf("Setup() with an unwritable file did not fail")
+	}
+}